@@ -1 +1,211 @@
-package api
+// Package api is the control API of session daemon for external tools.
+//
+// Requests, responses and notifications are JSON-RPC 2.0 objects, each in
+// one line, over unix socket of session. Batch is not supported. Events are
+// sent as notifications of method "event" after events.subscribe.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is value of "jsonrpc" member
+const Version = "2.0"
+
+// Methods of session
+const (
+	// MethodConnectionsList return []Connection
+	MethodConnectionsList = "connections.list"
+	// MethodConnectionOpen take OpenParams, it return once connecting is
+	// started
+	MethodConnectionOpen = "connection.open"
+	// MethodConnectionClose take ConnParams
+	MethodConnectionClose = "connection.close"
+	// MethodSend take SendParams, text is handled like input of user
+	MethodSend = "send"
+	// MethodScrollbackGet take ScrollbackParams and return Scrollback
+	MethodScrollbackGet = "scrollback.get"
+	// MethodTriggersList take ConnParams and return []Trigger
+	MethodTriggersList = "triggers.list"
+	// MethodTriggersAdd take TriggerParams, trigger of the same name is
+	// replaced
+	MethodTriggersAdd = "triggers.add"
+	// MethodTriggersDel take TriggerParams with Name only
+	MethodTriggersDel = "triggers.del"
+	// MethodTriggersEnable take TriggerParams with Name or Group, and
+	// Enabled
+	MethodTriggersEnable = "triggers.enable"
+	// MethodVarsGet take VarParams with Name only and return the value
+	MethodVarsGet = "vars.get"
+	// MethodVarsSet take VarParams, null value deletes variable
+	MethodVarsSet = "vars.set"
+	// MethodEventsSubscribe take SubscribeParams
+	MethodEventsSubscribe = "events.subscribe"
+	// MethodEventsUnsubscribe take no params
+	MethodEventsUnsubscribe = "events.unsubscribe"
+
+	// MethodEvent is method of notifications of Event
+	MethodEvent = "event"
+)
+
+// Error codes defined by JSON-RPC
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerError is code of errors reported by methods
+	CodeServerError = -32000
+)
+
+// Error is error object of response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.Code, e.Message)
+}
+
+// Request is request or notification if ID is nil
+type Request struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+// Response is reply of request, ID is null if request can't be parsed
+type Response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// DecodeParams decode params into v, missing params leave v unchanged.
+// Error returned is an Error of CodeInvalidParams.
+func DecodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// Connection is a connection of session
+type Connection struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	// State is "connected", "closed" or "reconnect#n"
+	State   string `json:"state"`
+	Current bool   `json:"current,omitempty"`
+}
+
+// ConnParams name a connection, empty Conn means the current one. For
+// triggers, empty Conn means triggers of session.
+type ConnParams struct {
+	Conn string `json:"conn,omitempty"`
+}
+
+// OpenParams are params of connection.open, connection is created if it
+// doesn't exist and becomes current. TLS settings of connection are kept
+// if TLS or Insecure is nil.
+type OpenParams struct {
+	Conn     string `json:"conn,omitempty"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Charset  string `json:"charset,omitempty"`
+	TLS      *bool  `json:"tls,omitempty"`
+	Insecure *bool  `json:"insecure,omitempty"`
+}
+
+// SendParams are params of send
+type SendParams struct {
+	Conn string `json:"conn,omitempty"`
+	Text string `json:"text"`
+}
+
+// ScrollbackParams are params of scrollback.get, lines before line of id
+// Before are returned, 0 means the latest lines
+type ScrollbackParams struct {
+	Before uint64 `json:"before,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// Line is an output line of session
+type Line struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	Conn string    `json:"conn,omitempty"`
+	// Text is line without color and line end
+	Text string `json:"text"`
+	// Partial is set for the latest line not ended yet
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Scrollback is result of scrollback.get, lines are in order
+type Scrollback struct {
+	Lines []Line `json:"lines"`
+}
+
+// Trigger is a trigger, see /trigger add for meaning of fields
+type Trigger struct {
+	Name     string `json:"name"`
+	Pattern  string `json:"pattern"`
+	Type     string `json:"type,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Body     string `json:"body"`
+	Group    string `json:"group,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Prompt   bool   `json:"prompt,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// TriggerParams are params of triggers.add, triggers.del and
+// triggers.enable, triggers.enable takes Group instead of Name to enable a
+// group
+type TriggerParams struct {
+	Conn    string   `json:"conn,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Group   string   `json:"group,omitempty"`
+	Enabled bool     `json:"enabled,omitempty"`
+	Trigger *Trigger `json:"trigger,omitempty"`
+}
+
+// VarParams are params of vars.get and vars.set
+type VarParams struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Types of Event
+const (
+	// EventLine is a line from server, Text is the line and Prompt is set
+	// for prompt
+	EventLine = "line"
+	// EventConn is lifecycle event of connection, Text is the event and
+	// Detail describes it
+	EventConn = "conn"
+)
+
+// SubscribeParams are params of events.subscribe, empty Types means all
+type SubscribeParams struct {
+	Types []string `json:"types,omitempty"`
+}
+
+// Event is params of notification "event"
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Conn   string    `json:"conn,omitempty"`
+	Text   string    `json:"text"`
+	Detail string    `json:"detail,omitempty"`
+	Prompt bool      `json:"prompt,omitempty"`
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// eventQueueSize is the number of events buffered by Client
+const eventQueueSize = 256
+
+// ErrClientClosed is returned by calls after connection is closed
+var ErrClientClosed = errors.New("api: connection closed")
+
+// Client calls methods of session, it's safe for concurrent use. Events
+// subscribed must be read from Events, or the session closes the
+// connection when its queue is full.
+type Client struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	events chan *Event
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *Response
+	err     error
+}
+
+// Dial connect control socket of session at path
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient return client calling over conn
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		events:  make(chan *Event, eventQueueSize),
+		pending: make(map[uint64]chan *Response),
+	}
+	go c.reader()
+	return c
+}
+
+// Close close the connection, pending calls return ErrClientClosed
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Events return channel of subscribed events, it's closed with connection
+func (c *Client) Events() <-chan *Event {
+	return c.events
+}
+
+func (c *Client) reader() {
+	defer close(c.events)
+
+	r := bufio.NewScanner(c.conn)
+	r.Buffer(make([]byte, 4096), maxRequestSize)
+	for r.Scan() {
+		var msg struct {
+			Response
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(r.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Method == MethodEvent {
+			e := &Event{}
+			if json.Unmarshal(msg.Params, e) == nil {
+				c.events <- e
+			}
+			continue
+		}
+		if msg.ID == nil {
+			continue
+		}
+		id, err := strconv.ParseUint(string(*msg.ID), 10, 64)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			resp := msg.Response
+			ch <- &resp
+		}
+	}
+
+	c.mu.Lock()
+	c.err = ErrClientClosed
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// Call call method with params and decode its result into result, result
+// may be nil if it's not needed. Error reported by session is an Error.
+func (c *Client) Call(method string, params, result interface{}) error {
+	var raw json.RawMessage
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		raw = b
+	}
+
+	ch := make(chan *Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	rawID := json.RawMessage(strconv.FormatUint(id, 10))
+	b, _ := json.Marshal(&Request{JSONRPC: Version, ID: &rawID, Method: method, Params: raw})
+	c.wmu.Lock()
+	_, err := c.conn.Write(append(b, '\n'))
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		return ErrClientClosed
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Connections return connections of session
+func (c *Client) Connections() ([]Connection, error) {
+	var list []Connection
+	err := c.Call(MethodConnectionsList, nil, &list)
+	return list, err
+}
+
+// Open open connection as p
+func (c *Client) Open(p *OpenParams) error {
+	return c.Call(MethodConnectionOpen, p, nil)
+}
+
+// CloseConn close connection conn, empty conn means the current one
+func (c *Client) CloseConn(conn string) error {
+	return c.Call(MethodConnectionClose, &ConnParams{Conn: conn}, nil)
+}
+
+// Send handle text like input of user on connection conn, empty conn means
+// the current one
+func (c *Client) Send(conn, text string) error {
+	return c.Call(MethodSend, &SendParams{Conn: conn, Text: text}, nil)
+}
+
+// Scrollback return at most count lines before line of id before, 0 means
+// the latest lines
+func (c *Client) Scrollback(before uint64, count int) ([]Line, error) {
+	sb := &Scrollback{}
+	err := c.Call(MethodScrollbackGet, &ScrollbackParams{Before: before, Count: count}, sb)
+	return sb.Lines, err
+}
+
+// Triggers return triggers of connection conn, empty conn means triggers
+// of session
+func (c *Client) Triggers(conn string) ([]Trigger, error) {
+	var list []Trigger
+	err := c.Call(MethodTriggersList, &ConnParams{Conn: conn}, &list)
+	return list, err
+}
+
+// AddTrigger add t to triggers of connection conn
+func (c *Client) AddTrigger(conn string, t *Trigger) error {
+	return c.Call(MethodTriggersAdd, &TriggerParams{Conn: conn, Trigger: t}, nil)
+}
+
+// DelTrigger remove trigger name of connection conn
+func (c *Client) DelTrigger(conn, name string) error {
+	return c.Call(MethodTriggersDel, &TriggerParams{Conn: conn, Name: name}, nil)
+}
+
+// EnableTrigger enable or disable trigger name of connection conn
+func (c *Client) EnableTrigger(conn, name string, enabled bool) error {
+	return c.Call(MethodTriggersEnable, &TriggerParams{Conn: conn, Name: name, Enabled: enabled}, nil)
+}
+
+// Var decode value of variable name into v
+func (c *Client) Var(name string, v interface{}) error {
+	return c.Call(MethodVarsGet, &VarParams{Name: name}, v)
+}
+
+// SetVar set variable name, nil value deletes it
+func (c *Client) SetVar(name string, value interface{}) error {
+	return c.Call(MethodVarsSet, &VarParams{Name: name, Value: value}, nil)
+}
+
+// Subscribe receive events of types from Events, no types means all
+func (c *Client) Subscribe(types ...string) error {
+	return c.Call(MethodEventsSubscribe, &SubscribeParams{Types: types}, nil)
+}
+
+// Unsubscribe stop receiving events
+func (c *Client) Unsubscribe() error {
+	return c.Call(MethodEventsUnsubscribe, nil, nil)
+}
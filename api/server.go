@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxRequestSize is the max length of request line
+const maxRequestSize = 1 << 20
+
+// connQueueSize is the number of messages queued for a connection, slower
+// one is closed so that events never block session
+const connQueueSize = 1024
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("api: server closed")
+
+// HandlerFunc handles a method, result is encoded as JSON. Error other than
+// Error is reported with CodeServerError.
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
+
+// Server serves methods registered by Handle
+type Server struct {
+	mu       sync.Mutex
+	methods  map[string]HandlerFunc
+	conns    map[*serverConn]struct{}
+	lns      []net.Listener
+	shutdown bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		methods: make(map[string]HandlerFunc),
+		conns:   make(map[*serverConn]struct{}),
+	}
+}
+
+// Handle register h for method, the one registered before is replaced
+func (s *Server) Handle(method string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.methods[method] = h
+}
+
+// Serve accept connections on ln until it's closed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns = append(s.lns, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serve requests on conn until it's closed
+func (s *Server) ServeConn(conn net.Conn) {
+	c := &serverConn{
+		conn: conn,
+		out:  make(chan []byte, connQueueSize),
+	}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	go c.writer()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		c.close()
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewScanner(conn)
+	r.Buffer(make([]byte, 4096), maxRequestSize)
+	for r.Scan() {
+		if len(r.Bytes()) == 0 {
+			continue
+		}
+		resp := s.handle(c, r.Bytes())
+		if resp == nil {
+			continue
+		}
+		b, _ := json.Marshal(resp)
+		s.mu.Lock()
+		ok := c.send(b)
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// Close close listeners and connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdown = true
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+	s.lns = nil
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// Publish send e to connections subscribing its type, it never blocks
+func (s *Server) Publish(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b []byte
+	for c := range s.conns {
+		if !c.subscribed(e.Type) {
+			continue
+		}
+		if b == nil {
+			params, _ := json.Marshal(e)
+			b, _ = json.Marshal(&Request{JSONRPC: Version, Method: MethodEvent, Params: params})
+		}
+		if !c.send(b) {
+			// falling behind, close it rather than lose events silently
+			c.conn.Close()
+		}
+	}
+}
+
+// HasSubscriber report if any connection subscribes events of type typ, so
+// that events are only built when needed
+func (s *Server) HasSubscriber(typ string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		if c.subscribed(typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle run request in line from c, it return nil for notification
+func (s *Server) handle(c *serverConn, line []byte) *Response {
+	req := &Request{}
+	if err := json.Unmarshal(line, req); err != nil {
+		code := CodeParseError
+		if json.Valid(line) {
+			code = CodeInvalidRequest
+		}
+		return &Response{JSONRPC: Version, Error: &Error{Code: code, Message: err.Error()}}
+	}
+	if req.JSONRPC != Version || len(req.Method) == 0 {
+		return &Response{JSONRPC: Version, ID: req.ID, Error: &Error{Code: CodeInvalidRequest, Message: "invalid request"}}
+	}
+
+	result, err := s.call(c, req)
+	if req.ID == nil {
+		return nil
+	}
+	resp := &Response{JSONRPC: Version, ID: req.ID}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = &Error{Code: CodeServerError, Message: err.Error()}
+		}
+		resp.Result = nil
+		resp.Error = e
+	}
+	return resp
+}
+
+func (s *Server) call(c *serverConn, req *Request) (interface{}, error) {
+	switch req.Method {
+	case MethodEventsSubscribe:
+		p := &SubscribeParams{}
+		if err := DecodeParams(req.Params, p); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		c.types = map[string]bool{}
+		for _, t := range p.Types {
+			c.types[t] = true
+		}
+		c.events = true
+		s.mu.Unlock()
+		return true, nil
+	case MethodEventsUnsubscribe:
+		s.mu.Lock()
+		c.events = false
+		s.mu.Unlock()
+		return true, nil
+	}
+
+	s.mu.Lock()
+	h, ok := s.methods[req.Method]
+	s.mu.Unlock()
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	return h(req.Params)
+}
+
+// serverConn is a connection of client, messages are written by its own
+// goroutine
+type serverConn struct {
+	conn net.Conn
+
+	// fields below are guarded by mu of Server
+	out    chan []byte
+	closed bool
+	events bool
+	types  map[string]bool
+}
+
+func (c *serverConn) writer() {
+	defer c.conn.Close()
+
+	for b := range c.out {
+		if _, err := c.conn.Write(append(b, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+// subscribed report if c subscribes events of type typ
+func (c *serverConn) subscribed(typ string) bool {
+	return c.events && (len(c.types) == 0 || c.types[typ])
+}
+
+// send queue message b, it return false if the queue is full
+func (c *serverConn) send(b []byte) bool {
+	if c.closed {
+		return true
+	}
+	select {
+	case c.out <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *serverConn) close() {
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() *Server {
+	s := NewServer()
+	s.Handle("echo", func(params json.RawMessage) (interface{}, error) {
+		var v interface{}
+		if err := DecodeParams(params, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+	s.Handle("int", func(params json.RawMessage) (interface{}, error) {
+		var n int
+		if err := DecodeParams(params, &n); err != nil {
+			return nil, err
+		}
+		return n, nil
+	})
+	s.Handle("fail", func(params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	return s
+}
+
+func TestServerCall(t *testing.T) {
+	s := newTestServer()
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	c := NewClient(client)
+	defer c.Close()
+
+	var got map[string]int
+	if err := c.Call("echo", map[string]int{"a": 1}, &got); err != nil || got["a"] != 1 {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	for _, tc := range []struct {
+		method string
+		code   int
+	}{
+		{"fail", CodeServerError},
+		{"missing", CodeMethodNotFound},
+	} {
+		err := c.Call(tc.method, nil, nil)
+		if e, ok := err.(*Error); !ok || e.Code != tc.code {
+			t.Errorf("%s: got %v", tc.method, err)
+		}
+	}
+}
+
+func TestServerInvalidRequest(t *testing.T) {
+	s := newTestServer()
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	for _, tc := range []struct {
+		req  string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","method":`, CodeParseError},
+		{`[{"jsonrpc":"2.0","id":1,"method":"echo"}]`, CodeInvalidRequest},
+		{`{"jsonrpc":"1.0","id":1,"method":"echo"}`, CodeInvalidRequest},
+		// notification is not replied, so next response is of the request
+		{`{"jsonrpc":"2.0","method":"echo"}` + "\n" + `{"jsonrpc":"2.0","id":2,"method":"int","params":"x"}`, CodeInvalidParams},
+	} {
+		client.Write([]byte(tc.req + "\n"))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &Response{}
+		if err := json.Unmarshal([]byte(line), resp); err != nil || resp.Error == nil || resp.Error.Code != tc.code {
+			t.Errorf("%s: got %s", tc.req, strings.TrimSpace(line))
+		}
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	s := newTestServer()
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	c := NewClient(client)
+	defer c.Close()
+
+	s.Publish(&Event{Type: EventLine, Text: "before"})
+	if err := c.Subscribe(EventConn); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasSubscriber(EventLine) || !s.HasSubscriber(EventConn) {
+		t.Fatal("subscription of types is not kept")
+	}
+	s.Publish(&Event{Type: EventLine, Text: "line"})
+	s.Publish(&Event{Type: EventConn, Text: "connected"})
+	select {
+	case e := <-c.Events():
+		if e.Type != EventConn || e.Text != "connected" {
+			t.Fatalf("got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	// subscriber never reading is closed rather than blocking publisher
+	slow, server := net.Pipe()
+	defer slow.Close()
+	go s.ServeConn(server)
+	slow.Write([]byte(`{"jsonrpc":"2.0","method":"events.subscribe"}` + "\n"))
+	for !s.HasSubscriber(EventLine) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < connQueueSize+10; i++ {
+		s.Publish(&Event{Type: EventLine, Text: "x"})
+	}
+	for s.HasSubscriber(EventLine) {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Close()
+	if err := c.Call("echo", nil, nil); err == nil {
+		t.Fatal("call succeeded after server is closed")
+	}
+}
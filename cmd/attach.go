@@ -18,18 +18,22 @@ package cmd
 import (
 	"os"
 
+	"github.com/defsky/xtelnet/session"
 	"github.com/defsky/xtelnet/xui"
 
 	"github.com/spf13/cobra"
 )
 
 var detachAnyOther bool
+var attachReadonly bool
+var attachRemote session.RemoteOptions
 
 // attachCmd represents the attach command
 var attachCmd = &cobra.Command{
-	Use:   "attach <session name>",
+	Use:   "attach <session name | host:port/session name>",
 	Short: "attach to the specified session",
-	Long:  `attach to the specified session`,
+	Long: `attach to the specified session, session on other host is attached
+over TLS with access token generated there by "xtelnet token"`,
 	Args:  cobra.ExactArgs(1),
 	PreRun: func(cmd *cobra.Command, args []string) {
 		os.Setenv("RUNEWIDTH_EASTASIAN", "1")
@@ -37,7 +41,11 @@ var attachCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 
 		ui := xui.NewXUI()
-		ui.Attach(args[0], detachAnyOther)
+		ui.Attach(args[0], xui.AttachOptions{
+			Detach:   detachAnyOther,
+			Readonly: attachReadonly,
+			Remote:   attachRemote,
+		})
 	},
 }
 
@@ -54,4 +62,9 @@ func init() {
 	// is called directly, e.g.:
 	// attachCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	attachCmd.Flags().BoolVarP(&detachAnyOther, "detach", "d", false, "Detach any other attaching, and attach from here")
+	attachCmd.Flags().BoolVarP(&attachReadonly, "readonly", "r", false, "Attach as spectator, input is refused")
+	attachCmd.Flags().StringVar(&attachRemote.Token, "token", "", "Access token of session on other host")
+	attachCmd.Flags().StringVar(&attachRemote.Fingerprint, "fingerprint", "", "SHA-256 fingerprint of certificate of session on other host")
+	attachCmd.Flags().StringVar(&attachRemote.CAFile, "ca", "", "PEM file of CA certificates to verify session on other host")
+	attachCmd.Flags().BoolVar(&attachRemote.Insecure, "insecure", false, "Skip verification of certificate of session on other host")
 }
@@ -16,10 +16,12 @@ limitations under the License.
 package cmd
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/defsky/xtelnet/proto"
 	"github.com/defsky/xtelnet/session"
@@ -91,6 +93,17 @@ func getSessionStatus(d, s string) string {
 	}
 	defer conn.Close()
 
+	if _, err := proto.ClientHandshake(conn); err != nil {
+		if err == proto.ENoHandshake {
+			return fmt.Sprintf("%-20s  (%s)", s, "Old version")
+		}
+		if _, ok := err.(*proto.VersionError); ok {
+			return fmt.Sprintf("%-20s  (%s)", s, "Incompatible")
+		}
+		os.Remove(fpath)
+		return ""
+	}
+
 	p := &proto.Packet{}
 	p.Opcode = proto.CM_QUERY_DETACH_STATUS
 	err = proto.WritePacket(conn, p)
@@ -107,7 +120,7 @@ func getSessionStatus(d, s string) string {
 	case proto.SM_DETACH_STATUS:
 		b, _ := retp.ReadByte()
 		if uint8(b) == 0 {
-			return fmt.Sprintf("%-20s  (%s)", s, "Attached")
+			return fmt.Sprintf("%-20s  (%s)", s, attachedClients(retp))
 		}
 		if uint8(b) == 1 {
 			return fmt.Sprintf("%-20s  (%s)", s, "Detached")
@@ -117,3 +130,20 @@ func getSessionStatus(d, s string) string {
 		return fmt.Sprintf("%-20s  (%s)", s, "Unknown ")
 	}
 }
+
+// attachedClients describe attached clients in data of SM_DETACH_STATUS p
+func attachedClients(p *proto.Packet) string {
+	if p.Len() < 2 {
+		return "Attached"
+	}
+	n := int(binary.BigEndian.Uint16(p.Next(2)))
+	modes := []string{}
+	for _, m := range p.Next(n) {
+		if m == 1 {
+			modes = append(modes, "read-only")
+		} else {
+			modes = append(modes, "read-write")
+		}
+	}
+	return fmt.Sprintf("Attached, %d clients: %s", n, strings.Join(modes, ", "))
+}
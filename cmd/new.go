@@ -141,5 +141,5 @@ func init() {
 	// newCmd.PersistentFlags().String("foo", "", "A help for foo")
 	// newCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	newCmd.Flags().BoolVarP(&isDetached, "detach", "d", false, "create new session in detached status")
-	newCmd.Flags().StringVarP(&cmdFile, "file", "f", "", "specify startup command file name")
+	newCmd.Flags().StringVarP(&cmdFile, "file", "f", "", "specify lua script run at startup, after init.lua of profile")
 }
@@ -0,0 +1,68 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/defsky/xtelnet/session"
+
+	"github.com/spf13/cobra"
+)
+
+var revokeToken bool
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token <session name>",
+	Short: "generate access token of session",
+	Long: `generate access token for attaching session from other hosts or web
+browser, the former token is revoked. Listeners of session are started by
+"/remote listen" and "/web listen".`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		if revokeToken {
+			if err := session.RevokeToken(name); err != nil {
+				fmt.Printf("  %s\n", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("  Access token of %s is revoked\n", name)
+			return
+		}
+
+		token, err := session.NewToken(name)
+		if err != nil {
+			fmt.Printf("  %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("  Token: %s\n", token)
+		if fp := session.RemoteFingerprint(name); len(fp) > 0 {
+			fmt.Printf("  Fingerprint: %s\n", fp)
+			fmt.Printf("  Usage: xtelnet attach <host:port>/%s --token %s --fingerprint %s\n", name, token, fp)
+		} else {
+			fmt.Printf("  Usage: xtelnet attach <host:port>/%s --token %s\n", name, token)
+		}
+		fmt.Printf("  Web: open http://<host:port>/#token=%s\n", token)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+
+	tokenCmd.Flags().BoolVar(&revokeToken, "revoke", false, "Revoke access token, remote attaching is refused")
+}
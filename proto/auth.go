@@ -0,0 +1,66 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// AuthPacket return CM_AUTH packet for session with token
+func AuthPacket(session, token string) *Packet {
+	p := &Packet{}
+	p.Opcode = CM_AUTH
+	binary.Write(p, binary.BigEndian, uint16(len(session)))
+	p.WriteString(session)
+	p.WriteString(token)
+	return p
+}
+
+// ParseAuth return session name and token in CM_AUTH packet p
+func ParseAuth(p *Packet) (string, string, error) {
+	data := p.Bytes()
+	if len(data) < 2 {
+		return "", "", EInvalidPacket
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", "", EInvalidPacket
+	}
+	return string(data[2 : 2+n]), string(data[2+n:]), nil
+}
+
+// ClientAuth send CM_AUTH to server c and wait for the reply, it return
+// reason from server if it's denied
+func ClientAuth(c net.Conn, session, token string) error {
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	if err := WritePacket(c, AuthPacket(session, token)); err != nil {
+		return err
+	}
+	p, err := ReadPacket(c)
+	if err != nil {
+		return err
+	}
+	if p.Opcode != SM_AUTH_ACK {
+		return EInvalidPacket
+	}
+	if b, err := p.ReadByte(); err != nil || b != 1 {
+		return errors.New(p.String())
+	}
+	return nil
+}
+
+// AuthAck return SM_AUTH_ACK packet, it's accepted if err is nil
+func AuthAck(err error) *Packet {
+	p := &Packet{}
+	p.Opcode = SM_AUTH_ACK
+	if err != nil {
+		p.WriteByte(0)
+		p.WriteString(err.Error())
+	} else {
+		p.WriteByte(1)
+	}
+	return p
+}
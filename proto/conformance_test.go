@@ -0,0 +1,204 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// frame return packet bytes of opcode and data with length field n
+func frame(n uint32, opcode uint16, data string) []byte {
+	b := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n), byte(opcode >> 8), byte(opcode)}
+	return append(b, data...)
+}
+
+func TestReadPacketConformance(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  []byte
+		opcode uint16
+		data   string
+		err    error
+	}{
+		{"opcode only", frame(2, CM_QUERY_DETACH_STATUS, ""), CM_QUERY_DETACH_STATUS, "", nil},
+		{"with data", frame(7, CM_USER_INPUT, "look\n"), CM_USER_INPUT, "look\n", nil},
+		{"zero length", frame(0, 0, "")[:4], 0, "", EInvalidPacket},
+		{"length shorter than opcode", frame(1, 0, "")[:5], 0, "", EInvalidPacket},
+		{"length too large", frame(maxPacketSize+1, CM_USER_INPUT, ""), 0, "", EInvalidPacket},
+		{"closed between packets", nil, 0, "", io.EOF},
+		{"closed in head", frame(7, CM_USER_INPUT, "")[:2], 0, "", io.ErrUnexpectedEOF},
+		{"closed in data", frame(7, CM_USER_INPUT, "lo"), 0, "", io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		// full read is required even if data comes one byte at a time
+		for _, r := range []io.Reader{bytes.NewReader(c.input), iotest.OneByteReader(bytes.NewReader(c.input))} {
+			p, err := ReadPacket(r)
+			if err != c.err {
+				t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+				continue
+			}
+			if err == nil && (p.Opcode != c.opcode || p.String() != c.data) {
+				t.Errorf("%s: got %#04x %q", c.name, p.Opcode, p.String())
+			}
+		}
+	}
+}
+
+func TestWritePacketConformance(t *testing.T) {
+	out := new(bytes.Buffer)
+	for _, data := range []string{"", "a", strings.Repeat("x", 70000)} {
+		p := &Packet{}
+		p.Opcode = SM_HISTORY
+		p.WriteString(data)
+		if err := WritePacket(out, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, data := range []string{"", "a", strings.Repeat("x", 70000)} {
+		p, err := ReadPacket(out)
+		if err != nil || p.Opcode != SM_HISTORY || p.String() != data {
+			t.Fatalf("round trip of %d bytes failed: %v", len(data), err)
+		}
+	}
+}
+
+func TestOpcodeRanges(t *testing.T) {
+	legacy := []uint16{SM_DETACH_STATUS, SM_ATTACH_ACK, CM_SCREEN_SIZE, CM_USER_INPUT, CM_QUERY_DETACH_STATUS, CM_ATTACH_REQ}
+	core := []uint16{CM_HELLO, SM_CONN_EVENT, CM_CLIENT_COLORS, CM_HISTORY_REQ, SM_HISTORY, SM_HELLO, CM_AUTH, SM_AUTH_ACK}
+
+	// values of the first protocol never change
+	for i, op := range legacy {
+		if op != uint16(i+1) {
+			t.Errorf("legacy opcode %d changed to %#04x", i+1, op)
+		}
+	}
+	seen := map[uint16]bool{}
+	for _, op := range core {
+		if op < OpcodeCoreMin || op >= OpcodeExtMin {
+			t.Errorf("core opcode %#04x out of range", op)
+		}
+		if seen[op] {
+			t.Errorf("duplicated opcode %#04x", op)
+		}
+		seen[op] = true
+	}
+}
+
+func TestHelloConformance(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		version  uint16
+		features []string
+		err      error
+	}{
+		{"no features", "XTEL\x00\x01", 1, nil, nil},
+		{"features", "XTEL\x00\x01history,conn-event", 1, []string{"history", "conn-event"}, nil},
+		{"bad magic", "XTEX\x00\x01", 0, nil, EInvalidPacket},
+		{"short", "XTEL\x00", 0, nil, EInvalidPacket},
+	}
+	for _, c := range cases {
+		p := &Packet{}
+		p.Opcode = CM_HELLO
+		p.WriteString(c.data)
+		h, err := ParseHello(p)
+		if err != c.err {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if err == nil && (h.Version != c.version || strings.Join(h.Features, ",") != strings.Join(c.features, ",")) {
+			t.Errorf("%s: got %+v", c.name, h)
+		}
+	}
+
+	h, _ := ParseHello(NewHello().Packet(SM_HELLO))
+	if h.Version != Version || !h.Has(FeatureHistory) || h.Has("unknown") {
+		t.Errorf("got %+v from hello of this side", h)
+	}
+	for _, v := range []uint16{MinVersion - 1, Version + 1} {
+		if err := (&Hello{Version: v}).Check(); err == nil {
+			t.Errorf("want error for version %d", v)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	defer func(d time.Duration) { HandshakeTimeout = d }(HandshakeTimeout)
+	HandshakeTimeout = 200 * time.Millisecond
+
+	cases := []struct {
+		name   string
+		server func(net.Conn)
+		check  func(*Hello, error) bool
+	}{
+		{"compatible", func(c net.Conn) {
+			p, _ := ReadPacket(c)
+			if h, err := ServerHandshake(c, p); err != nil || !h.Has(FeatureHistory) {
+				c.Close()
+			}
+		}, func(h *Hello, err error) bool {
+			return err == nil && h.Version == Version
+		}},
+		{"newer server", func(c net.Conn) {
+			ReadPacket(c)
+			WritePacket(c, (&Hello{Version: Version + 1}).Packet(SM_HELLO))
+		}, func(h *Hello, err error) bool {
+			_, ok := err.(*VersionError)
+			return ok && h.Version == Version+1
+		}},
+		{"server without handshake", func(c net.Conn) {
+			ReadPacket(c)
+		}, func(h *Hello, err error) bool {
+			return err == ENoHandshake
+		}},
+		{"unexpected reply", func(c net.Conn) {
+			ReadPacket(c)
+			WritePacket(c, &Packet{Opcode: SM_DETACH_STATUS})
+		}, func(h *Hello, err error) bool {
+			return err == ENoHandshake
+		}},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go c.server(server)
+		h, err := ClientHandshake(client)
+		if !c.check(h, err) {
+			t.Errorf("%s: got %+v, %v", c.name, h, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestAuthConformance(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		session string
+		token   string
+		err     error
+	}{
+		{"session and token", "\x00\x03mudsecret", "mud", "secret", nil},
+		{"empty token", "\x00\x03mud", "mud", "", nil},
+		{"short", "\x00", "", "", EInvalidPacket},
+		{"name too long", "\x00\x05mud", "", "", EInvalidPacket},
+	}
+	for _, c := range cases {
+		p := &Packet{}
+		p.Opcode = CM_AUTH
+		p.WriteString(c.data)
+		session, token, err := ParseAuth(p)
+		if err != c.err || session != c.session || token != c.token {
+			t.Errorf("%s: got %q %q %v", c.name, session, token, err)
+		}
+	}
+
+	session, token, _ := ParseAuth(AuthPacket("1.mud", "t"))
+	if session != "1.mud" || token != "t" {
+		t.Errorf("got %q %q", session, token)
+	}
+}
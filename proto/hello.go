@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Version of protocol, it's increased on incompatible changes
+const Version uint16 = 1
+
+// MinVersion is the oldest version of peer still supported
+const MinVersion uint16 = 1
+
+// Features of protocol. A feature may be added without changing Version,
+// it's only used if both sides advertise it.
+const (
+	// FeatureConnEvent is SM_CONN_EVENT
+	FeatureConnEvent = "conn-event"
+	// FeatureClientColors is CM_CLIENT_COLORS
+	FeatureClientColors = "client-colors"
+	// FeatureHistory is CM_HISTORY_REQ and SM_HISTORY
+	FeatureHistory = "history"
+	// FeatureReadOnly is read-only bit of CM_ATTACH_REQ
+	FeatureReadOnly = "read-only"
+)
+
+// Features is features supported by this side
+var Features = []string{FeatureConnEvent, FeatureClientColors, FeatureHistory, FeatureReadOnly}
+
+// helloMagic starts data of hello packets
+const helloMagic = "XTEL"
+
+// HandshakeTimeout is the max time to wait for reply of CM_HELLO
+var HandshakeTimeout = 5 * time.Second
+
+// ENoHandshake means peer doesn't reply CM_HELLO, it's older than the first
+// version of handshake
+var ENoHandshake = errors.New("peer does not support protocol handshake")
+
+// VersionError means version of peer is not supported
+type VersionError struct {
+	Peer uint16
+}
+
+func (e *VersionError) Error() string {
+	if e.Peer < MinVersion {
+		return fmt.Sprintf("peer protocol version %d is too old, version %d to %d is required", e.Peer, MinVersion, Version)
+	}
+	return fmt.Sprintf("peer protocol version %d is too new, version %d to %d is required", e.Peer, MinVersion, Version)
+}
+
+// Hello is data of CM_HELLO and SM_HELLO.
+//
+// Data structure:
+//  0-3 byte: "XTEL"
+//  4-5 byte: uint16, protocol version
+//  6 byte: []byte, supported features separated by comma
+type Hello struct {
+	Version  uint16
+	Features []string
+}
+
+// NewHello return hello of this side
+func NewHello() *Hello {
+	return &Hello{
+		Version:  Version,
+		Features: Features,
+	}
+}
+
+// Packet return hello packet with opcode
+func (h *Hello) Packet(opcode uint16) *Packet {
+	p := &Packet{}
+	p.Opcode = opcode
+	p.WriteString(helloMagic)
+	binary.Write(p, binary.BigEndian, h.Version)
+	p.WriteString(strings.Join(h.Features, ","))
+	return p
+}
+
+// ParseHello parse data of hello packet p
+func ParseHello(p *Packet) (*Hello, error) {
+	data := p.Bytes()
+	if len(data) < len(helloMagic)+2 || string(data[:len(helloMagic)]) != helloMagic {
+		return nil, EInvalidPacket
+	}
+	data = data[len(helloMagic):]
+	h := &Hello{Version: binary.BigEndian.Uint16(data)}
+	if len(data) > 2 {
+		h.Features = strings.Split(string(data[2:]), ",")
+	}
+	return h, nil
+}
+
+// Has report if feature f is advertised in h
+func (h *Hello) Has(f string) bool {
+	for _, v := range h.Features {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Check report error if version of h is not supported
+func (h *Hello) Check() error {
+	if h.Version < MinVersion || h.Version > Version {
+		return &VersionError{Peer: h.Version}
+	}
+	return nil
+}
+
+// ClientHandshake send CM_HELLO to server c and return its reply
+func ClientHandshake(c net.Conn) (*Hello, error) {
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	if err := WritePacket(c, NewHello().Packet(CM_HELLO)); err != nil {
+		return nil, err
+	}
+	p, err := ReadPacket(c)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, ENoHandshake
+		}
+		return nil, err
+	}
+	if p.Opcode != SM_HELLO {
+		return nil, ENoHandshake
+	}
+	h, err := ParseHello(p)
+	if err != nil {
+		return nil, err
+	}
+	return h, h.Check()
+}
+
+// ServerHandshake reply CM_HELLO packet p from client c and return hello of
+// client. Server always replies so that client can report version of both.
+func ServerHandshake(c net.Conn, p *Packet) (*Hello, error) {
+	h, err := ParseHello(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := WritePacket(c, NewHello().Packet(SM_HELLO)); err != nil {
+		return nil, err
+	}
+	return h, h.Check()
+}
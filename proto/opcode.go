@@ -1,10 +1,26 @@
 package proto
 
+// Opcodes are divided into ranges:
+//  0x0001-0x00ff: opcodes of the first protocol, numbered by iota
+//  0x0100-0x0fff: core opcodes, numbered explicitly
+//  0x1000-0x7fff: extensions, an extension opcode is only sent to peer
+//                 advertising the feature it belongs to in hello
+//  0x8000-0xffff: private use, they are never defined here
+const (
+	OpcodeLegacyMin  uint16 = 0x0001
+	OpcodeCoreMin    uint16 = 0x0100
+	OpcodeExtMin     uint16 = 0x1000
+	OpcodePrivateMin uint16 = 0x8000
+)
+
 const (
 	// SM_DETACH_STATUS is server message.
 	//
 	// Data structure:
 	//  0 byte: uint8, 1 detached 0 attached
+	//  1-2 byte: uint16, number of attached clients
+	//  3 byte: []uint8, mode of each attached client, 1 read-only 0
+	//          read-write
 	SM_DETACH_STATUS uint16 = iota + 1
 
 	// SM_ATTACH_ACK is server message.
@@ -36,6 +52,65 @@ const (
 	// CM_ATTACH_REQ is client message.
 	//
 	// Data structure:
-	//  0 byte: uint8, 1 detach other and attach, 0 only attach
+	//  0 byte: uint8, bit 0 set to detach others, bit 1 set to attach
+	//          read-only
 	CM_ATTACH_REQ
 )
+
+// Opcodes below are numbered explicitly, so adding one never shifts the
+// value of others on the wire.
+const (
+	// CM_HELLO is client message, it must be the first packet of a
+	// connection.
+	//
+	// Data structure: see Hello
+	CM_HELLO uint16 = 0x0100
+
+	// SM_CONN_EVENT is server message.
+	//
+	// Data structure:
+	//  []byte, connection name and lifecycle event separated by space
+	SM_CONN_EVENT uint16 = 0x0101
+
+	// CM_CLIENT_COLORS is client message.
+	//
+	// Data structure:
+	//  0 byte: uint8, bit 0 set if 256 colors are supported, bit 1 set if
+	//          24-bit colors are supported
+	CM_CLIENT_COLORS uint16 = 0x0102
+
+	// CM_HISTORY_REQ is client message.
+	//
+	// Data structure:
+	//  0-7 byte: uint64, id of output line, lines before it are requested,
+	//            0 for the latest ones
+	//  8-9 byte: uint16, max number of lines
+	CM_HISTORY_REQ uint16 = 0x0103
+
+	// SM_HISTORY is server message, it's the reply of CM_HISTORY_REQ.
+	//
+	// Data structure:
+	//  0-7 byte: uint64, id of the first line, 0 if there is no line
+	//  8 byte: []byte, lines in order, each is ended by newline except the
+	//          latest one if it's not ended yet
+	SM_HISTORY uint16 = 0x0104
+
+	// SM_HELLO is server message, it's the reply of CM_HELLO.
+	//
+	// Data structure: see Hello
+	SM_HELLO uint16 = 0x0105
+
+	// CM_AUTH is client message, it follows CM_HELLO on remote connection.
+	//
+	// Data structure:
+	//  0-1 byte: uint16, length of session name
+	//  2 byte: []byte, session name followed by access token
+	CM_AUTH uint16 = 0x0106
+
+	// SM_AUTH_ACK is server message, it's the reply of CM_AUTH.
+	//
+	// Data structure:
+	//  0 byte: uint8, 1 accept, otherwise denied
+	//  1 byte: []byte, reason for denied
+	SM_AUTH_ACK uint16 = 0x0107
+)
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"net"
+	"io"
 )
 
 const (
 	headSize   = 4
 	opcodeSize = 2
+	// maxPacketSize is the max size of data in a packet, including opcode
+	maxPacketSize = 100 * 1024 * 1024
 )
 
 var EInvalidPacket = errors.New("invalid data packet format")
@@ -65,7 +67,9 @@ func Unmarshal(data []byte) (*Packet, error) {
 	return p, nil
 }
 
-func WritePacket(c net.Conn, p *Packet) error {
+// WritePacket write p into c in one call, so packets written by goroutines
+// sharing a connection are not mixed
+func WritePacket(c io.Writer, p *Packet) error {
 	b := makeHeadData(p)
 
 	data := Marshal(p)
@@ -76,22 +80,25 @@ func WritePacket(c net.Conn, p *Packet) error {
 	return err
 }
 
-func ReadPacket(c net.Conn) (*Packet, error) {
-	head := make([]byte, 4)
-	_, err := c.Read(head)
-	if err != nil {
+// ReadPacket read a whole packet from c. It return io.EOF if c is closed
+// between packets, and io.ErrUnexpectedEOF if it's closed in a packet.
+// Framing can't be recovered after EInvalidPacket, c should be closed.
+func ReadPacket(c io.Reader) (*Packet, error) {
+	head := make([]byte, headSize)
+	if _, err := io.ReadFull(c, head); err != nil {
 		return nil, err
 	}
 	dataLen := binary.BigEndian.Uint32(head)
-	if dataLen > 0 && dataLen < 100*1024*1024 {
-		data := make([]byte, dataLen)
+	if dataLen < opcodeSize || dataLen > maxPacketSize {
+		return nil, EInvalidPacket
+	}
 
-		_, err = c.Read(data)
-		if err != nil {
-			return nil, err
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(c, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-
-		return Unmarshal(data)
+		return nil, err
 	}
-	return nil, EInvalidPacket
+	return Unmarshal(data)
 }
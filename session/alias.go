@@ -0,0 +1,465 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const aliasFileName = "aliases.json"
+
+// maxAliasDepth is the limit of nested alias expansion
+const maxAliasDepth = 10
+
+const defaultSeparator = ";"
+
+// Alias replace input matching it with body. A plain alias matches input
+// whose first word is its name, words after name are referenced in body by
+// $1, $2 ... and $* for all of them. A regex alias matches input by
+// pattern, captures are referenced by $1 or ${name}.
+type Alias struct {
+	Name  string `json:"name"`
+	Body  string `json:"body"`
+	Regex bool   `json:"regex,omitempty"`
+	// Script is set for aliases added by scripts, they are not saved
+	Script bool `json:"-"`
+
+	re *regexp.Regexp
+}
+
+func (a *Alias) compile() error {
+	if !a.Regex {
+		return nil
+	}
+	re, err := regexp.Compile(a.Name)
+	if err != nil {
+		return err
+	}
+	a.re = re
+	return nil
+}
+
+// Expand return body of a with arguments of input replaced, false is
+// returned if input doesn't match a
+func (a *Alias) Expand(input string) (string, bool) {
+	if a.Regex {
+		m := a.re.FindStringSubmatch(input)
+		if m == nil {
+			return "", false
+		}
+		named := make(map[string]string)
+		for i, n := range a.re.SubexpNames() {
+			if len(n) > 0 {
+				named[n] = m[i]
+			}
+		}
+		return expandArgs(a.Body, m, named, m[0]), true
+	}
+
+	fields := strings.Fields(input)
+	if len(fields) == 0 || fields[0] != a.Name {
+		return "", false
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimLeft(input, " \t"), a.Name))
+	return expandArgs(a.Body, fields, nil, rest), true
+}
+
+func (a *Alias) String() string {
+	if a.Regex {
+		return fmt.Sprintf("regex %q -> %q", a.Name, a.Body)
+	}
+	return fmt.Sprintf("%s -> %q", a.Name, a.Body)
+}
+
+// expandArgs replace $N and ${N} with args[N], ${name} with named[name], $*
+// with all and $$ with '$', unknown references are replaced by empty string
+func expandArgs(body string, args []string, named map[string]string, all string) string {
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '$' || i+1 >= len(body) {
+			b.WriteByte(c)
+			continue
+		}
+
+		next := body[i+1]
+		switch {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '*':
+			b.WriteString(all)
+			i++
+		case next >= '0' && next <= '9':
+			j := i + 1
+			for j < len(body) && body[j] >= '0' && body[j] <= '9' {
+				j++
+			}
+			n, _ := strconv.Atoi(body[i+1 : j])
+			if n < len(args) {
+				b.WriteString(args[n])
+			}
+			i = j - 1
+		case next == '{':
+			j := strings.IndexByte(body[i+2:], '}')
+			if j < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			name := body[i+2 : i+2+j]
+			if n, err := strconv.Atoi(name); err == nil {
+				if n < len(args) {
+					b.WriteString(args[n])
+				}
+			} else {
+				b.WriteString(named[name])
+			}
+			i = i + 2 + j
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitCommands split s by sep, sep escaped by '\\' is kept as it is
+func splitCommands(s, sep string) []string {
+	if len(sep) == 0 {
+		return []string{s}
+	}
+
+	cmds := []string{}
+	var cmd strings.Builder
+	for len(s) > 0 {
+		switch {
+		case strings.HasPrefix(s, "\\"+sep):
+			cmd.WriteString(sep)
+			s = s[len(sep)+1:]
+		case strings.HasPrefix(s, sep):
+			cmds = append(cmds, cmd.String())
+			cmd.Reset()
+			s = s[len(sep):]
+		default:
+			cmd.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return append(cmds, cmd.String())
+}
+
+// AliasSet keeps aliases and separator of stacked commands
+type AliasSet struct {
+	mu        sync.Mutex
+	plain     map[string]*Alias
+	regex     []*Alias
+	separator string
+	fname     string
+}
+
+// aliasFile is the persisted form of AliasSet
+type aliasFile struct {
+	Separator string   `json:"separator"`
+	Aliases   []*Alias `json:"aliases"`
+}
+
+func NewAliasSet() *AliasSet {
+	return &AliasSet{
+		plain:     make(map[string]*Alias),
+		regex:     make([]*Alias, 0),
+		separator: defaultSeparator,
+	}
+}
+
+// Add compile a and add it into set, alias with the same name is replaced
+func (s *AliasSet) Add(a *Alias) error {
+	if len(a.Name) == 0 {
+		return errors.New("alias name is empty")
+	}
+	if !a.Regex && strings.ContainsAny(a.Name, " \t") {
+		return errors.New("alias name can not contain spaces")
+	}
+	if err := a.compile(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(a.Name)
+	if a.Regex {
+		s.regex = append(s.regex, a)
+	} else {
+		s.plain[a.Name] = a
+	}
+	return nil
+}
+
+// Del remove alias name, it return false if alias is not found
+func (s *AliasSet) Del(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(name)
+}
+
+func (s *AliasSet) remove(name string) bool {
+	if _, ok := s.plain[name]; ok {
+		delete(s.plain, name)
+		return true
+	}
+	for i, a := range s.regex {
+		if a.Name == name {
+			s.regex = append(s.regex[:i], s.regex[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List return plain aliases sorted by name followed by regex aliases
+func (s *AliasSet) List() []*Alias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list()
+}
+
+func (s *AliasSet) list() []*Alias {
+	ret := make([]*Alias, 0, len(s.plain)+len(s.regex))
+	for _, a := range s.plain {
+		ret = append(ret, a)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return append(ret, s.regex...)
+}
+
+// Separator return separator of stacked commands
+func (s *AliasSet) Separator() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.separator
+}
+
+// SetSeparator set separator of stacked commands, empty sep disables
+// command stacking
+func (s *AliasSet) SetSeparator(sep string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.separator = sep
+}
+
+// match return expansion of the first alias matching cmd
+func (s *AliasSet) match(cmd string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fields := strings.Fields(cmd); len(fields) > 0 {
+		if a, ok := s.plain[fields[0]]; ok {
+			return a.Expand(cmd)
+		}
+	}
+	for _, a := range s.regex {
+		if body, ok := a.Expand(cmd); ok {
+			return body, true
+		}
+	}
+	return "", false
+}
+
+// Expand split input into stacked commands and expand aliases in them
+// recursively, commands without alias are returned as they are
+func (s *AliasSet) Expand(input string) ([]string, error) {
+	return s.expand(input, 0)
+}
+
+func (s *AliasSet) expand(input string, depth int) ([]string, error) {
+	cmds := []string{}
+	for _, cmd := range splitCommands(input, s.Separator()) {
+		body, ok := s.match(cmd)
+		if !ok {
+			cmds = append(cmds, cmd)
+			continue
+		}
+		if depth >= maxAliasDepth {
+			return nil, fmt.Errorf("alias nested too deep: %s", cmd)
+		}
+		sub, err := s.expand(body, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, sub...)
+	}
+	return cmds, nil
+}
+
+// Load read aliases from file fname, later changes are saved into it.
+// A not existing file is taken as empty.
+func (s *AliasSet) Load(fname string) error {
+	s.mu.Lock()
+	s.fname = fname
+	s.mu.Unlock()
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	f := &aliasFile{Separator: defaultSeparator}
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("%s: %s", fname, err.Error())
+	}
+	s.SetSeparator(f.Separator)
+	for _, a := range f.Aliases {
+		if err := s.Add(a); err != nil {
+			return fmt.Errorf("%s: alias %s: %s", fname, a.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Save write aliases into the file loaded from
+func (s *AliasSet) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.fname) == 0 {
+		return nil
+	}
+
+	f := &aliasFile{
+		Separator: s.separator,
+		Aliases:   make([]*Alias, 0),
+	}
+	for _, a := range s.list() {
+		if !a.Script {
+			f.Aliases = append(f.Aliases, a)
+		}
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.fname, b, 0644)
+}
+
+var aliases = NewAliasSet()
+
+var aliasSubCommands = CommandMap{
+	"add": &Command{
+		name:       "add",
+		handler:    handleCmdAliasAdd,
+		subCommand: nil,
+		desc:       "add or replace an alias",
+		help:       "\tUsage: /alias add [--regex] <name|pattern> <body>",
+	},
+	"del": &Command{
+		name:       "del",
+		handler:    handleCmdAliasDel,
+		subCommand: nil,
+		desc:       "delete an alias",
+		help:       "\tUsage: /alias del <name|pattern>",
+	},
+	"list": &Command{
+		name:       "list",
+		handler:    handleCmdAliasList,
+		subCommand: nil,
+		desc:       "list aliases",
+		help:       "\tUsage: /alias list",
+	},
+}
+
+func handleCmdAliasAdd(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "regex")
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) < 2 {
+		return c.help, nil, errors.New("need params: <name|pattern> <body>")
+	}
+
+	a := &Alias{
+		Name: args[0],
+		Body: strings.Join(args[1:], " "),
+	}
+	for name := range opts {
+		switch name {
+		case "regex":
+			a.Regex = true
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+
+	if err := aliases.Add(a); err != nil {
+		return "", nil, err
+	}
+	if err := aliases.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("alias %s", a), nil, nil
+}
+
+func handleCmdAliasDel(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) == 0 {
+		return c.help, nil, errors.New("need param: <name|pattern>")
+	}
+
+	if !aliases.Del(args[0]) {
+		return "", nil, fmt.Errorf("alias not found: %s", args[0])
+	}
+	if err := aliases.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("alias %s deleted", args[0]), nil, nil
+}
+
+func handleCmdAliasList(c *Command, p *bufio.Reader) (string, []byte, error) {
+	list := aliases.List()
+	if len(list) == 0 {
+		return "No alias defined", nil, nil
+	}
+
+	msg := fmt.Sprintf("command separator: %q\n", aliases.Separator())
+	for _, a := range list {
+		msg = msg + fmt.Sprintf("\t%s\n", a)
+	}
+	return strings.TrimRight(msg, "\n"), nil, nil
+}
+
+func handleCmdSetSeparator(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "none")
+	if err != nil {
+		return c.help, nil, err
+	}
+	if _, ok := opts["none"]; ok {
+		aliases.SetSeparator("")
+	} else if len(args) > 0 {
+		aliases.SetSeparator(args[0])
+	} else {
+		return fmt.Sprintf("command separator: %q", aliases.Separator()), nil, nil
+	}
+
+	if err := aliases.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("command separator: %q", aliases.Separator()), nil, nil
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandArgs(t *testing.T) {
+	args := []string{"k", "orc", "2"}
+	named := map[string]string{"who": "bob"}
+	got := expandArgs("kill $1 $2;say ${who} $* $$ $9${", args, named, "orc 2")
+	want := "kill orc 2;say bob orc 2 $ ${"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestAliasExpand(t *testing.T) {
+	s := NewAliasSet()
+	for _, a := range []*Alias{
+		{Name: "k", Body: "kill $1;get all from corpse"},
+		{Name: "kk", Body: "k $1;k $1"},
+		{Name: `^tt (?P<who>\w+) (.*)$`, Body: "tell ${who} $2", Regex: true},
+		{Name: "loop", Body: "loop"},
+	} {
+		if err := s.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmds, err := s.Expand(`kk orc;n\;e;tt bob hello there`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kill orc", "get all from corpse",
+		"kill orc", "get all from corpse",
+		"n;e", "tell bob hello there",
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Fatalf("got %q, want %q", cmds, want)
+	}
+
+	if _, err := s.Expand("loop"); err == nil {
+		t.Fatal("want error for recursive alias")
+	}
+
+	s.SetSeparator("")
+	cmds, _ = s.Expand("n;e")
+	if !reflect.DeepEqual(cmds, []string{"n;e"}) {
+		t.Fatalf("separator not disabled: %q", cmds)
+	}
+}
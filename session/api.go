@@ -0,0 +1,384 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/defsky/xtelnet/api"
+	"github.com/defsky/xtelnet/shared"
+)
+
+const apiDir = "api"
+
+// Limits of scrollback.get
+const (
+	apiScrollbackLines    = 100
+	apiScrollbackMaxLines = 1000
+	apiScrollbackMaxBytes = 512 * 1024
+)
+
+// APIHomeDir return directory of control sockets of sessions
+func APIHomeDir() (string, error) {
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(userHome, cacheDir, apiDir)
+	if err := mkdirIfNotExist(dir, os.ModeDir|os.FileMode(0700)); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// listenAPI listen control socket of session name, only the user can
+// connect it
+func listenAPI(name string) (net.Listener, string, error) {
+	dir, err := APIHomeDir()
+	if err != nil {
+		return nil, "", err
+	}
+	fname := filepath.Join(dir, fmt.Sprintf("%d.%s", os.Getpid(), name))
+	ln, err := net.Listen("unix", fname)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(fname, 0600); err != nil {
+		ln.Close()
+		return nil, "", err
+	}
+	return ln, fname, nil
+}
+
+var apiServer = api.NewServer()
+
+// handlers refer to apiServer through events of connections, so they are
+// registered in init
+func init() {
+	s := apiServer
+	s.Handle(api.MethodConnectionsList, apiConnectionsList)
+	s.Handle(api.MethodConnectionOpen, apiConnectionOpen)
+	s.Handle(api.MethodConnectionClose, apiConnectionClose)
+	s.Handle(api.MethodSend, apiSend)
+	s.Handle(api.MethodScrollbackGet, apiScrollbackGet)
+	s.Handle(api.MethodTriggersList, apiTriggersList)
+	s.Handle(api.MethodTriggersAdd, apiTriggersAdd)
+	s.Handle(api.MethodTriggersDel, apiTriggersDel)
+	s.Handle(api.MethodTriggersEnable, apiTriggersEnable)
+	s.Handle(api.MethodVarsGet, apiVarsGet)
+	s.Handle(api.MethodVarsSet, apiVarsSet)
+}
+
+// publishLine send line from server of connection c to subscribers
+func publishLine(c *Connection, line string, prompt bool) {
+	if !apiServer.HasSubscriber(api.EventLine) {
+		return
+	}
+	apiServer.Publish(&api.Event{
+		Type:   api.EventLine,
+		Time:   time.Now(),
+		Conn:   c.name,
+		Text:   line,
+		Prompt: prompt,
+	})
+}
+
+// publishConnEvent send lifecycle event of connection c to subscribers
+func publishConnEvent(c *Connection, ev ConnEvent, detail string) {
+	if !apiServer.HasSubscriber(api.EventConn) {
+		return
+	}
+	apiServer.Publish(&api.Event{
+		Type:   api.EventConn,
+		Time:   time.Now(),
+		Conn:   c.name,
+		Text:   string(ev),
+		Detail: detail,
+	})
+}
+
+func apiConnection(c *Connection) api.Connection {
+	return api.Connection{
+		Name:    c.Name(),
+		Address: c.Address(),
+		State:   c.State(),
+		Current: c == conns.Current(),
+	}
+}
+
+// apiConn return connection name, the current one if name is empty
+func apiConn(name string) (*Connection, error) {
+	if len(name) == 0 {
+		return conns.Current(), nil
+	}
+	c, ok := conns.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("connection not found: %s", name)
+	}
+	return c, nil
+}
+
+// apiTriggers return triggers of connection name, triggers of session if
+// name is empty
+func apiTriggers(name string) (*TriggerSet, error) {
+	if len(name) == 0 {
+		return triggers, nil
+	}
+	c, err := conns.GetOrCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.triggers, nil
+}
+
+func apiConnectionsList(params json.RawMessage) (interface{}, error) {
+	list := []api.Connection{}
+	for _, c := range conns.List() {
+		list = append(list, apiConnection(c))
+	}
+	return list, nil
+}
+
+func apiConnectionOpen(params json.RawMessage) (interface{}, error) {
+	p := &api.OpenParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	if len(p.Host) == 0 || p.Port <= 0 || p.Port > 65535 {
+		return nil, &api.Error{Code: api.CodeInvalidParams, Message: "host and port in range 1-65535 are required"}
+	}
+
+	conn := conns.Current()
+	if len(p.Conn) > 0 {
+		var err error
+		if conn, err = conns.GetOrCreate(p.Conn); err != nil {
+			return nil, err
+		}
+	}
+	var charset shared.Charset
+	if len(p.Charset) > 0 {
+		cs, err := shared.LookupCharset(p.Charset)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err.Error(), p.Charset)
+		}
+		charset = cs
+	}
+
+	if len(p.Conn) > 0 {
+		conns.Switch(p.Conn)
+	}
+	if len(charset) > 0 {
+		conn.config.Charset = charset
+	}
+	tlsCfg := conn.config.TLS.Get()
+	if p.TLS != nil {
+		tlsCfg.Enabled = *p.TLS
+	}
+	if p.Insecure != nil {
+		tlsCfg.Insecure = *p.Insecure
+	}
+	conn.config.TLS.Set(tlsCfg)
+	if err := conn.Open(p.Host, strconv.Itoa(p.Port)); err != nil {
+		return nil, err
+	}
+	return apiConnection(conn), nil
+}
+
+func apiConnectionClose(params json.RawMessage) (interface{}, error) {
+	p := &api.ConnParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	c, err := apiConn(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Close(), nil
+}
+
+func apiSend(params json.RawMessage) (interface{}, error) {
+	p := &api.SendParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	c, err := apiConn(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := execInput(p.Text, c)
+	if len(msg) > 0 {
+		outCh <- []byte(msg + "\n")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func apiScrollbackGet(params json.RawMessage) (interface{}, error) {
+	p := &api.ScrollbackParams{Count: apiScrollbackLines}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Count <= 0 || p.Count > apiScrollbackMaxLines {
+		return nil, &api.Error{Code: api.CodeInvalidParams, Message: fmt.Sprintf("count must be in range 1-%d", apiScrollbackMaxLines)}
+	}
+
+	_, lines := scrollback.Before(p.Before, p.Count, apiScrollbackMaxBytes)
+	ret := &api.Scrollback{Lines: make([]api.Line, 0, len(lines))}
+	for _, l := range lines {
+		text := l.Plain
+		if l.Partial {
+			text = plainText(l.Raw)
+		}
+		ret.Lines = append(ret.Lines, api.Line{
+			ID:      l.ID,
+			Time:    l.Time,
+			Conn:    l.Conn,
+			Text:    text,
+			Partial: l.Partial,
+		})
+	}
+	return ret, nil
+}
+
+func apiTriggersList(params json.RawMessage) (interface{}, error) {
+	p := &api.ConnParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	set, err := apiTriggers(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []api.Trigger{}
+	for _, t := range set.List() {
+		if t.Script {
+			continue
+		}
+		list = append(list, api.Trigger{
+			Name:     t.Name,
+			Pattern:  t.Pattern,
+			Type:     string(t.Type),
+			Action:   string(t.Action),
+			Body:     t.Body,
+			Group:    t.Group,
+			Priority: t.Priority,
+			Prompt:   t.Prompt,
+			Disabled: !set.IsActive(t),
+		})
+	}
+	return list, nil
+}
+
+func apiTriggersAdd(params json.RawMessage) (interface{}, error) {
+	p := &api.TriggerParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Trigger == nil {
+		return nil, &api.Error{Code: api.CodeInvalidParams, Message: "trigger is required"}
+	}
+	set, err := apiTriggers(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Trigger{
+		Name:     p.Trigger.Name,
+		Pattern:  p.Trigger.Pattern,
+		Type:     TriggerRegex,
+		Action:   ActionSend,
+		Body:     p.Trigger.Body,
+		Group:    p.Trigger.Group,
+		Priority: p.Trigger.Priority,
+		Prompt:   p.Trigger.Prompt,
+		Disabled: p.Trigger.Disabled,
+	}
+	if len(p.Trigger.Type) > 0 {
+		t.Type = TriggerType(p.Trigger.Type)
+	}
+	if len(p.Trigger.Action) > 0 {
+		a, ok := parseTriggerAction(p.Trigger.Action)
+		if !ok {
+			return nil, &api.Error{Code: api.CodeInvalidParams, Message: "unknown action: " + p.Trigger.Action}
+		}
+		t.Action = a
+	}
+	if err := set.Add(t); err != nil {
+		return nil, err
+	}
+	if err := set.Save(); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func apiTriggersDel(params json.RawMessage) (interface{}, error) {
+	p := &api.TriggerParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	set, err := apiTriggers(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !set.Del(p.Name) {
+		return nil, fmt.Errorf("trigger not found: %s", p.Name)
+	}
+	if err := set.Save(); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func apiTriggersEnable(params json.RawMessage) (interface{}, error) {
+	p := &api.TriggerParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	set, err := apiTriggers(p.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Group) > 0 {
+		set.SetGroupEnabled(p.Group, p.Enabled)
+	} else if err := set.SetEnabled(p.Name, p.Enabled); err != nil {
+		return nil, err
+	}
+	if err := set.Save(); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func apiVarsGet(params json.RawMessage) (interface{}, error) {
+	p := &api.VarParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	if len(p.Name) == 0 {
+		return nil, &api.Error{Code: api.CodeInvalidParams, Message: "name is required"}
+	}
+	return vars.Get(p.Name), nil
+}
+
+func apiVarsSet(params json.RawMessage) (interface{}, error) {
+	p := &api.VarParams{}
+	if err := api.DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+	if len(p.Name) == 0 {
+		return nil, &api.Error{Code: api.CodeInvalidParams, Message: "name is required"}
+	}
+	vars.Set(p.Name, p.Value)
+	return true, nil
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/api"
+	"github.com/defsky/xtelnet/telnet"
+)
+
+// startEchoServer listen on a local port, lines from client are replied
+// with "You say: " prefixed
+func startEchoServer(t *testing.T) (int, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("Welcome\r\n"))
+		r := bufio.NewScanner(conn)
+		for r.Scan() {
+			conn.Write([]byte("You say: " + strings.TrimSpace(r.Text()) + "\r\n"))
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() }
+}
+
+// waitAPIEvent read events of c until one matches typ and text
+func waitAPIEvent(t *testing.T, c *api.Client, typ, text string) *api.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-c.Events():
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if e.Type == typ && e.Text == text {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s event %q", typ, text)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+
+	// daemon without client attached
+	term := NewTerminal()
+	go term.terminal()
+	defer close(term.close)
+	ln, fname, err := listenAPI("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go apiServer.Serve(ln)
+
+	port, stop := startEchoServer(t)
+	defer stop()
+
+	c, err := api.Dial(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Subscribe(api.EventConn, api.EventLine); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Open(&api.OpenParams{Conn: "mud", Host: "127.0.0.1", Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	defer conns.CloseAll()
+	waitAPIEvent(t, c, api.EventConn, string(EventConnected))
+	waitAPIEvent(t, c, api.EventLine, "Welcome")
+
+	list, err := c.Connections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mud *api.Connection
+	for i := range list {
+		if list[i].Name == "mud" {
+			mud = &list[i]
+		}
+	}
+	if mud == nil || mud.State != "connected" || !mud.Current {
+		t.Fatalf("got %+v", list)
+	}
+
+	// text is sent like input of user
+	if err := c.Send("mud", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitAPIEvent(t, c, api.EventLine, "You say: hello"); e.Conn != "mud" {
+		t.Fatalf("got %+v", e)
+	}
+	var found bool
+	for i := 0; i < 100 && !found; i++ {
+		lines, err := c.Scrollback(0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range lines {
+			// lines are shown with tag of connection in scrollback
+			found = found || (l.Conn == "mud" && strings.HasSuffix(l.Text, "You say: hello"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found {
+		t.Fatal("line is not found in scrollback")
+	}
+
+	// triggers of connection
+	tr := &api.Trigger{Name: "greet", Pattern: "^You say: (.*)$", Action: "echo", Body: "echo $1"}
+	if err := c.AddTrigger("mud", tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnableTrigger("mud", "greet", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Triggers("mud"); err != nil || len(got) != 1 || got[0].Type != "regex" || !got[0].Disabled {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if err := c.DelTrigger("mud", "greet"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Triggers("mud"); len(got) != 0 {
+		t.Fatalf("got %+v after deleting", got)
+	}
+
+	// variables are shared with scripts
+	if err := c.SetVar("hp", 100); err != nil {
+		t.Fatal(err)
+	}
+	var hp int
+	if err := c.Var("hp", &hp); err != nil || hp != 100 || vars.Get("hp") != float64(100) {
+		t.Fatalf("got %d, %v", hp, err)
+	}
+	c.SetVar("hp", nil)
+	var v interface{}
+	if err := c.Var("hp", &v); err != nil || v != nil {
+		t.Fatalf("got %v, %v after deleting", v, err)
+	}
+
+	if _, err := c.Scrollback(0, 0); err == nil || err.(*api.Error).Code != api.CodeInvalidParams {
+		t.Fatalf("got %v for invalid count", err)
+	}
+
+	if err := c.CloseConn("mud"); err != nil {
+		t.Fatal(err)
+	}
+	waitAPIEvent(t, c, api.EventConn, string(EventDisconnected))
+}
+
+func TestAPIOpenKeepTLS(t *testing.T) {
+	// nothing listens on the port, connecting fails at once
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	conn, err := conns.GetOrCreate("secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.config.TLS.Set(telnet.TLSConfig{Enabled: true})
+
+	for _, tc := range []struct {
+		params string
+		tls    bool
+	}{
+		{fmt.Sprintf(`{"conn":"secure","host":"127.0.0.1","port":%d}`, port), true},
+		{fmt.Sprintf(`{"conn":"secure","host":"127.0.0.1","port":%d,"tls":false}`, port), false},
+	} {
+		conn.Close()
+		if _, err := apiConnectionOpen(json.RawMessage(tc.params)); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.config.TLS.Get().Enabled; got != tc.tls {
+			t.Errorf("%s: got TLS %v", tc.params, got)
+		}
+	}
+}
@@ -1,54 +1,436 @@
-package session
-
-import (
-	"sync"
-)
-
-type OutBuffer struct {
-	mu     sync.Mutex
-	maxLen int
-	buffer [][]byte
-}
-
-func NewBuffer(len int) *OutBuffer {
-	return &OutBuffer{
-		maxLen: len,
-		buffer: make([][]byte, 0, 100),
-	}
-}
-
-func (b *OutBuffer) Put(data []byte) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	b.buffer = append(b.buffer, data)
-	if len(b.buffer) > b.maxLen {
-		b.buffer = b.buffer[1:]
-	}
-}
-
-func (b *OutBuffer) Get(n int) [][]byte {
-	if n <= 0 {
-		return nil
-	}
-
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	size := len(b.buffer)
-
-	startIdx := 0
-	// retSize := size
-
-	if size > n {
-		startIdx = size - n
-		// retSize = n
-	}
-
-	ret := make([][]byte, 0)
-	ret = append(ret, b.buffer[startIdx:]...)
-	// src := b.buffer[startIdx:]
-	// copy(ret, src)
-
-	return ret
-}
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+const (
+	// maxLineSize is the max size of a line, longer output without newline
+	// is split
+	maxLineSize = 64 * 1024
+	// lineOverhead is estimated memory used by a line besides its text
+	lineOverhead = 64
+	// segmentLines is the number of lines in a spilled segment file
+	segmentLines = 10000
+)
+
+// Line is a line of session output
+type Line struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Conn is name of connection the line comes from, it's empty for
+	// messages of session
+	Conn  string `json:"conn,omitempty"`
+	Raw   []byte `json:"raw"`
+	Plain string `json:"-"`
+	// Partial is set if line is not ended by newline yet
+	Partial bool `json:"-"`
+}
+
+// size return memory used by l
+func (l *Line) size() int {
+	return len(l.Raw) + len(l.Plain) + lineOverhead
+}
+
+// LineBuffer keeps the latest lines of session output in a ring. Lines are
+// dropped when there are more than maxLines of them or they use more than
+// maxBytes memory, dropped lines are written to segment files if spilling is
+// enabled.
+type LineBuffer struct {
+	mu       sync.Mutex
+	maxLines int
+	maxBytes int64
+
+	// ring holds count lines starting from ring[start]
+	ring  []Line
+	start int
+	count int
+	size  int64
+	// partial is the last line not ended by newline yet
+	partial *Line
+	next    uint64
+
+	spill    *spillFile
+	spillDir string
+}
+
+// NewLineBuffer return buffer keeping at most maxLines lines and maxBytes
+// memory
+func NewLineBuffer(maxLines int, maxBytes int64) *LineBuffer {
+	return &LineBuffer{
+		maxLines: maxLines,
+		maxBytes: maxBytes,
+		next:     1,
+	}
+}
+
+// SetLimits change max lines and memory of buffer, lines over them are
+// dropped at once
+func (b *LineBuffer) SetLimits(maxLines int, maxBytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.maxLines = maxLines
+	b.maxBytes = maxBytes
+	b.evict()
+	if b.count < len(b.ring)/2 {
+		b.resize(b.count)
+	}
+}
+
+// Limits return max lines and memory of buffer
+func (b *LineBuffer) Limits() (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.maxLines, b.maxBytes
+}
+
+// Put add output of connection conn into buffer, conn is empty for
+// messages of session
+func (b *LineBuffer) Put(conn string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for len(data) > 0 {
+		if b.partial == nil {
+			b.partial = &Line{ID: b.next, Time: now, Conn: conn}
+			b.next++
+		}
+		n := bytes.IndexByte(data, '\n')
+		if n < 0 {
+			b.partial.Raw = append(b.partial.Raw, data...)
+			if len(b.partial.Raw) >= maxLineSize {
+				b.push()
+			}
+			break
+		}
+		b.partial.Raw = append(b.partial.Raw, data[:n]...)
+		b.push()
+		data = data[n+1:]
+	}
+	b.evict()
+}
+
+// push move partial line into ring
+func (b *LineBuffer) push() {
+	l := b.partial
+	b.partial = nil
+	l.Plain = plainText(l.Raw)
+
+	if b.count == len(b.ring) {
+		b.resize(b.count * 2)
+	}
+	b.ring[(b.start+b.count)%len(b.ring)] = *l
+	b.count++
+	b.size += int64(l.size())
+}
+
+// resize reallocate ring for n lines, n is limited between the number of
+// lines kept and maxLines
+func (b *LineBuffer) resize(n int) {
+	if n < 64 {
+		n = 64
+	}
+	if n > b.maxLines {
+		n = b.maxLines
+	}
+	if n < b.count+1 {
+		n = b.count + 1
+	}
+	ring := make([]Line, n)
+	for i := 0; i < b.count; i++ {
+		ring[i] = b.ring[(b.start+i)%len(b.ring)]
+	}
+	b.ring = ring
+	b.start = 0
+}
+
+// evict drop the oldest lines while limits are exceeded
+func (b *LineBuffer) evict() {
+	for b.count > 0 && (b.count > b.maxLines || b.size > b.maxBytes) {
+		l := &b.ring[b.start]
+		if b.spill != nil {
+			if err := b.spill.write(l); err != nil {
+				b.spill.fail(err)
+				b.spill = nil
+			}
+		}
+		b.size -= int64(l.size())
+		*l = Line{}
+		b.start = (b.start + 1) % len(b.ring)
+		b.count--
+	}
+	if b.spill != nil {
+		if err := b.spill.flush(); err != nil {
+			b.spill.fail(err)
+			b.spill = nil
+		}
+	}
+}
+
+// Before return at most n lines before line of id before in order, and id
+// of the first one returned. before 0 means after the latest line, the
+// line not ended yet is included. Lines are returned from the newest one
+// until size of their raw text reaches maxBytes, the newest one is always
+// returned even if it's larger. Spilled lines are read back from disk.
+func (b *LineBuffer) Before(before uint64, n int, maxBytes int) (uint64, []Line) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ret := []Line{}
+	size := 0
+	add := func(l *Line) bool {
+		if len(ret) >= n || (len(ret) > 0 && size+len(l.Raw) > maxBytes) {
+			return false
+		}
+		ret = append(ret, *l)
+		size += len(l.Raw)
+		return true
+	}
+
+	if before == 0 {
+		before = b.next
+	}
+	if b.partial != nil && b.partial.ID < before {
+		l := *b.partial
+		l.Raw = append([]byte{}, l.Raw...)
+		l.Plain = plainText(l.Raw)
+		l.Partial = true
+		add(&l)
+	}
+	full := false
+	for i := b.count - 1; i >= 0 && !full; i-- {
+		l := &b.ring[(b.start+i)%len(b.ring)]
+		if l.ID < before {
+			full = !add(l)
+		}
+	}
+	if !full && b.spill != nil {
+		bound := before
+		if b.count > 0 && b.ring[b.start].ID < bound {
+			bound = b.ring[b.start].ID
+		}
+		if err := b.spill.read(bound, add); err != nil {
+			b.spill.fail(err)
+			b.spill = nil
+		}
+	}
+
+	if len(ret) == 0 {
+		return 0, nil
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret[0].ID, ret
+}
+
+// Status describe lines kept in buffer
+func (b *LineBuffer) Status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := fmt.Sprintf("%d lines (%s) in memory, limit %d lines / %s",
+		b.count, formatSize(b.size), b.maxLines, formatSize(b.maxBytes))
+	if b.spill == nil {
+		return s + ", spill off"
+	}
+	return s + fmt.Sprintf(", %d lines spilled into %s", b.spill.lines, b.spill.dir)
+}
+
+// SetSpillDir set directory of segment files
+func (b *LineBuffer) SetSpillDir(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.spillDir = dir
+}
+
+// SetSpill start writing dropped lines into segment files, or stop it and
+// remove spilled files
+func (b *LineBuffer) SetSpill(on bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !on {
+		if b.spill != nil {
+			b.spill.remove()
+			b.spill = nil
+		}
+		return nil
+	}
+	if b.spill != nil {
+		return nil
+	}
+	if len(b.spillDir) == 0 {
+		return errors.New("no directory to spill scrollback")
+	}
+	if err := mkdirIfNotExist(b.spillDir, os.ModeDir|os.FileMode(0700)); err != nil {
+		return err
+	}
+	b.spill = &spillFile{dir: b.spillDir}
+	return nil
+}
+
+// Close stop spilling and remove spilled files
+func (b *LineBuffer) Close() {
+	b.SetSpill(false)
+}
+
+// segment is a spilled file of lines starting from first
+type segment struct {
+	first uint64
+	lines int
+	fname string
+}
+
+// spillFile keeps lines dropped from memory in segment files, every file
+// holds segmentLines JSON encoded lines
+type spillFile struct {
+	dir      string
+	segments []segment
+	lines    int
+	f        *os.File
+	w        *bufio.Writer
+}
+
+func (s *spillFile) write(l *Line) error {
+	if s.f == nil || s.segments[len(s.segments)-1].lines >= segmentLines {
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+		fname := filepath.Join(s.dir, fmt.Sprintf("%020d.seg", l.ID))
+		f, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		s.f = f
+		s.w = bufio.NewWriter(f)
+		s.segments = append(s.segments, segment{first: l.ID, fname: fname})
+	}
+
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].lines++
+	s.lines++
+	return nil
+}
+
+func (s *spillFile) flush() error {
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+func (s *spillFile) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if e := s.f.Close(); err == nil {
+		err = e
+	}
+	s.f = nil
+	s.w = nil
+	return err
+}
+
+// read pass lines before id bound to add from the newest one, until add
+// return false
+func (s *spillFile) read(bound uint64, add func(*Line) bool) error {
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		seg := s.segments[i]
+		if seg.first >= bound {
+			continue
+		}
+		data, err := ioutil.ReadFile(seg.fname)
+		if err != nil {
+			return err
+		}
+		lines := make([]Line, 0, seg.lines)
+		for _, b := range bytes.Split(data, []byte{'\n'}) {
+			if len(b) == 0 {
+				continue
+			}
+			var l Line
+			if err := json.Unmarshal(b, &l); err != nil {
+				return fmt.Errorf("%s: %s", seg.fname, err.Error())
+			}
+			lines = append(lines, l)
+		}
+		for j := len(lines) - 1; j >= 0; j-- {
+			l := &lines[j]
+			if l.ID >= bound {
+				continue
+			}
+			l.Plain = plainText(l.Raw)
+			if !add(l) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// fail report error of spilling to session and remove spilled files
+func (s *spillFile) fail(err error) {
+	s.remove()
+	select {
+	case outCh <- []byte(fmt.Sprintf("scrollback spill stopped: %s\n", err.Error())):
+	default:
+	}
+}
+
+func (s *spillFile) remove() {
+	s.closeFile()
+	os.RemoveAll(s.dir)
+}
+
+// plainText return raw without escape sequences and color tags
+func plainText(raw []byte) string {
+	out := new(bytes.Buffer)
+	r := bytes.NewReader(raw)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		switch b {
+		case '\r':
+		case 0x1b:
+			_, ctrl, _ := telnet.ReadEscSeq(r)
+			out.Write(ctrl)
+		case '[':
+			rest := raw[len(raw)-r.Len()-1:]
+			m := colorTag.FindSubmatch(rest)
+			if m == nil || len(m[0]) == 2 {
+				out.WriteByte(b)
+				continue
+			}
+			r.Seek(int64(len(m[0])-1), 1)
+		default:
+			out.WriteByte(b)
+		}
+	}
+	return out.String()
+}
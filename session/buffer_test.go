@@ -0,0 +1,120 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// joinLines return raw text of lines joined by comma
+func joinLines(lines []Line) string {
+	s := []string{}
+	for _, l := range lines {
+		s = append(s, string(l.Raw))
+	}
+	return strings.Join(s, ",")
+}
+
+func TestLineBufferPut(t *testing.T) {
+	b := NewLineBuffer(100, 1<<20)
+	b.Put("a", []byte("one\ntw"))
+	b.Put("", []byte("o\n\x1b[31mthree[-]\nfo"))
+
+	first, lines := b.Before(0, 10, 1024)
+	if first != 1 || joinLines(lines) != "one,two,\x1b[31mthree[-],fo" {
+		t.Fatalf("got %d %q", first, joinLines(lines))
+	}
+	if lines[1].Conn != "a" || lines[2].Conn != "" {
+		t.Errorf("got conn %q %q", lines[1].Conn, lines[2].Conn)
+	}
+	if lines[2].Plain != "three" {
+		t.Errorf("got plain %q", lines[2].Plain)
+	}
+	if lines[2].Partial || !lines[3].Partial {
+		t.Error("only the last line is partial")
+	}
+	for i, l := range lines {
+		if l.ID != uint64(i+1) {
+			t.Errorf("line %d: got id %d", i, l.ID)
+		}
+	}
+}
+
+func TestLineBufferBefore(t *testing.T) {
+	b := NewLineBuffer(5, 1<<20)
+	for i := 1; i <= 8; i++ {
+		b.Put("", []byte(strconv.Itoa(i)+"\n"))
+	}
+
+	cases := []struct {
+		before   uint64
+		n        int
+		maxBytes int
+		first    uint64
+		want     string
+	}{
+		{0, 2, 100, 7, "7,8"},
+		{0, 10, 100, 4, "4,5,6,7,8"},
+		{7, 2, 100, 5, "5,6"},
+		{6, 10, 100, 4, "4,5"},
+		{100, 1, 100, 8, "8"},
+		{4, 10, 100, 0, ""},
+		{2, 10, 100, 0, ""},
+		{0, 10, 3, 6, "6,7,8"},
+		{0, 10, 0, 8, "8"},
+	}
+	for _, c := range cases {
+		first, lines := b.Before(c.before, c.n, c.maxBytes)
+		if first != c.first || joinLines(lines) != c.want {
+			t.Errorf("Before(%d, %d, %d) = %d %q, want %d %q",
+				c.before, c.n, c.maxBytes, first, joinLines(lines), c.first, c.want)
+		}
+	}
+
+	// memory limit drops lines too
+	b.SetLimits(100, 2*int64(len("8")+len("8")+lineOverhead))
+	if first, lines := b.Before(0, 10, 100); first != 7 || joinLines(lines) != "7,8" {
+		t.Errorf("got %d %q after limiting memory", first, joinLines(lines))
+	}
+}
+
+func TestLineBufferSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewLineBuffer(10, 1<<20)
+	b.SetSpillDir(dir + "/spill")
+	if err := b.SetSpill(true); err != nil {
+		t.Fatal(err)
+	}
+	total := segmentLines + 100
+	for i := 1; i <= total; i++ {
+		b.Put("a", []byte(strconv.Itoa(i)+"\n"))
+	}
+
+	// lines are read across memory and segment files
+	first, lines := b.Before(0, 30, 1<<20)
+	if first != uint64(total-29) || len(lines) != 30 {
+		t.Fatalf("got %d, %d lines", first, len(lines))
+	}
+	if lines[0].Conn != "a" || lines[0].Plain != strconv.Itoa(total-29) {
+		t.Errorf("got spilled line %+v", lines[0])
+	}
+	first, lines = b.Before(segmentLines+2, 3, 1<<20)
+	if first != segmentLines-1 || joinLines(lines) != strconv.Itoa(segmentLines-1)+","+strconv.Itoa(segmentLines)+","+strconv.Itoa(segmentLines+1) {
+		t.Errorf("got %d %q across segments", first, joinLines(lines))
+	}
+	if first, lines := b.Before(3, 10, 1<<20); first != 1 || joinLines(lines) != "1,2" {
+		t.Errorf("got %d %q at the beginning", first, joinLines(lines))
+	}
+
+	b.Close()
+	if _, err := os.Stat(dir + "/spill"); !os.IsNotExist(err) {
+		t.Error("spilled files are not removed")
+	}
+}
@@ -0,0 +1,73 @@
+package session
+
+import (
+	"net"
+
+	"github.com/defsky/xtelnet/proto"
+)
+
+// clientQueueSize is the number of packets queued for a client, client
+// falling behind more than it is detached
+const clientQueueSize = 1024
+
+// Bits of data of CM_ATTACH_REQ, read-only client can't detach others
+const (
+	attachDetachOthers = 1 << iota
+	attachReadonly
+)
+
+// client is an attached client. Packets are sent by its own goroutine, so
+// that a slow client never blocks the others.
+type client struct {
+	conn     net.Conn
+	peer     *proto.Hello
+	readonly bool
+
+	// out and closed are guarded by mu of Terminal
+	out    chan *proto.Packet
+	closed bool
+}
+
+func newClient(conn net.Conn, peer *proto.Hello, readonly bool) *client {
+	c := &client{
+		conn:     conn,
+		peer:     peer,
+		readonly: readonly,
+		out:      make(chan *proto.Packet, clientQueueSize),
+	}
+	go c.writer()
+	return c
+}
+
+func (c *client) writer() {
+	defer c.conn.Close()
+
+	for p := range c.out {
+		if err := proto.WritePacket(c.conn, p); err != nil {
+			return
+		}
+	}
+}
+
+// send queue p for client, it return false if the queue is full. It must be
+// called with mu of Terminal locked.
+func (c *client) send(p *proto.Packet) bool {
+	if c.closed {
+		return true
+	}
+	select {
+	case c.out <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stop sending to client, packets queued are still sent. It must be
+// called with mu of Terminal locked.
+func (c *client) close() {
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+}
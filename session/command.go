@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/defsky/xtelnet/shared"
 	"github.com/defsky/xtelnet/telnet"
 )
 
@@ -35,11 +37,16 @@ func (c *Command) GetCommandMap() CommandMap {
 	return c.subCommand
 }
 
-var rootCMD = &Command{
-	name:       "",
-	handler:    nil,
-	subCommand: commands,
-	desc:       "Available commands",
+var rootCMD *Command
+
+func init() {
+	// rootCMD is set here as commands may execute input which refers it
+	rootCMD = &Command{
+		name:       "",
+		handler:    nil,
+		subCommand: commands,
+		desc:       "Available commands",
+	}
 }
 
 var debugSubCommands = CommandMap{
@@ -73,6 +80,127 @@ var setSubCommands = CommandMap{
 		desc:       "switch GA visibility",
 		help:       "\t Usage: /set GA",
 	},
+	"esc": &Command{
+		name:       "esc",
+		handler:    handleCmdSetEsc,
+		subCommand: nil,
+		desc:       "switch pass through of unsupported escape sequences",
+		help:       "\t Usage: /set esc",
+	},
+	"charset": &Command{
+		name:       "charset",
+		handler:    handleCmdSetCharset,
+		subCommand: nil,
+		desc:       "set charset of connection",
+		help:       "\t Usage: /set charset [charset]",
+	},
+	"ttype": &Command{
+		name:       "ttype",
+		handler:    handleCmdSetTType,
+		subCommand: nil,
+		desc:       "set client name and terminal type reported by TTYPE",
+		help:       "\t Usage: /set ttype [--conn <conn>] [<client name> [terminal type]]",
+	},
+	"separator": &Command{
+		name:       "separator",
+		handler:    handleCmdSetSeparator,
+		subCommand: nil,
+		desc:       "set separator of stacked commands",
+		help:       "\t Usage: /set separator [<separator> | --none]",
+	},
+	"keepalive": &Command{
+		name:       "keepalive",
+		handler:    handleCmdSetKeepalive,
+		subCommand: nil,
+		desc:       "send command periodly to keep connection alive",
+		help:       "\t Usage: /set keepalive [--conn <conn>] [<interval> [command] | off]",
+	},
+	"reconnect": &Command{
+		name:       "reconnect",
+		handler:    handleCmdSetReconnect,
+		subCommand: nil,
+		desc:       "set auto reconnect policy of connection",
+		help:       "\t Usage: /set reconnect [on|off] [--conn <conn>] [--delay <interval>] [--max-delay <interval>] [--attempts <n>]",
+	},
+	"login": &Command{
+		name:       "login",
+		handler:    handleCmdSetLogin,
+		subCommand: nil,
+		desc:       "set commands run after connection is established",
+		help:       "\t Usage: /set login [--conn <conn>] [<commands> | --none]",
+	},
+	"tls": &Command{
+		name:       "tls",
+		handler:    handleCmdSetTLS,
+		subCommand: nil,
+		desc:       "set TLS of connection",
+		help:       "\t Usage: /set tls [--conn <conn>] [on|off] [--ca <file>] [--cert <file>] [--key <file>] [--insecure <on|off>] [--starttls <on|off>]",
+	},
+	"scrollback": &Command{
+		name:       "scrollback",
+		handler:    handleCmdSetScrollback,
+		subCommand: nil,
+		desc:       "set size of output history kept for attached client",
+		help:       "\t Usage: /set scrollback [--lines <n>] [--size <n[K|M|G]>] [--spill <on|off>]",
+	},
+	"proxy": &Command{
+		name:       "proxy",
+		handler:    handleCmdSetProxy,
+		subCommand: nil,
+		desc:       "set proxy connecting servers",
+		help:       "\t Usage: /set proxy [--conn <conn> | --global] [<socks5://[user:pass@]host:port | http://[user:pass@]host:port | env | direct | default>]",
+	},
+	"mtts": &Command{
+		name:       "mtts",
+		handler:    handleCmdSetMTTS,
+		subCommand: nil,
+		desc:       "switch capabilities reported by MTTS",
+		help:       "\t Usage: /set mtts [--conn <conn>] [<ansi|vt100|utf8|256colors|truecolor|mnes|mslp|tls|...> <on|off>]",
+	},
+}
+var telnetSubCommands = CommandMap{
+	"will": &Command{
+		name:       "will",
+		handler:    handleCmdTelnetNegotiate,
+		subCommand: nil,
+		desc:       "offer to enable an option on our side",
+		help:       "\tUsage: /telnet will <option>",
+	},
+	"wont": &Command{
+		name:       "wont",
+		handler:    handleCmdTelnetNegotiate,
+		subCommand: nil,
+		desc:       "disable an option on our side",
+		help:       "\tUsage: /telnet wont <option>",
+	},
+	"do": &Command{
+		name:       "do",
+		handler:    handleCmdTelnetNegotiate,
+		subCommand: nil,
+		desc:       "ask server to enable an option",
+		help:       "\tUsage: /telnet do <option>",
+	},
+	"dont": &Command{
+		name:       "dont",
+		handler:    handleCmdTelnetNegotiate,
+		subCommand: nil,
+		desc:       "ask server to disable an option",
+		help:       "\tUsage: /telnet dont <option>",
+	},
+	"charset": &Command{
+		name:       "charset",
+		handler:    handleCmdTelnetCharset,
+		subCommand: nil,
+		desc:       "request server to use charset by CHARSET option",
+		help:       "\tUsage: /telnet charset [charset ...]",
+	},
+	"status": &Command{
+		name:       "status",
+		handler:    handleCmdTelnetStatus,
+		subCommand: nil,
+		desc:       "show negotiation state of options",
+		help:       "\tUsage: /telnet status",
+	},
 }
 var commands = CommandMap{
 	"open": &Command{
@@ -80,14 +208,28 @@ var commands = CommandMap{
 		handler:    handleCmdOpen,
 		subCommand: nil,
 		desc:       "Open a session",
-		help:       "\tUsage: /open <host> <port>",
+		help:       "\tUsage: /open [<name>] [--charset <charset>] [--tls] [--ca <file>] [--cert <file> --key <file>] [--insecure] <host> <port>",
 	},
 	"close": &Command{
 		name:       "/close",
 		handler:    handleCmdClose,
 		subCommand: nil,
 		desc:       "Close a session, equivalent to Ctrl-d",
-		help:       "\tUsage: /close",
+		help:       "\tUsage: /close [name]",
+	},
+	"reconnect": &Command{
+		name:       "/reconnect",
+		handler:    handleCmdReconnect,
+		subCommand: nil,
+		desc:       "reconnect to the last opened server",
+		help:       "\tUsage: /reconnect [name]",
+	},
+	"switch": &Command{
+		name:       "/switch",
+		handler:    handleCmdSwitch,
+		subCommand: nil,
+		desc:       "list connections or switch current connection",
+		help:       "\tUsage: /switch [name]",
 	},
 	"debug": &Command{
 		name:       "/debug",
@@ -103,6 +245,69 @@ var commands = CommandMap{
 		desc:       "subcommands for setting",
 		help:       "\tUsage: /set",
 	},
+	"gmcp": &Command{
+		name:       "/gmcp",
+		handler:    nil,
+		subCommand: gmcpSubCommands,
+		desc:       "GMCP data and messages",
+		help:       "\tUsage: /gmcp",
+	},
+	"telnet": &Command{
+		name:       "/telnet",
+		handler:    nil,
+		subCommand: telnetSubCommands,
+		desc:       "telnet option negotiation",
+		help:       "\tUsage: /telnet",
+	},
+	"alias": &Command{
+		name:       "/alias",
+		handler:    nil,
+		subCommand: aliasSubCommands,
+		desc:       "aliases of input",
+		help:       "\tUsage: /alias",
+	},
+	"lua": &Command{
+		name:       "/lua",
+		handler:    nil,
+		subCommand: luaSubCommands,
+		desc:       "lua scripts",
+		help:       "\tUsage: /lua",
+	},
+	"log": &Command{
+		name:       "/log",
+		handler:    nil,
+		subCommand: logSubCommands,
+		desc:       "write output of session into file",
+		help:       "\tUsage: /log",
+	},
+	"timer": &Command{
+		name:       "/timer",
+		handler:    nil,
+		subCommand: timerSubCommands,
+		desc:       "timers running commands",
+		help:       "\tUsage: /timer",
+	},
+	"trigger": &Command{
+		name:       "/trigger",
+		handler:    nil,
+		subCommand: triggerSubCommands,
+		desc:       "triggers on lines from server",
+		help:       "\tUsage: /trigger",
+	},
+	"remote": &Command{
+		name:       "/remote",
+		handler:    nil,
+		subCommand: remoteSubCommands,
+		desc:       "attaching session from other hosts",
+		help:       "\tUsage: /remote",
+	},
+	"web": &Command{
+		name:       "/web",
+		handler:    nil,
+		subCommand: webSubCommands,
+		desc:       "web client of session",
+		help:       "\tUsage: /web",
+	},
 	"exit": &Command{
 		name:       "/exit",
 		handler:    handleCmdExit,
@@ -130,8 +335,9 @@ func handleCmdDetach(c *Command, p *bufio.Reader) (string, []byte, error) {
 	return "", nil, errors.New("\nPress CTRL-C to Detach\n")
 }
 func handleCmdSetGA(c *Command, p *bufio.Reader) (string, []byte, error) {
-	gaVisible := !nvtConfig.GAVisible
-	nvtConfig.GAVisible = gaVisible
+	cfg := conns.Current().config
+	gaVisible := !cfg.GAVisible
+	cfg.GAVisible = gaVisible
 	if gaVisible {
 		return "GA visible on", nil, nil
 	} else {
@@ -139,10 +345,115 @@ func handleCmdSetGA(c *Command, p *bufio.Reader) (string, []byte, error) {
 	}
 }
 
+func handleCmdSetEsc(c *Command, p *bufio.Reader) (string, []byte, error) {
+	cfg := conns.Current().config
+	cfg.EscPassThrough = !cfg.EscPassThrough
+	if cfg.EscPassThrough {
+		return "Escape sequence pass through on", nil, nil
+	} else {
+		return "Escape sequence pass through off", nil, nil
+	}
+}
+
+func handleCmdSetCharset(c *Command, p *bufio.Reader) (string, []byte, error) {
+	name, err := p.ReadString(' ')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	name = strings.TrimRight(name, " ")
+
+	conn := conns.Current()
+	if len(name) == 0 {
+		msg := fmt.Sprintf("current charset: %s\navailable charsets:\n\t%s",
+			conn.Charset(), strings.Join(shared.Charsets(), " "))
+		return msg, nil, nil
+	}
+
+	cs, err := shared.LookupCharset(name)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %s", err.Error(), name)
+	}
+	conn.SetCharset(cs)
+	return fmt.Sprintf("charset: %s", cs), nil, nil
+}
+
+func handleCmdSetTType(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	for name := range opts {
+		if name != "conn" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttype := conn.config.TType
+	if len(args) > 0 {
+		var term string
+		if len(args) > 1 {
+			term = args[1]
+		}
+		ttype.SetIdentity(args[0], term)
+		if err := conn.saveSettings(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	name, term := ttype.Identity()
+	return fmt.Sprintf("client name: %s, terminal type: %s", name, term), nil, nil
+}
+
+func handleCmdSetMTTS(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	for name := range opts {
+		if name != "conn" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttype := conn.config.TType
+	if len(args) > 0 {
+		flag, ok := telnet.ParseMTTSFlag(args[0])
+		if !ok {
+			return c.help, nil, fmt.Errorf("unknown capability: %s", args[0])
+		}
+		if len(args) < 2 {
+			return c.help, nil, errors.New("need param: <on|off>")
+		}
+		switch args[1] {
+		case "on":
+			ttype.SetCapability(flag, true)
+		case "off":
+			ttype.SetCapability(flag, false)
+		default:
+			return c.help, nil, errors.New("need param: <on|off>")
+		}
+		if err := conn.saveSettings(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	caps := ttype.Capabilities()
+	return fmt.Sprintf("MTTS %d: %s", int(caps), caps), nil, nil
+}
+
 func handleCmdDebugIAC(c *Command, p *bufio.Reader) (string, []byte, error) {
 
-	iacDebug := !nvtConfig.DebugIAC
-	nvtConfig.DebugIAC = iacDebug
+	cfg := conns.Current().config
+	iacDebug := !cfg.DebugIAC
+	cfg.DebugIAC = iacDebug
 	if iacDebug {
 		return "IAC debug opened", nil, nil
 	} else {
@@ -153,9 +464,10 @@ func handleCmdDebugIAC(c *Command, p *bufio.Reader) (string, []byte, error) {
 
 func handleCmdDebugColor(c *Command, p *bufio.Reader) (string, []byte, error) {
 
-	colorDebug := !nvtConfig.DebugColor
+	cfg := conns.Current().config
+	colorDebug := !cfg.DebugColor
 	// screen.SetDynamicColors(!colorDebug)
-	nvtConfig.DebugColor = colorDebug
+	cfg.DebugColor = colorDebug
 	if colorDebug {
 		return "Color debug opened", nil, nil
 	} else {
@@ -164,18 +476,97 @@ func handleCmdDebugColor(c *Command, p *bufio.Reader) (string, []byte, error) {
 
 }
 func handleCmdDebugAnsiColor(c *Command, p *bufio.Reader) (string, []byte, error) {
-	nvtConfig.DebugAnsiColor = !nvtConfig.DebugAnsiColor
+	cfg := conns.Current().config
+	cfg.DebugAnsiColor = !cfg.DebugAnsiColor
 
-	if nvtConfig.DebugAnsiColor {
+	if cfg.DebugAnsiColor {
 		return "Ansi Color debug opened", nil, nil
 	} else {
 		return "Ansi Color debug closed", nil, nil
 	}
 }
+func handleCmdTelnetNegotiate(c *Command, p *bufio.Reader) (string, []byte, error) {
+	name, err := p.ReadString(' ')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	name = strings.TrimRight(name, " ")
+	if len(name) == 0 {
+		return c.help, nil, errors.New("need param: <option>")
+	}
+	opt, ok := telnet.ParseOption(name)
+	if !ok {
+		return "", nil, fmt.Errorf("unknown option: %s", name)
+	}
+
+	cmds := map[string]telnet.NVTCommand{
+		"will": telnet.WILL,
+		"wont": telnet.WONT,
+		"do":   telnet.DO,
+		"dont": telnet.DONT,
+	}
+	nvt := conns.Current().NVT()
+	if nvt == nil {
+		return "", nil, errNoConnection
+	}
+	if err := nvt.Negotiate(cmds[c.name], opt); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%s %s requested", cmds[c.name], opt), nil, nil
+}
+
+func handleCmdTelnetCharset(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+
+	charsets := make([]shared.Charset, 0, len(args))
+	for _, name := range args {
+		cs, err := shared.LookupCharset(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %s", err.Error(), name)
+		}
+		charsets = append(charsets, cs)
+	}
+
+	nvt := conns.Current().NVT()
+	if nvt == nil {
+		return "", nil, errNoConnection
+	}
+	if err := nvt.RequestCharset(charsets...); err != nil {
+		return "", nil, err
+	}
+	return "charset requested", nil, nil
+}
+
+func handleCmdTelnetStatus(c *Command, p *bufio.Reader) (string, []byte, error) {
+	status := conns.Current().config.NVTOptionCfg.Status()
+	if len(status) == 0 {
+		return "No option negotiated", nil, nil
+	}
+
+	msg := fmt.Sprintf("\t%-10s%-10s%-10s\n", "OPTION", "LOCAL", "REMOTE")
+	for _, st := range status {
+		msg = msg + fmt.Sprintf("\t%-10s%-10s%-10s\n", st.Option, st.Local, st.Remote)
+	}
+	return strings.TrimRight(msg, "\n"), nil, nil
+}
+
 func handleCmdClose(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
 
-	if nvt != nil {
-		nvt.Close()
+	conn := conns.Current()
+	if len(args) > 0 {
+		var ok bool
+		if conn, ok = conns.Get(args[0]); !ok {
+			return "", nil, fmt.Errorf("connection not found: %s", args[0])
+		}
+	}
+	if conn.Close() {
 		return "", nil, nil
 	}
 	return "No active connection", nil, nil
@@ -186,20 +577,20 @@ func handleCmdOpen(c *Command, p *bufio.Reader) (string, []byte, error) {
 		return c.help, nil, errors.New("need params: <host> <port>")
 	}
 
-	var host, port string
-	var err error
-	host, err = p.ReadString(' ')
-	if err != nil && err != io.EOF {
-		return "", nil, err
+	args, opts, err := readArgs(p, "tls", "insecure")
+	if err != nil {
+		return c.help, nil, err
 	}
-	host = strings.TrimRight(host, " ")
 
-	if err != io.EOF {
-		port, err = p.ReadString(' ')
-		if err != nil && err != io.EOF {
-			return "", nil, err
-		}
-		port = strings.TrimRight(port, " ")
+	var name, host, port string
+	if len(args) > 2 {
+		name, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		host = args[0]
+	}
+	if len(args) > 1 {
+		port = args[1]
 	}
 
 	if len(port) == 0 {
@@ -214,11 +605,136 @@ func handleCmdOpen(c *Command, p *bufio.Reader) (string, []byte, error) {
 		return "", nil, errors.New("port number must in range 1-65535")
 	}
 
-	go func() {
-		nvt = telnet.NewNVT(outCh, host, port, nvtConfig)
-	}()
+	conn := conns.Current()
+	if len(name) > 0 {
+		if conn, err = conns.GetOrCreate(name); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var charset shared.Charset
+	tlsCfg := conn.config.TLS.Get()
+	for name, value := range opts {
+		switch name {
+		case "charset":
+			cs, err := shared.LookupCharset(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: %s", err.Error(), value)
+			}
+			charset = cs
+		default:
+			ok, err := setTLSOption(&tlsCfg, name, value)
+			if err != nil {
+				return c.help, nil, err
+			}
+			if !ok || name == "starttls" {
+				return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+			}
+		}
+	}
+
+	if len(name) > 0 {
+		conns.Switch(name)
+	}
+	if len(charset) > 0 {
+		conn.config.Charset = charset
+	}
+	conn.config.TLS.Set(tlsCfg)
+	if err := conn.Open(host, port); err != nil {
+		return "", nil, err
+	}
 
-	return fmt.Sprintf("connecting to %s:%s ...", host, port), nil, nil
+	return fmt.Sprintf("connecting %s to %s:%s ...", conn.Name(), host, port), nil, nil
+}
+
+// readArgs read all remaining arguments, argument can be quoted by " or '.
+// Arguments like "--name value" or "--name=value" are returned as options,
+// options listed in flags take no value.
+func readArgs(p *bufio.Reader, flags ...string) ([]string, map[string]string, error) {
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields, err := splitArgs(string(b))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := []string{}
+	opts := map[string]string{}
+NEXT:
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if !strings.HasPrefix(f, "--") {
+			args = append(args, f)
+			continue
+		}
+
+		name := strings.TrimPrefix(f, "--")
+		if n := strings.IndexByte(name, '='); n >= 0 {
+			opts[name[:n]] = name[n+1:]
+			continue
+		}
+		for _, flag := range flags {
+			if name == flag {
+				opts[name] = "true"
+				continue NEXT
+			}
+		}
+		if i+1 >= len(fields) {
+			return nil, nil, fmt.Errorf("need value of option: %s", f)
+		}
+		opts[name] = fields[i+1]
+		i++
+	}
+
+	return args, opts, nil
+}
+
+// splitArgs split s by spaces, quoted string is kept as one argument,
+// '\\' escapes the next character in double quoted string
+func splitArgs(s string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote != 0:
+			if r == '\\' && quote == '"' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
 }
 
 func (c *Command) Exec(p *bufio.Reader) (string, []byte, error) {
@@ -0,0 +1,573 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/defsky/xtelnet/shared"
+	"github.com/defsky/xtelnet/telnet"
+)
+
+const defaultConnName = "default"
+
+// stableConnTime is how long a connection must stay up before failed
+// attempts are forgotten, so a server dropping every connection at once
+// still ends in giving up
+const stableConnTime = 30 * time.Second
+
+var errNoConnection = errors.New("no active connection")
+
+// windowSize is screen size of attached client shared by all connections
+var windowSize = telnet.NewWindowSize(80, 24)
+
+// clientColors is colors supported by attached client shared by all
+// connections
+var clientColors = telnet.NewClientColors()
+
+// Connection is a named connection to server, it keeps its own telnet
+// options, charset, GMCP data and triggers across reconnects
+type Connection struct {
+	mu       sync.Mutex
+	manager  *ConnManager
+	name     string
+	host     string
+	port     string
+	config   *telnet.SessionOption
+	nvt      *telnet.NVT
+	gmcp     *GMCPStore
+	triggers *TriggerSet
+	out      chan []byte
+
+	// policy, login, keepalive and proxy are saved in fname
+	policy       *ReconnectPolicy
+	login        string
+	proxy        string
+	keepalive    time.Duration
+	keepaliveCmd string
+	fname        string
+
+	// closed is set when connection is closed by user, attempt counts
+	// reconnects since the last successful connection
+	closed  bool
+	attempt int
+	// dialing is set while connecting, gen is generation of the latest
+	// dial, a dial finding gen changed is superseded
+	dialing bool
+	gen     uint64
+	retry   *time.Timer
+	// since is when the last connection was established
+	since time.Time
+}
+
+func newConnection(m *ConnManager, name string) *Connection {
+	c := &Connection{
+		manager:  m,
+		name:     name,
+		gmcp:     NewGMCPStore(),
+		triggers: NewTriggerSet(),
+		out:      make(chan []byte, 100),
+		policy:   NewReconnectPolicy(),
+	}
+	c.config = &telnet.SessionOption{
+		NVTOptionCfg: telnet.NewNVTOptionConfig(),
+		GMCP:         telnet.NewGMCPOption(),
+		WindowSize:   windowSize,
+		TType:        telnet.NewTTypeOption(),
+		ClientColors: clientColors,
+		TLS:          telnet.NewTLSOption(),
+		Charset:      shared.GB18030,
+		OnLine: func(line string, prompt bool) []byte {
+			return handleServerLine(c, line, prompt)
+		},
+		OnClose: c.onClose,
+	}
+	c.config.GMCP.Subscribe("", c.gmcp.Put)
+	c.config.GMCP.Subscribe("", func(msg *telnet.GMCPMessage) {
+		runGMCPHooks(c, msg)
+	})
+
+	go c.forward()
+	return c
+}
+
+// Name return name of connection
+func (c *Connection) Name() string {
+	return c.name
+}
+
+// Address return "host:port" of the last opened server
+func (c *Connection) Address() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.host) == 0 {
+		return ""
+	}
+	return c.host + ":" + c.port
+}
+
+// NVT return the telnet connection, nil is returned if it's never opened
+func (c *Connection) NVT() *telnet.NVT {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nvt
+}
+
+// IsConnected report if connection is alive
+func (c *Connection) IsConnected() bool {
+	n := c.NVT()
+	return n != nil && n.IsAlive()
+}
+
+// Open connect to host:port in background, output of the connection is
+// written to screen tagged by connection name
+func (c *Connection) Open(host, port string) error {
+	if c.IsConnected() {
+		return fmt.Errorf("connection %s is already opened", c.name)
+	}
+
+	c.mu.Lock()
+	if c.dialing {
+		c.mu.Unlock()
+		return fmt.Errorf("connection %s is connecting", c.name)
+	}
+	c.host, c.port = host, port
+	c.reset()
+	gen := c.startDial()
+	c.mu.Unlock()
+
+	go c.dial(gen)
+	return nil
+}
+
+// Reconnect connect to the last opened server at once, the alive
+// connection is closed first
+func (c *Connection) Reconnect() error {
+	c.mu.Lock()
+	if len(c.host) == 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("connection %s was never opened", c.name)
+	}
+	old := c.nvt
+	// close of the old one is not taken as closed by server
+	c.nvt = nil
+	c.reset()
+	gen := c.startDial()
+	c.mu.Unlock()
+
+	if old != nil && old.IsAlive() {
+		old.Close()
+	}
+	go c.dial(gen)
+	return nil
+}
+
+// startDial supersede dial in progress and return generation of the new
+// one, it must be called with mu held
+func (c *Connection) startDial() uint64 {
+	c.gen++
+	c.dialing = true
+	return c.gen
+}
+
+// reset cancel pending reconnect, it must be called with mu held
+func (c *Connection) reset() {
+	c.closed = false
+	c.attempt = 0
+	if c.retry != nil {
+		c.retry.Stop()
+		c.retry = nil
+	}
+}
+
+// Close close the telnet connection and cancel pending reconnect, it
+// return false if there is nothing to close
+func (c *Connection) Close() bool {
+	c.mu.Lock()
+	c.closed = true
+	pending := c.retry != nil
+	if pending {
+		c.retry.Stop()
+		c.retry = nil
+	}
+	// dial in progress is superseded, its connection is closed
+	connecting := c.dialing
+	c.gen++
+	c.dialing = false
+	c.mu.Unlock()
+
+	if !c.IsConnected() {
+		if pending {
+			c.emit(EventDisconnected, "reconnect canceled")
+		} else if connecting {
+			c.emit(EventDisconnected, "connecting canceled")
+		}
+		return pending || connecting
+	}
+	c.NVT().Close()
+	return true
+}
+
+// dial connect to server and run login script, a failed attempt is
+// retried by reconnect policy. Connection of a superseded dial is closed.
+func (c *Connection) dial(gen uint64) {
+	c.mu.Lock()
+	host, port := c.host, c.port
+	c.mu.Unlock()
+
+	var n *telnet.NVT
+	dialer, via, err := c.dialer()
+	if err != nil {
+		c.emit(EventConnecting, "")
+		c.out <- []byte(fmt.Sprintf("proxy of %s: %s\n", c.name, err.Error()))
+	} else {
+		if len(via) > 0 {
+			via = "via " + via
+		}
+		c.emit(EventConnecting, via)
+		n = telnet.DialNVT(c.out, dialer, host, port, c.config)
+	}
+
+	c.mu.Lock()
+	if c.gen != gen {
+		// closed by user or dialed again while connecting
+		c.mu.Unlock()
+		if n != nil {
+			n.Close()
+		}
+		return
+	}
+	c.dialing = false
+	c.nvt = n
+	c.since = time.Now()
+	login := c.login
+	c.mu.Unlock()
+
+	if n == nil {
+		c.emit(EventDisconnected, "")
+		c.scheduleReconnect()
+		return
+	}
+	c.emit(EventConnected, "")
+
+	if len(login) > 0 {
+		msg, err := execInput(login, c)
+		if len(msg) > 0 {
+			outCh <- []byte(msg + "\n")
+		}
+		if err != nil {
+			outCh <- []byte(fmt.Sprintf("login of %s: %s\n", c.name, err.Error()))
+		}
+	}
+}
+
+// onClose is called when telnet connection n is closed
+func (c *Connection) onClose(n *telnet.NVT) {
+	c.mu.Lock()
+	if c.nvt != n {
+		// replaced by reconnect
+		c.mu.Unlock()
+		return
+	}
+	if time.Since(c.since) >= stableConnTime {
+		c.attempt = 0
+	}
+	c.mu.Unlock()
+
+	c.emit(EventDisconnected, "")
+	c.scheduleReconnect()
+}
+
+// scheduleReconnect connect to server again after backoff if it's enabled
+// and the connection is not closed by user
+func (c *Connection) scheduleReconnect() {
+	addr := c.Address()
+
+	c.mu.Lock()
+	if c.closed || !c.policy.Enabled {
+		c.mu.Unlock()
+		return
+	}
+	if c.policy.GiveUp(c.attempt) {
+		n := c.attempt
+		c.mu.Unlock()
+		c.emit(EventGaveUp, fmt.Sprintf("%s after %d attempts", addr, n))
+		return
+	}
+	c.attempt++
+	n := c.attempt
+	d := c.policy.Backoff(n)
+	c.retry = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.retry = nil
+		gen := c.startDial()
+		c.mu.Unlock()
+		c.dial(gen)
+	})
+	c.mu.Unlock()
+
+	c.emit(EventReconnecting, fmt.Sprintf("%s in %s, attempt %d",
+		addr, d.Round(100*time.Millisecond), n))
+}
+
+// State return description of connection state
+func (c *Connection) State() string {
+	if c.IsConnected() {
+		return "connected"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.retry != nil {
+		return fmt.Sprintf("reconnect#%d", c.attempt)
+	}
+	return "closed"
+}
+
+// Send send data to server
+func (c *Connection) Send(data []byte) error {
+	n := c.NVT()
+	if n == nil || !n.Send(data) {
+		return errNoConnection
+	}
+	return nil
+}
+
+// Charset return charset in use
+func (c *Connection) Charset() shared.Charset {
+	if n := c.NVT(); n != nil {
+		return n.Charset()
+	}
+	return c.config.Charset
+}
+
+// SetCharset set charset of connection, it takes effect at once if it's
+// connected
+func (c *Connection) SetCharset(cs shared.Charset) {
+	c.config.Charset = cs
+	if n := c.NVT(); n != nil {
+		n.SetCharset(cs)
+	}
+}
+
+func (c *Connection) forward() {
+	for msg := range c.out {
+		c.manager.output(c, msg)
+	}
+}
+
+// ConnManager keeps connections of session, input without "#name" prefix is
+// sent to the current connection
+type ConnManager struct {
+	mu      sync.Mutex
+	conns   map[string]*Connection
+	current *Connection
+	dir     string
+	// proxy, autoLog, scrollback, remote and web are settings of session
+	// saved in fname
+	proxy      string
+	autoLog    *logEntry
+	scrollback *scrollbackEntry
+	remote     *remoteEntry
+	web        *webEntry
+	fname      string
+
+	// out is where output of connections goes
+	out       chan<- connOutput
+	outMu     sync.Mutex
+	lastOut   *Connection
+	lineStart bool
+}
+
+func NewConnManager() *ConnManager {
+	return &ConnManager{
+		conns:     make(map[string]*Connection),
+		out:       connOutCh,
+		lineStart: true,
+	}
+}
+
+// SetProfile set profile directory of session, triggers of a connection are
+// kept in sub directory named by connection
+func (m *ConnManager) SetProfile(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dir = dir
+}
+
+// Get return connection name
+func (m *ConnManager) Get(name string) (*Connection, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.conns[name]
+	return c, ok
+}
+
+// GetOrCreate return connection name, it's created if not exist. The first
+// created connection becomes current.
+func (m *ConnManager) GetOrCreate(name string) (*Connection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getOrCreate(name)
+}
+
+func (m *ConnManager) getOrCreate(name string) (*Connection, error) {
+	if c, ok := m.conns[name]; ok {
+		return c, nil
+	}
+	if len(name) == 0 || strings.ContainsAny(name, " \t#/[]") {
+		return nil, fmt.Errorf("invalid connection name: %s", name)
+	}
+
+	c := newConnection(m, name)
+	if len(m.dir) > 0 {
+		dir := filepath.Join(m.dir, name)
+		if err := mkdirIfNotExist(dir, os.ModeDir|os.FileMode(0775)); err != nil {
+			return nil, err
+		}
+		if err := c.triggers.Load(filepath.Join(dir, triggerFileName)); err != nil {
+			return nil, err
+		}
+		if err := c.loadSettings(filepath.Join(dir, connFileName)); err != nil {
+			return nil, err
+		}
+	}
+
+	m.conns[name] = c
+	if m.current == nil {
+		m.current = c
+	}
+	return c, nil
+}
+
+// Current return the current connection, a connection named "default" is
+// created if there is no connection
+func (m *ConnManager) Current() *Connection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current == nil {
+		if _, err := m.getOrCreate(defaultConnName); err != nil {
+			// profile is not usable, go on without triggers of connection
+			c := newConnection(m, defaultConnName)
+			m.conns[c.name] = c
+			m.current = c
+		}
+	}
+	return m.current
+}
+
+// Switch make connection name current
+func (m *ConnManager) Switch(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.conns[name]
+	if !ok {
+		return fmt.Errorf("connection not found: %s", name)
+	}
+	m.current = c
+	return nil
+}
+
+// List return connections sorted by name
+func (m *ConnManager) List() []*Connection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*Connection, 0, len(m.conns))
+	for _, c := range m.conns {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// CloseAll close all connections
+func (m *ConnManager) CloseAll() {
+	for _, c := range m.List() {
+		c.Close()
+	}
+}
+
+// output write msg of c to screen, lines are tagged by connection name when
+// there are more than one connection. A line left incomplete by another
+// connection is ended first.
+func (m *ConnManager) output(c *Connection, msg []byte) {
+	m.mu.Lock()
+	tagged := len(m.conns) > 1
+	m.mu.Unlock()
+
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+
+	b := new(bytes.Buffer)
+	if m.lastOut != c && !m.lineStart {
+		b.WriteByte('\n')
+		m.lineStart = true
+	}
+	m.lastOut = c
+
+	for len(msg) > 0 {
+		if m.lineStart && tagged {
+			b.WriteString("[darkcyan]#" + c.name + "[-] ")
+		}
+		n := bytes.IndexByte(msg, '\n')
+		if n < 0 {
+			b.Write(msg)
+			m.lineStart = false
+			break
+		}
+		b.Write(msg[:n+1])
+		msg = msg[n+1:]
+		m.lineStart = true
+	}
+	m.out <- connOutput{conn: c.name, data: b.Bytes()}
+}
+
+var conns = NewConnManager()
+
+func handleCmdSwitch(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+
+	if len(args) > 0 {
+		if err := conns.Switch(args[0]); err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("switched to connection %s", args[0]), nil, nil
+	}
+
+	current := conns.Current()
+	msg := fmt.Sprintf("\t  %-16s%-14s%s\n", "NAME", "STATE", "ADDRESS")
+	for _, conn := range conns.List() {
+		mark := " "
+		if conn == current {
+			mark = "*"
+		}
+		state := conn.State()
+		msg = msg + fmt.Sprintf("\t%s %-16s%-14s%s\n", mark, conn.name, state, conn.Address())
+	}
+	return strings.TrimRight(msg, "\n"), nil, nil
+}
@@ -0,0 +1,35 @@
+package session
+
+import "testing"
+
+func TestConnOutputTagged(t *testing.T) {
+	out := make(chan connOutput, 10)
+	m := NewConnManager()
+	m.out = out
+	a, err := m.GetOrCreate("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != a {
+		t.Fatal("first connection is not current")
+	}
+
+	m.output(a, []byte("one\ntw"))
+	if got := <-out; got.conn != "a" || string(got.data) != "one\ntw" {
+		t.Fatalf("untagged output: got %s %q", got.conn, got.data)
+	}
+
+	b, err := m.GetOrCreate("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.output(b, []byte("x\n"))
+	want := "\n[darkcyan]#b[-] x\n"
+	if got := string((<-out).data); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := m.GetOrCreate("bad name"); err == nil {
+		t.Fatal("want error for invalid name")
+	}
+}
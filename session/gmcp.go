@@ -0,0 +1,139 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+// GMCPStore keeps the latest data of every GMCP package received from server
+type GMCPStore struct {
+	mu   sync.Mutex
+	data map[string]*telnet.GMCPMessage
+}
+
+func NewGMCPStore() *GMCPStore {
+	return &GMCPStore{
+		data: make(map[string]*telnet.GMCPMessage),
+	}
+}
+
+// Put is a telnet.GMCPHandler which saves msg
+func (s *GMCPStore) Put(msg *telnet.GMCPMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[msg.Package] = msg
+}
+
+// Get return the latest message of package pkg
+func (s *GMCPStore) Get(pkg string) (*telnet.GMCPMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.data[pkg]
+	return m, ok
+}
+
+// Packages return sorted names of all received packages
+func (s *GMCPStore) Packages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.data))
+	for n := range s.data {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var gmcpSubCommands = CommandMap{
+	"list": &Command{
+		name:       "list",
+		handler:    handleCmdGMCPList,
+		subCommand: nil,
+		desc:       "list received GMCP packages",
+		help:       "\tUsage: /gmcp list",
+	},
+	"show": &Command{
+		name:       "show",
+		handler:    handleCmdGMCPShow,
+		subCommand: nil,
+		desc:       "show latest data of a GMCP package",
+		help:       "\tUsage: /gmcp show <package>",
+	},
+	"send": &Command{
+		name:       "send",
+		handler:    handleCmdGMCPSend,
+		subCommand: nil,
+		desc:       "send a GMCP message to server",
+		help:       "\tUsage: /gmcp send <package> [json data]",
+	},
+}
+
+func handleCmdGMCPList(c *Command, p *bufio.Reader) (string, []byte, error) {
+	names := conns.Current().gmcp.Packages()
+	if len(names) == 0 {
+		return "No GMCP message received", nil, nil
+	}
+	return "GMCP packages:\n\t" + strings.Join(names, "\n\t"), nil, nil
+}
+
+func handleCmdGMCPShow(c *Command, p *bufio.Reader) (string, []byte, error) {
+	name, err := p.ReadString(' ')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	name = strings.TrimRight(name, " ")
+	if len(name) == 0 {
+		return c.help, nil, errors.New("need param: <package>")
+	}
+
+	msg, ok := conns.Current().gmcp.Get(name)
+	if !ok {
+		return "", nil, fmt.Errorf("GMCP package not received: %s", name)
+	}
+	return msg.String(), nil, nil
+}
+
+func handleCmdGMCPSend(c *Command, p *bufio.Reader) (string, []byte, error) {
+	name, err := p.ReadString(' ')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	name = strings.TrimRight(name, " ")
+	if len(name) == 0 {
+		return c.help, nil, errors.New("need param: <package>")
+	}
+
+	rest, err := ioutil.ReadAll(p)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var data interface{}
+	if s := strings.TrimSpace(string(rest)); len(s) > 0 {
+		if !json.Valid([]byte(s)) {
+			return "", nil, errors.New("data must be valid json")
+		}
+		data = json.RawMessage(s)
+	}
+
+	nvt := conns.Current().NVT()
+	if nvt == nil {
+		return "", nil, errNoConnection
+	}
+	if err := nvt.SendGMCP(name, data); err != nil {
+		return "", nil, err
+	}
+	return "", nil, nil
+}
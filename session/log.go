@@ -0,0 +1,719 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+const logDir = "logs"
+
+// defaultLogName is name of log file if it's not given
+const defaultLogName = "output"
+
+// LogFormat is format of session log
+type LogFormat int
+
+const (
+	// LogRaw keeps output as it's shown, with ANSI sequences and color tags
+	LogRaw LogFormat = iota
+	// LogPlain keeps only text
+	LogPlain
+	// LogHTML keeps colors of output in HTML
+	LogHTML
+)
+
+var logFormatName = []string{"raw", "plain", "html"}
+var logFormatExt = []string{".log", ".txt", ".html"}
+
+func parseLogFormat(s string) (LogFormat, bool) {
+	for i, name := range logFormatName {
+		if name == s {
+			return LogFormat(i), true
+		}
+	}
+	return 0, false
+}
+
+func (f LogFormat) String() string {
+	return logFormatName[f]
+}
+
+// LogOptions are options of session log
+type LogOptions struct {
+	Format     LogFormat
+	Timestamps bool
+	// Input logs commands of user
+	Input bool
+	// MaxSize rotates file when it's larger, 0 means no limit
+	MaxSize int64
+	// Daily rotates file when date changes
+	Daily bool
+}
+
+func (o LogOptions) String() string {
+	items := []string{o.Format.String()}
+	if o.Timestamps {
+		items = append(items, "timestamps")
+	}
+	if o.Input {
+		items = append(items, "input")
+	}
+	if o.Daily {
+		items = append(items, "rotate daily")
+	}
+	if o.MaxSize > 0 {
+		items = append(items, "rotate at "+formatSize(o.MaxSize))
+	}
+	return strings.Join(items, ", ")
+}
+
+// htmlHead and htmlTail enclose HTML log
+const htmlHead = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>xtelnet log</title>
+<style>
+body { background: black; color: silver; font-family: monospace; white-space: pre-wrap; }
+.ts { color: gray; }
+.input { color: yellow; }
+</style></head><body>
+`
+const htmlTail = "</body></html>\n"
+
+// colorTag matches tview color tags like [red], [-] and [red:blue:b] in
+// output of session
+var colorTag = regexp.MustCompile(`^\[([a-zA-Z]+|#[0-9a-fA-F]{6}|-)?(:([a-zA-Z]+|#[0-9a-fA-F]{6}|-)?)?(:([lbdru]+|-)?)?\]`)
+
+// SessionLog writes output of session into file
+type SessionLog struct {
+	mu    sync.Mutex
+	dir   string
+	opts  LogOptions
+	fname string
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+	day   string
+
+	lineStart bool
+	// style is current style of HTML log, span is set if a span is open
+	style telnet.SGRStyle
+	span  bool
+	// pending is incomplete escape sequence of last output
+	pending []byte
+	// err stopped the log
+	err error
+}
+
+func NewSessionLog() *SessionLog {
+	return &SessionLog{}
+}
+
+// SetDir set directory log files are written in by default
+func (l *SessionLog) SetDir(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dir = dir
+}
+
+// Start write log into file fname with options opts, fname is relative to
+// log directory if it's not absolute. The running log is stopped first.
+func (l *SessionLog) Start(fname string, opts LogOptions) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(fname) == 0 {
+		fname = defaultLogName + logFormatExt[opts.Format]
+	}
+	if !filepath.IsAbs(fname) {
+		if len(l.dir) == 0 {
+			return errors.New("no log directory")
+		}
+		fname = filepath.Join(l.dir, fname)
+	}
+
+	if err := l.close(); err != nil {
+		return err
+	}
+	l.opts = opts
+	l.fname = fname
+	l.err = nil
+	return l.open()
+}
+
+// Stop close log file, it return false if log is not running
+func (l *SessionLog) Stop() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return false, nil
+	}
+	return true, l.close()
+}
+
+// Status describe the running log
+func (l *SessionLog) Status() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		if l.err != nil {
+			return fmt.Sprintf("log: off, stopped by error: %s", l.err.Error())
+		}
+		return "log: off"
+	}
+	return fmt.Sprintf("log: %s (%s), %s written", l.fname, l.opts, formatSize(l.size))
+}
+
+// open open log file, caller must hold the lock
+func (l *SessionLog) open() error {
+	if err := mkdirIfNotExist(filepath.Dir(l.fname), os.ModeDir|os.FileMode(0775)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.size = info.Size()
+	l.day = time.Now().Format("2006-01-02")
+	l.lineStart = true
+	l.style = telnet.SGRStyle{}
+	l.span = false
+	l.pending = nil
+	if l.opts.Format == LogHTML {
+		l.write(htmlHead)
+	}
+	return nil
+}
+
+// close flush and close log file, caller must hold the lock
+func (l *SessionLog) close() error {
+	if l.f == nil {
+		return nil
+	}
+	if l.opts.Format == LogHTML {
+		l.closeSpan()
+		l.write(htmlTail)
+	}
+	err := l.w.Flush()
+	if e := l.f.Close(); err == nil {
+		err = e
+	}
+	l.f = nil
+	l.w = nil
+	return err
+}
+
+// rotate move log file aside and open a new one if it's too large or date
+// changed, caller must hold the lock
+func (l *SessionLog) rotate() error {
+	now := time.Now()
+	if !(l.opts.MaxSize > 0 && l.size >= l.opts.MaxSize) &&
+		!(l.opts.Daily && now.Format("2006-01-02") != l.day) {
+		return nil
+	}
+
+	if err := l.close(); err != nil {
+		return err
+	}
+	// file rotated in the same second is not overwritten
+	ext := filepath.Ext(l.fname)
+	base := strings.TrimSuffix(l.fname, ext) + now.Format("-20060102-150405")
+	aside := base + ext
+	for n := 1; ; n++ {
+		_, err := os.Stat(aside)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		aside = fmt.Sprintf("%s.%d%s", base, n, ext)
+	}
+	if err := os.Rename(l.fname, aside); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *SessionLog) write(s string) {
+	n, _ := l.w.WriteString(s)
+	l.size += int64(n)
+}
+
+// fail stop log by error err, caller must hold the lock
+func (l *SessionLog) fail(err error) {
+	l.err = err
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+		l.w = nil
+	}
+}
+
+// Output log output of session, log is stopped on error
+func (l *SessionLog) Output(msg []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return
+	}
+	if err := l.output(msg); err != nil {
+		l.fail(err)
+	}
+}
+
+func (l *SessionLog) output(msg []byte) error {
+	if len(l.pending) > 0 {
+		msg = append(l.pending, msg...)
+		l.pending = nil
+	}
+
+	r := bytes.NewReader(msg)
+	text := new(bytes.Buffer)
+	flush := func() {
+		if text.Len() > 0 {
+			l.text(text.String())
+			text.Reset()
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+
+		switch {
+		case b == '\n':
+			flush()
+			l.endLine()
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		case b == '\r' && l.opts.Format != LogRaw:
+		case b == 0x1b && l.opts.Format != LogRaw:
+			flush()
+			start := len(msg) - r.Len() - 1
+			seq, ctrl, err := telnet.ReadEscSeq(r)
+			text.Write(ctrl)
+			if err != nil {
+				// incomplete sequence, wait for the rest
+				l.pending = append([]byte{}, msg[start:]...)
+				return l.w.Flush()
+			}
+			if seq != nil && seq.Type == telnet.ESC_SGR && l.opts.Format == LogHTML {
+				l.style.Apply(seq.ParamString, true)
+				l.openSpan()
+			}
+		case b == '[' && l.opts.Format != LogRaw:
+			rest := msg[len(msg)-r.Len()-1:]
+			m := colorTag.FindSubmatch(rest)
+			if m == nil || len(m[0]) == 2 {
+				text.WriteByte(b)
+				continue
+			}
+			flush()
+			r.Seek(int64(len(m[0])-1), 1)
+			if l.opts.Format == LogHTML {
+				applyColorTag(&l.style, m)
+				l.openSpan()
+			}
+		default:
+			text.WriteByte(b)
+		}
+	}
+	flush()
+	return l.w.Flush()
+}
+
+// Input log command of user, log is stopped on error
+func (l *SessionLog) Input(cmd string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil || !l.opts.Input {
+		return
+	}
+	if l.opts.Format == LogHTML {
+		l.closeSpan()
+		l.stamp()
+		l.write(`<span class="input">` + html.EscapeString(cmd) + "</span>\n")
+		l.openSpan()
+	} else {
+		l.stamp()
+		l.write(cmd + "\n")
+	}
+	l.lineStart = true
+	if err := l.w.Flush(); err != nil {
+		l.fail(err)
+	}
+}
+
+// text write text of output, it doesn't contain line end
+func (l *SessionLog) text(s string) {
+	l.stamp()
+	if l.opts.Format == LogHTML {
+		s = html.EscapeString(s)
+	}
+	l.write(s)
+}
+
+func (l *SessionLog) endLine() {
+	l.stamp()
+	l.write("\n")
+	l.lineStart = true
+}
+
+// stamp write timestamp at line start if it's enabled
+func (l *SessionLog) stamp() {
+	if !l.lineStart {
+		return
+	}
+	l.lineStart = false
+	if !l.opts.Timestamps {
+		return
+	}
+	ts := time.Now().Format("[15:04:05] ")
+	if l.opts.Format == LogHTML {
+		l.closeSpan()
+		l.write(`<span class="ts">` + ts + "</span>")
+		l.openSpan()
+		return
+	}
+	l.write(ts)
+}
+
+// openSpan open span of current style, the open one is closed first
+func (l *SessionLog) openSpan() {
+	l.closeSpan()
+	css := styleCSS(&l.style)
+	if len(css) == 0 {
+		return
+	}
+	l.write(`<span style="` + css + `">`)
+	l.span = true
+}
+
+func (l *SessionLog) closeSpan() {
+	if l.span {
+		l.write("</span>")
+		l.span = false
+	}
+}
+
+// styleCSS return CSS of style s, color names of s are valid in CSS
+func styleCSS(s *telnet.SGRStyle) string {
+	fg, bg := s.Fg, s.Bg
+	if s.Reverse {
+		if fg == "" {
+			fg = "silver"
+		}
+		if bg == "" {
+			bg = "black"
+		}
+		fg, bg = bg, fg
+	}
+
+	items := []string{}
+	if len(fg) > 0 {
+		items = append(items, "color:"+fg)
+	}
+	if len(bg) > 0 {
+		items = append(items, "background:"+bg)
+	}
+	if s.Bold {
+		items = append(items, "font-weight:bold")
+	}
+	if s.Dim {
+		items = append(items, "opacity:0.6")
+	}
+	if s.Italic {
+		items = append(items, "font-style:italic")
+	}
+	if s.Underline {
+		items = append(items, "text-decoration:underline")
+	}
+	return strings.Join(items, ";")
+}
+
+// applyColorTag update style s by matched color tag m, empty field keeps
+// the old value and "-" resets it
+func applyColorTag(s *telnet.SGRStyle, m [][]byte) {
+	if fg := string(m[1]); fg == "-" {
+		s.Fg = ""
+	} else if len(fg) > 0 {
+		s.Fg = strings.ToLower(fg)
+	}
+	if bg := string(m[3]); bg == "-" {
+		s.Bg = ""
+	} else if len(bg) > 0 {
+		s.Bg = strings.ToLower(bg)
+	}
+	if attrs := string(m[5]); len(attrs) > 0 {
+		s.Bold = strings.Contains(attrs, "b")
+		s.Dim = strings.Contains(attrs, "d")
+		s.Underline = strings.Contains(attrs, "u")
+		s.Blink = strings.Contains(attrs, "l")
+		s.Reverse = strings.Contains(attrs, "r")
+		s.Italic = false
+	}
+}
+
+// parseSize parse size like 512, 64K, 10M or 1G
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// LogHomeDir return directory of log files of session name
+func LogHomeDir(name string) (string, error) {
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(userHome, cacheDir, logDir, name)
+	err = mkdirIfNotExist(dir, os.ModeDir|os.FileMode(0775))
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// logEntry is the persisted auto log setting of session
+type logEntry struct {
+	File       string `json:"file,omitempty"`
+	Format     string `json:"format"`
+	Timestamps bool   `json:"timestamps,omitempty"`
+	Input      bool   `json:"input,omitempty"`
+	Rotate     string `json:"rotate,omitempty"`
+}
+
+func newLogEntry(opts LogOptions) *logEntry {
+	e := &logEntry{
+		Format:     opts.Format.String(),
+		Timestamps: opts.Timestamps,
+		Input:      opts.Input,
+	}
+	if opts.Daily {
+		e.Rotate = "daily"
+	} else if opts.MaxSize > 0 {
+		e.Rotate = formatSize(opts.MaxSize)
+	}
+	return e
+}
+
+// options return log options of e, invalid values are ignored
+func (e *logEntry) options() LogOptions {
+	opts, _ := e.parse()
+	return opts
+}
+
+// parse return log options of e
+func (e *logEntry) parse() (LogOptions, error) {
+	var opts LogOptions
+	var ok bool
+	if opts.Format, ok = parseLogFormat(e.Format); !ok {
+		return opts, fmt.Errorf("unknown format: %s", e.Format)
+	}
+	opts.Timestamps = e.Timestamps
+	opts.Input = e.Input
+	if e.Rotate == "daily" {
+		opts.Daily = true
+	} else if len(e.Rotate) > 0 {
+		var err error
+		if opts.MaxSize, err = parseSize(e.Rotate); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+var sessionLog = NewSessionLog()
+
+var logSubCommands = CommandMap{
+	"start": &Command{
+		name:       "start",
+		handler:    handleCmdLogStart,
+		subCommand: nil,
+		desc:       "start writing output into file",
+		help:       "\tUsage: /log start [file] [--format raw|plain|html] [--timestamps] [--input] [--rotate daily|<size>]",
+	},
+	"stop": &Command{
+		name:       "stop",
+		handler:    handleCmdLogStop,
+		subCommand: nil,
+		desc:       "stop writing log",
+		help:       "\tUsage: /log stop",
+	},
+	"status": &Command{
+		name:       "status",
+		handler:    handleCmdLogStatus,
+		subCommand: nil,
+		desc:       "show log file and options",
+		help:       "\tUsage: /log status",
+	},
+	"auto": &Command{
+		name:       "auto",
+		handler:    handleCmdLogAuto,
+		subCommand: nil,
+		desc:       "start log automatically with session",
+		help:       "\tUsage: /log auto [off | on [file] [--format raw|plain|html] [--timestamps] [--input] [--rotate daily|<size>]]",
+	},
+}
+
+// readLogArgs read file name and options of /log start
+func readLogArgs(p *bufio.Reader) ([]string, LogOptions, error) {
+	var opts LogOptions
+	args, flags, err := readArgs(p, "timestamps", "input")
+	if err != nil {
+		return nil, opts, err
+	}
+	for name, value := range flags {
+		switch name {
+		case "format":
+			f, ok := parseLogFormat(value)
+			if !ok {
+				return nil, opts, fmt.Errorf("unknown format: %s", value)
+			}
+			opts.Format = f
+		case "timestamps":
+			opts.Timestamps = true
+		case "input":
+			opts.Input = true
+		case "rotate":
+			if value == "daily" {
+				opts.Daily = true
+			} else if opts.MaxSize, err = parseSize(value); err != nil {
+				return nil, opts, err
+			}
+		default:
+			return nil, opts, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	if len(args) > 1 {
+		return nil, opts, errors.New("too many params")
+	}
+	return args, opts, nil
+}
+
+func handleCmdLogStart(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readLogArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	var fname string
+	if len(args) > 0 {
+		fname = args[0]
+	}
+	if err := sessionLog.Start(fname, opts); err != nil {
+		return "", nil, err
+	}
+	return sessionLog.Status(), nil, nil
+}
+
+func handleCmdLogStop(c *Command, p *bufio.Reader) (string, []byte, error) {
+	ok, err := sessionLog.Stop()
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, errors.New("log is not running")
+	}
+	return "log: off", nil, nil
+}
+
+func handleCmdLogStatus(c *Command, p *bufio.Reader) (string, []byte, error) {
+	return sessionLog.Status(), nil, nil
+}
+
+func handleCmdLogAuto(c *Command, p *bufio.Reader) (string, []byte, error) {
+	word, err := p.ReadString(' ')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	word = strings.TrimSpace(word)
+	if len(word) == 0 {
+		conns.mu.Lock()
+		auto := conns.autoLog
+		conns.mu.Unlock()
+		if auto == nil {
+			return "auto log: off", nil, nil
+		}
+		return fmt.Sprintf("auto log: %s (%s)", auto.File, auto.options()), nil, nil
+	}
+
+	var auto *logEntry
+	switch word {
+	case "off":
+	case "on":
+		args, opts, err := readLogArgs(p)
+		if err != nil {
+			return c.help, nil, err
+		}
+		auto = newLogEntry(opts)
+		if len(args) > 0 {
+			auto.File = args[0]
+		}
+	default:
+		return c.help, nil, fmt.Errorf("unknown param: %s", word)
+	}
+
+	conns.mu.Lock()
+	conns.autoLog = auto
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	if auto == nil {
+		return "auto log: off", nil, nil
+	}
+	return fmt.Sprintf("auto log: %s (%s)", auto.File, auto.options()), nil, nil
+}
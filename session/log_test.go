@@ -0,0 +1,83 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionLogFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := []string{
+		"[yellow]connecting[-]\n",
+		"\x1b[31mred\x1b[0m <b> & \x1b[38;5",
+		";208mx\x1b[m\r\n",
+	}
+	for _, c := range []struct {
+		format LogFormat
+		want   string
+	}{
+		{LogRaw, strings.Join(output, "") + "look\n"},
+		{LogPlain, "connecting\nred <b> & x\nlook\n"},
+		{LogHTML, htmlHead + `<span style="color:yellow">connecting</span>` + "\n" +
+			`<span style="color:maroon">red</span> &lt;b&gt; &amp; <span style="color:#ff8700">x</span>` + "\n" +
+			`<span class="input">look</span>` + "\n" + htmlTail},
+	} {
+		l := NewSessionLog()
+		l.SetDir(dir)
+		if err := l.Start("", LogOptions{Format: c.format, Input: true}); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range output {
+			l.Output([]byte(msg))
+		}
+		l.Input("look")
+		if ok, err := l.Stop(); !ok || err != nil {
+			t.Fatalf("%s: stop: %v, %v", c.format, ok, err)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, defaultLogName+logFormatExt[c.format]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.want {
+			t.Errorf("%s: got %q, want %q", c.format, b, c.want)
+		}
+	}
+}
+
+func TestSessionLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewSessionLog()
+	l.SetDir(dir)
+	if err := l.Start("game.txt", LogOptions{Format: LogPlain, MaxSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// files rotated in the same second are all kept
+	for i := 0; i < 3; i++ {
+		l.Output([]byte("0123456789\n"))
+	}
+	l.Output([]byte("next\n"))
+	l.Stop()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "game*.txt"))
+	if len(files) != 4 {
+		t.Fatalf("got files %v", files)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "game.txt"))
+	if string(b) != "next\n" {
+		t.Fatalf("got %q after rotation", b)
+	}
+}
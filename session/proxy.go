@@ -0,0 +1,219 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+const sessionFileName = "session.json"
+
+// Proxy settings besides proxy address. Connection with empty setting uses
+// the global one, and the global one is proxyEnv if it's empty.
+const (
+	proxyEnv    = "env"
+	proxyDirect = "direct"
+)
+
+// sessionFile is the persisted settings of session
+type sessionFile struct {
+	Proxy      string           `json:"proxy,omitempty"`
+	AutoLog    *logEntry        `json:"autolog,omitempty"`
+	Scrollback *scrollbackEntry `json:"scrollback,omitempty"`
+	Remote     *remoteEntry     `json:"remote,omitempty"`
+	Web        *webEntry        `json:"web,omitempty"`
+}
+
+// loadSettings read session settings from file fname, later changes are
+// saved into it. A not existing file is taken as empty.
+func (m *ConnManager) loadSettings(fname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fname = fname
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	f := &sessionFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("%s: %s", fname, err.Error())
+	}
+	if err := checkProxy(f.Proxy); err != nil {
+		return fmt.Errorf("%s: proxy: %s", fname, err.Error())
+	}
+	if f.AutoLog != nil {
+		if _, err := f.AutoLog.parse(); err != nil {
+			return fmt.Errorf("%s: autolog: %s", fname, err.Error())
+		}
+	}
+	if f.Scrollback != nil {
+		if _, _, err := f.Scrollback.parse(); err != nil {
+			return fmt.Errorf("%s: scrollback: %s", fname, err.Error())
+		}
+	}
+	m.proxy = f.Proxy
+	m.autoLog = f.AutoLog
+	m.scrollback = f.Scrollback
+	m.remote = f.Remote
+	m.web = f.Web
+	return nil
+}
+
+// saveSettings write session settings into the file loaded from
+func (m *ConnManager) saveSettings() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.fname) == 0 {
+		return nil
+	}
+	f := &sessionFile{Proxy: m.proxy, AutoLog: m.autoLog, Scrollback: m.scrollback, Remote: m.remote, Web: m.web}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	// proxy may contain password
+	return writePrivateFile(m.fname, b)
+}
+
+// Proxy return global proxy setting
+func (m *ConnManager) Proxy() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.proxy) == 0 {
+		return proxyEnv
+	}
+	return m.proxy
+}
+
+// checkProxy report error if s is not a valid proxy setting
+func checkProxy(s string) error {
+	switch s {
+	case "", proxyEnv, proxyDirect:
+		return nil
+	}
+	_, err := telnet.ParseProxyURL(s)
+	return err
+}
+
+// proxyString return proxy address u without password
+func proxyString(u *url.URL) string {
+	v := *u
+	if v.User != nil {
+		v.User = url.User(v.User.Username())
+	}
+	return v.String()
+}
+
+// settingString return proxy setting s without password
+func settingString(s string) string {
+	switch s {
+	case "", proxyEnv, proxyDirect:
+		return s
+	}
+	u, err := telnet.ParseProxyURL(s)
+	if err != nil {
+		return s
+	}
+	return proxyString(u)
+}
+
+// dialer return dialer connecting server of c and description of proxy,
+// it's empty for direct connection
+func (c *Connection) dialer() (telnet.Dialer, string, error) {
+	c.mu.Lock()
+	setting, host := c.proxy, c.host
+	c.mu.Unlock()
+	if len(setting) == 0 {
+		setting = c.manager.Proxy()
+	}
+
+	var u *url.URL
+	var err error
+	switch setting {
+	case proxyDirect:
+		return telnet.DirectDialer, "", nil
+	case proxyEnv:
+		u, err = telnet.ProxyFromEnvironment(host)
+		if err != nil || u == nil {
+			return telnet.DirectDialer, "", err
+		}
+	default:
+		if u, err = telnet.ParseProxyURL(setting); err != nil {
+			return nil, "", err
+		}
+	}
+
+	d, err := telnet.NewProxyDialer(u, telnet.DirectDialer)
+	if err != nil {
+		return nil, "", err
+	}
+	return d, proxyString(u), nil
+}
+
+func handleCmdSetProxy(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "global")
+	if err != nil {
+		return c.help, nil, err
+	}
+	for name := range opts {
+		if name != "conn" && name != "global" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	if len(args) > 1 {
+		return c.help, nil, errors.New("too many params")
+	}
+	setting := ""
+	if len(args) > 0 && args[0] != "default" {
+		setting = args[0]
+		if err := checkProxy(setting); err != nil {
+			return c.help, nil, err
+		}
+	}
+
+	if _, ok := opts["global"]; ok {
+		if len(args) > 0 {
+			conns.mu.Lock()
+			conns.proxy = setting
+			conns.mu.Unlock()
+			if err := conns.saveSettings(); err != nil {
+				return "", nil, err
+			}
+		}
+		return fmt.Sprintf("global proxy: %s", settingString(conns.Proxy())), nil, nil
+	}
+
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	conn.mu.Lock()
+	if len(args) > 0 {
+		conn.proxy = setting
+	}
+	proxy := settingString(conn.proxy)
+	conn.mu.Unlock()
+	if len(args) > 0 {
+		if err := conn.saveSettings(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if len(proxy) == 0 {
+		proxy = "default (" + settingString(conns.Proxy()) + ")"
+	}
+	return fmt.Sprintf("proxy of %s: %s", conn.name, proxy), nil, nil
+}
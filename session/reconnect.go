@@ -0,0 +1,434 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/defsky/xtelnet/proto"
+	"github.com/defsky/xtelnet/telnet"
+	glua "github.com/yuin/gopher-lua"
+)
+
+const connFileName = "connection.json"
+
+// reconnectJitter is the fraction of delay randomly added or subtracted, so
+// connections closed together don't reconnect at the same time
+const reconnectJitter = 0.2
+
+// ConnEvent is lifecycle event of connection
+type ConnEvent string
+
+const (
+	EventConnecting   ConnEvent = "connecting"
+	EventConnected    ConnEvent = "connected"
+	EventDisconnected ConnEvent = "disconnected"
+	EventReconnecting ConnEvent = "reconnecting"
+	EventGaveUp       ConnEvent = "gave-up"
+)
+
+// ReconnectPolicy decides if and when a connection closed by server or
+// failed to open is reconnected. Delay is doubled on every attempt until
+// MaxDelay, MaxAttempts 0 means retrying forever.
+type ReconnectPolicy struct {
+	Enabled     bool
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+}
+
+func NewReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		Delay:       2 * time.Second,
+		MaxDelay:    2 * time.Minute,
+		MaxAttempts: 10,
+	}
+}
+
+// Backoff return delay before attempt n which starts from 1
+func (p *ReconnectPolicy) Backoff(n int) time.Duration {
+	d := p.Delay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	jitter := float64(d) * reconnectJitter * (2*rand.Float64() - 1)
+	return d + time.Duration(jitter)
+}
+
+// GiveUp report if no more attempt is allowed after n attempts
+func (p *ReconnectPolicy) GiveUp(n int) bool {
+	return p.MaxAttempts > 0 && n >= p.MaxAttempts
+}
+
+func (p *ReconnectPolicy) String() string {
+	if !p.Enabled {
+		return "off"
+	}
+	attempts := "unlimited"
+	if p.MaxAttempts > 0 {
+		attempts = strconv.Itoa(p.MaxAttempts)
+	}
+	return fmt.Sprintf("on, delay %s, max delay %s, attempts %s",
+		p.Delay, p.MaxDelay, attempts)
+}
+
+// connFile is the persisted settings of connection
+type connFile struct {
+	Reconnect struct {
+		Enabled     bool   `json:"enabled"`
+		Delay       string `json:"delay"`
+		MaxDelay    string `json:"max_delay"`
+		MaxAttempts int    `json:"max_attempts"`
+	} `json:"reconnect"`
+	Login     string          `json:"login,omitempty"`
+	Proxy     string          `json:"proxy,omitempty"`
+	Keepalive *keepaliveEntry `json:"keepalive,omitempty"`
+	TType     *ttypeEntry     `json:"ttype,omitempty"`
+	TLS       *tlsEntry       `json:"tls,omitempty"`
+}
+
+// tlsEntry is the persisted TLS settings of connection
+type tlsEntry struct {
+	Enabled  bool   `json:"enabled"`
+	CA       string `json:"ca,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	StartTLS bool   `json:"starttls"`
+}
+
+// ttypeEntry is the persisted TTYPE identity of connection, MTTS is
+// capability names separated by comma
+type ttypeEntry struct {
+	Name     string `json:"name"`
+	Terminal string `json:"terminal"`
+	MTTS     string `json:"mtts"`
+}
+
+// keepaliveEntry is the persisted keepalive setting of connection
+type keepaliveEntry struct {
+	Interval string `json:"interval"`
+	Command  string `json:"command"`
+}
+
+// loadSettings read reconnect policy, login script, keepalive, proxy, TTYPE
+// identity and TLS settings of c from file fname, later changes are saved
+// into it. A not existing file is taken as empty.
+func (c *Connection) loadSettings(fname string) error {
+	c.mu.Lock()
+	c.fname = fname
+	c.mu.Unlock()
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	f := &connFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("%s: %s", fname, err.Error())
+	}
+	policy := NewReconnectPolicy()
+	policy.Enabled = f.Reconnect.Enabled
+	policy.MaxAttempts = f.Reconnect.MaxAttempts
+	if len(f.Reconnect.Delay) > 0 {
+		if policy.Delay, err = parseInterval(f.Reconnect.Delay); err != nil {
+			return fmt.Errorf("%s: delay: %s", fname, err.Error())
+		}
+	}
+	if len(f.Reconnect.MaxDelay) > 0 {
+		if policy.MaxDelay, err = parseInterval(f.Reconnect.MaxDelay); err != nil {
+			return fmt.Errorf("%s: max_delay: %s", fname, err.Error())
+		}
+	}
+
+	if err := checkProxy(f.Proxy); err != nil {
+		return fmt.Errorf("%s: proxy: %s", fname, err.Error())
+	}
+	if f.TLS != nil {
+		c.config.TLS.Set(telnet.TLSConfig{
+			Enabled:  f.TLS.Enabled,
+			CAFile:   f.TLS.CA,
+			CertFile: f.TLS.Cert,
+			KeyFile:  f.TLS.Key,
+			Insecure: f.TLS.Insecure,
+			StartTLS: f.TLS.StartTLS,
+		})
+	}
+	if f.TType != nil {
+		caps, err := parseMTTSFlags(f.TType.MTTS)
+		if err != nil {
+			return fmt.Errorf("%s: mtts: %s", fname, err.Error())
+		}
+		c.config.TType.SetIdentity(f.TType.Name, f.TType.Terminal)
+		c.config.TType.SetCapabilities(caps)
+	}
+	if f.Keepalive != nil {
+		d, err := parseInterval(f.Keepalive.Interval)
+		if err != nil {
+			return fmt.Errorf("%s: keepalive: %s", fname, err.Error())
+		}
+		if err := c.setKeepalive(d, f.Keepalive.Command); err != nil {
+			return fmt.Errorf("%s: keepalive: %s", fname, err.Error())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.policy = policy
+	c.login = f.Login
+	c.proxy = f.Proxy
+	return nil
+}
+
+// saveSettings write reconnect policy, login script, keepalive, proxy, TTYPE
+// identity and TLS settings of c into the file loaded from, TTYPE identity
+// and TLS settings are saved only if they are not the default
+func (c *Connection) saveSettings() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.fname) == 0 {
+		return nil
+	}
+
+	f := &connFile{Login: c.login, Proxy: c.proxy}
+	f.Reconnect.Enabled = c.policy.Enabled
+	f.Reconnect.Delay = c.policy.Delay.String()
+	f.Reconnect.MaxDelay = c.policy.MaxDelay.String()
+	f.Reconnect.MaxAttempts = c.policy.MaxAttempts
+	if c.keepalive > 0 {
+		f.Keepalive = &keepaliveEntry{
+			Interval: c.keepalive.String(),
+			Command:  c.keepaliveCmd,
+		}
+	}
+	if tc := c.config.TLS.Get(); tc != telnet.NewTLSOption().Get() {
+		f.TLS = &tlsEntry{
+			Enabled:  tc.Enabled,
+			CA:       tc.CAFile,
+			Cert:     tc.CertFile,
+			Key:      tc.KeyFile,
+			Insecure: tc.Insecure,
+			StartTLS: tc.StartTLS,
+		}
+	}
+	ttype, def := c.config.TType, telnet.NewTTypeOption()
+	name, term := ttype.Identity()
+	defName, defTerm := def.Identity()
+	if name != defName || term != defTerm || ttype.Capabilities() != def.Capabilities() {
+		f.TType = &ttypeEntry{
+			Name:     name,
+			Terminal: term,
+			MTTS:     ttype.Capabilities().String(),
+		}
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	// login script usually contains password
+	return writePrivateFile(c.fname, b)
+}
+
+// parseMTTSFlags parse capability names separated by comma
+func parseMTTSFlags(s string) (telnet.MTTSFlag, error) {
+	var caps telnet.MTTSFlag
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		flag, ok := telnet.ParseMTTSFlag(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown capability: %s", name)
+		}
+		caps |= flag
+	}
+	return caps, nil
+}
+
+// emit notify attached client, scripts and API subscribers event ev of c,
+// detail is shown on screen if it's not empty
+func (c *Connection) emit(ev ConnEvent, detail string) {
+	if len(detail) > 0 {
+		c.out <- []byte(fmt.Sprintf("[yellow]%s: %s[-]\n", ev, detail))
+	}
+
+	p := &proto.Packet{}
+	p.Opcode = proto.SM_CONN_EVENT
+	p.WriteString(c.name + " " + string(ev))
+	select {
+	case eventCh <- p:
+	default:
+		// nobody reads events, drop it rather than block connection
+	}
+
+	runEventHooks(c, ev, detail)
+	publishConnEvent(c, ev, detail)
+}
+
+// runEventHooks post event of connection c to callbacks registered by
+// on_event
+func runEventHooks(c *Connection, ev ConnEvent, detail string) {
+	if atomic.LoadInt32(&hookCount.event) == 0 {
+		return
+	}
+
+	luaEngine.Post(func(L *glua.LState) error {
+		var first error
+		for _, h := range scriptHooks.event {
+			err := L.CallByParam(glua.P{Fn: h.fn, NRet: 0, Protect: true},
+				glua.LString(ev), glua.LString(c.name), glua.LString(detail))
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+func handleCmdReconnect(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+
+	conn := conns.Current()
+	if len(args) > 0 {
+		var ok bool
+		if conn, ok = conns.Get(args[0]); !ok {
+			return "", nil, fmt.Errorf("connection not found: %s", args[0])
+		}
+	}
+	if err := conn.Reconnect(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, nil
+}
+
+// selectConn return connection named by option --conn, or the current
+// connection if it's not given
+func selectConn(opts map[string]string) (*Connection, error) {
+	if name, ok := opts["conn"]; ok {
+		return conns.GetOrCreate(name)
+	}
+	return conns.Current(), nil
+}
+
+func handleCmdSetReconnect(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	conn.mu.Lock()
+	policy := *conn.policy
+	conn.mu.Unlock()
+
+	if len(args) == 0 && len(opts) == 0 {
+		return fmt.Sprintf("reconnect of %s: %s", conn.name, &policy), nil, nil
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "on":
+			policy.Enabled = true
+		case "off":
+			policy.Enabled = false
+		default:
+			return c.help, nil, fmt.Errorf("unknown param: %s", args[0])
+		}
+	}
+	for name, value := range opts {
+		switch name {
+		case "conn":
+		case "delay":
+			if policy.Delay, err = parseInterval(value); err != nil {
+				return c.help, nil, err
+			}
+		case "max-delay":
+			if policy.MaxDelay, err = parseInterval(value); err != nil {
+				return c.help, nil, err
+			}
+		case "attempts":
+			if policy.MaxAttempts, err = strconv.Atoi(value); err != nil || policy.MaxAttempts < 0 {
+				return c.help, nil, errors.New("attempts must be a number not less than 0")
+			}
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	if policy.Delay < minTimerInterval || policy.MaxDelay < policy.Delay {
+		return "", nil, fmt.Errorf("delay must be in range %s-<max delay>", minTimerInterval)
+	}
+
+	conn.mu.Lock()
+	*conn.policy = policy
+	conn.mu.Unlock()
+	if err := conn.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("reconnect of %s: %s", conn.name, &policy), nil, nil
+}
+
+func handleCmdSetLogin(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "none")
+	if err != nil {
+		return c.help, nil, err
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	for name := range opts {
+		if name != "conn" && name != "none" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+
+	conn.mu.Lock()
+	if _, ok := opts["none"]; ok {
+		conn.login = ""
+	} else if len(args) > 0 {
+		conn.login = strings.Join(args, " ")
+	} else {
+		login := conn.login
+		conn.mu.Unlock()
+		return fmt.Sprintf("login of %s: %s", conn.name, loginString(login)), nil, nil
+	}
+	login := conn.login
+	conn.mu.Unlock()
+
+	if err := conn.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("login of %s: %s", conn.name, loginString(login)), nil, nil
+}
+
+// loginString describe login script without showing it, output is seen by
+// every attached client
+func loginString(login string) string {
+	if len(login) == 0 {
+		return "none"
+	}
+	return "set, hidden"
+}
@@ -0,0 +1,259 @@
+package session
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	p := &ReconnectPolicy{
+		Enabled:     true,
+		Delay:       time.Second,
+		MaxDelay:    10 * time.Second,
+		MaxAttempts: 3,
+	}
+	for n, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		d := p.Backoff(n)
+		if d < want*8/10 || d > want*12/10 {
+			t.Errorf("attempt %d: got %s, want about %s", n, d, want)
+		}
+	}
+
+	if p.GiveUp(2) || !p.GiveUp(3) {
+		t.Error("want giving up after 3 attempts")
+	}
+	p.MaxAttempts = 0
+	if p.GiveUp(100) {
+		t.Error("want retrying forever")
+	}
+}
+
+// startServer listen on a local port, the first drop connections accepted
+// are closed at once
+func startServer(t *testing.T, drop int) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		kept := []net.Conn{}
+		defer func() {
+			for _, conn := range kept {
+				conn.Close()
+			}
+		}()
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if n < drop {
+				conn.Close()
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port, func() { ln.Close() }
+}
+
+// newTestConn return a connection whose output is discarded
+func newTestConn(t *testing.T, policy *ReconnectPolicy) (*Connection, func()) {
+	out := make(chan connOutput, 10)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-out:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// events of former tests
+	for len(eventCh) > 0 {
+		<-eventCh
+	}
+
+	m := NewConnManager()
+	m.out = out
+	c, err := m.GetOrCreate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.policy = policy
+	return c, func() {
+		if c.Close() {
+			waitEvents(t, EventDisconnected)
+		}
+		close(done)
+	}
+}
+
+func waitEvents(t *testing.T, events ...ConnEvent) {
+	for _, ev := range events {
+		select {
+		case p := <-eventCh:
+			if got := p.String(); got != "test "+string(ev) {
+				t.Fatalf("got event %q, want %q", got, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %s", ev)
+		}
+	}
+}
+
+func TestConnectionReconnect(t *testing.T) {
+	port, stop := startServer(t, 1)
+	defer stop()
+
+	c, cleanup := newTestConn(t, &ReconnectPolicy{
+		Enabled:     true,
+		Delay:       minTimerInterval,
+		MaxDelay:    time.Second,
+		MaxAttempts: 1,
+	})
+	defer cleanup()
+
+	if err := c.Open("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	waitEvents(t,
+		EventConnecting, EventConnected, EventDisconnected,
+		EventReconnecting, EventConnecting, EventConnected)
+	if !c.IsConnected() {
+		t.Fatal("connection is not reconnected")
+	}
+}
+
+func TestConnectionGiveUp(t *testing.T) {
+	port, stop := startServer(t, 100)
+	defer stop()
+
+	c, cleanup := newTestConn(t, &ReconnectPolicy{
+		Enabled:     true,
+		Delay:       minTimerInterval,
+		MaxDelay:    time.Second,
+		MaxAttempts: 2,
+	})
+	defer cleanup()
+
+	if err := c.Open("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	// connections dropped at once don't reset attempts
+	waitEvents(t,
+		EventConnecting, EventConnected, EventDisconnected, EventReconnecting,
+		EventConnecting, EventConnected, EventDisconnected, EventReconnecting,
+		EventConnecting, EventConnected, EventDisconnected, EventGaveUp)
+}
+
+func TestConnectionDialing(t *testing.T) {
+	// TLS handshake never completes, so connecting lasts until server stops
+	port, stop := startServer(t, 0)
+	defer stop()
+
+	c, cleanup := newTestConn(t, NewReconnectPolicy())
+	defer cleanup()
+	c.config.TLS.Set(telnet.TLSConfig{Enabled: true})
+
+	if err := c.Open("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	waitEvents(t, EventConnecting)
+	if err := c.Open("127.0.0.1", port); err == nil || !strings.Contains(err.Error(), "connecting") {
+		t.Fatalf("got %v opening while connecting", err)
+	}
+	if !c.Close() {
+		t.Fatal("connecting is not canceled")
+	}
+	waitEvents(t, EventDisconnected)
+	if err := c.Open("127.0.0.1", port); err != nil {
+		t.Fatalf("got %v opening after canceled", err)
+	}
+	waitEvents(t, EventConnecting)
+}
+
+func TestLoginSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, connFileName)
+	// file of former version is readable by others
+	if err := ioutil.WriteFile(fname, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, cleanup := newTestConn(t, NewReconnectPolicy())
+	defer cleanup()
+	if err := c.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	c.login = "guest;secret"
+	if err := c.saveSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("got %v, %v", fi.Mode(), err)
+	}
+
+	c2 := newConnection(c.manager, c.name)
+	if err := c2.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	if c2.login != c.login {
+		t.Fatalf("login not restored: %q", c2.login)
+	}
+	if s := loginString(c2.login); strings.Contains(s, "secret") {
+		t.Fatalf("login is shown: %s", s)
+	}
+}
+
+func TestTTypeSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, connFileName)
+
+	c, cleanup := newTestConn(t, NewReconnectPolicy())
+	defer cleanup()
+	if err := c.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	c.config.TType.SetIdentity("MUDLET", "ansi")
+	c.config.TType.SetCapability(telnet.MTTS_MNES, true)
+	if err := c.saveSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := newConnection(c.manager, c.name)
+	if err := c2.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	name, term := c2.config.TType.Identity()
+	if name != "MUDLET" || term != "ANSI" {
+		t.Fatalf("identity not restored: %s %s", name, term)
+	}
+	if got, want := c2.config.TType.Capabilities(), c.config.TType.Capabilities(); got != want {
+		t.Fatalf("mtts not restored: %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,518 @@
+package session
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/defsky/xtelnet/proto"
+	"github.com/defsky/xtelnet/telnet"
+)
+
+const (
+	remoteCertFile = "remote-cert.pem"
+	remoteKeyFile  = "remote-key.pem"
+	tokenFileName  = "remote.token"
+
+	// authTimeout is the max time from connecting to being authenticated
+	authTimeout = 10 * time.Second
+
+	// a host failing authentication maxAuthFails times in authFailWindow
+	// is refused until the window passes
+	maxAuthFails   = 5
+	authFailWindow = time.Minute
+)
+
+var errAuthFailed = errors.New("authentication failed")
+var errAuthLimited = errors.New("too many failed attempts, try later")
+
+// NewToken generate access token of session name for remote attaching, the
+// former one is revoked. Only hash of token is saved.
+func NewToken(name string) (string, error) {
+	dir, err := ProfileHomeDir(name)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(filepath.Join(dir, tokenFileName), []byte(hashToken(token)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken remove access token of session name
+func RevokeToken(name string) error {
+	dir, err := ProfileHomeDir(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, tokenFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RemoteFingerprint return fingerprint of certificate generated for remote
+// listener of session name, it's empty if there is none
+func RemoteFingerprint(name string) string {
+	dir, err := ProfileHomeDir(name)
+	if err != nil {
+		return ""
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, remoteCertFile), filepath.Join(dir, remoteKeyFile))
+	if err != nil {
+		return ""
+	}
+	return certFingerprint(cert.Certificate[0])
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkToken report error if token doesn't match the hash saved in fname
+func checkToken(fname, token string) error {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil || len(token) == 0 {
+		return errAuthFailed
+	}
+	want := strings.TrimSpace(string(b))
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(want)) != 1 {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// certFingerprint return SHA-256 of certificate der in hex
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadOrCreateCert load certificate of remote listener, a self-signed one
+// is generated in dir if certFile is empty
+func loadOrCreateCert(dir, certFile, keyFile string) (tls.Certificate, error) {
+	if len(certFile) > 0 {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certFile = filepath.Join(dir, remoteCertFile)
+	keyFile = filepath.Join(dir, remoteKeyFile)
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "xtelnet"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// authLimiter counts failed authentication of every host, an attempt is
+// counted as failed until it succeeds, so concurrent attempts can't exceed
+// the limit
+type authLimiter struct {
+	mu     sync.Mutex
+	max    int
+	window time.Duration
+	fails  map[string][]time.Time
+	now    func() time.Time
+	// pruned is when hosts not failing in window were removed
+	pruned time.Time
+}
+
+func newAuthLimiter(max int, window time.Duration) *authLimiter {
+	return &authLimiter{
+		max:    max,
+		window: window,
+		fails:  make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+// recent return failures of host in window, it must be called with mu
+// locked
+func (l *authLimiter) recent(host string) []time.Time {
+	since := l.now().Add(-l.window)
+	fails := l.fails[host]
+	for len(fails) > 0 && fails[0].Before(since) {
+		fails = fails[1:]
+	}
+	if len(fails) == 0 {
+		delete(l.fails, host)
+		return nil
+	}
+	l.fails[host] = fails
+	return fails
+}
+
+// allow report if host may try to authenticate, the attempt is reserved
+// and release must be called if it succeeds
+func (l *authLimiter) allow(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.pruned) >= l.window {
+		for h := range l.fails {
+			l.recent(h)
+		}
+		l.pruned = now
+	}
+	fails := l.recent(host)
+	if len(fails) >= l.max {
+		return false
+	}
+	l.fails[host] = append(fails, now)
+	return true
+}
+
+// release forget an attempt of host reserved by allow
+func (l *authLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fails := l.recent(host)
+	if len(fails) <= 1 {
+		delete(l.fails, host)
+		return
+	}
+	l.fails[host] = fails[:len(fails)-1]
+}
+
+// remoteListener accepts clients over TCP with TLS, a client must send
+// access token of session after hello
+type remoteListener struct {
+	mu          sync.Mutex
+	name        string
+	dir         string
+	term        *Terminal
+	ln          net.Listener
+	fingerprint string
+	limiter     *authLimiter
+}
+
+var remote = &remoteListener{
+	limiter: newAuthLimiter(maxAuthFails, authFailWindow),
+}
+
+// remoteEntry is the persisted remote listener setting of session
+type remoteEntry struct {
+	Addr string `json:"addr"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// setSession set name and profile directory of session, and terminal
+// serving clients
+func (r *remoteListener) setSession(name, dir string, term *Terminal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.name = name
+	r.dir = dir
+	r.term = term
+}
+
+// Listen start accepting clients on addr, listener started before is
+// stopped. A self-signed certificate is used if certFile is empty.
+func (r *remoteListener) Listen(addr, certFile, keyFile string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.term == nil {
+		return errors.New("session is not started")
+	}
+	cert, err := loadOrCreateCert(r.dir, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if r.ln != nil {
+		r.ln.Close()
+	}
+	r.ln = ln
+	r.fingerprint = certFingerprint(cert.Certificate[0])
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	go r.serve(tls.NewListener(ln, cfg))
+	return nil
+}
+
+// Stop close the listener, attached clients are kept
+func (r *remoteListener) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ln != nil {
+		r.ln.Close()
+		r.ln = nil
+	}
+}
+
+// Status describe the listener
+func (r *remoteListener) Status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ln == nil {
+		return "not listening"
+	}
+	s := fmt.Sprintf("listening on %s, fingerprint %s", r.ln.Addr(), r.fingerprint)
+	if _, err := os.Stat(filepath.Join(r.dir, tokenFileName)); err != nil {
+		s += ", [red]no access token[-], run: xtelnet token " + r.name
+	}
+	return s
+}
+
+func (r *remoteListener) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle run handshake and authentication of client conn, then serve it
+// like a local client
+func (r *remoteListener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	p, err := proto.ReadPacket(conn)
+	if err != nil || p.Opcode != proto.CM_HELLO {
+		conn.Close()
+		return
+	}
+	peer, err := proto.ServerHandshake(conn, p)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if p, err = proto.ReadPacket(conn); err != nil || p.Opcode != proto.CM_AUTH {
+		conn.Close()
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	err = r.auth(host, p)
+	if werr := proto.WritePacket(conn, proto.AuthAck(err)); err != nil || werr != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	r.mu.Lock()
+	term := r.term
+	r.mu.Unlock()
+	term.serve(conn, peer)
+}
+
+// auth check session name and token in CM_AUTH packet p from host
+func (r *remoteListener) auth(host string, p *proto.Packet) error {
+	if !r.limiter.allow(host) {
+		return errAuthLimited
+	}
+	name, token, err := proto.ParseAuth(p)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	ok := name == r.name || name == fmt.Sprintf("%d.%s", os.Getpid(), r.name)
+	fname := filepath.Join(r.dir, tokenFileName)
+	r.mu.Unlock()
+	if !ok {
+		return errAuthFailed
+	}
+	if err := checkToken(fname, token); err != nil {
+		return err
+	}
+	r.limiter.release(host)
+	return nil
+}
+
+// RemoteOptions are options of attaching session on other host
+type RemoteOptions struct {
+	Token string
+	// Fingerprint is SHA-256 of server certificate, if it's set the
+	// certificate is checked by it only
+	Fingerprint string
+	CAFile      string
+	Insecure    bool
+}
+
+// DialRemote connect session name listening on addr, handshake and
+// authentication are done on return
+func DialRemote(addr, name string, opts RemoteOptions) (net.Conn, *proto.Hello, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := telnet.TLSConfig{CAFile: opts.CAFile, Insecure: opts.Insecure}
+	tlsCfg, err := cfg.ClientConfig(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(opts.Fingerprint) > 0 {
+		want := strings.ToLower(strings.Replace(opts.Fingerprint, ":", "", -1))
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 || certFingerprint(certs[0]) != want {
+				return errors.New("certificate fingerprint mismatch")
+			}
+			return nil
+		}
+	}
+
+	d := &net.Dialer{Timeout: authTimeout}
+	conn, err := tls.DialWithDialer(d, "tcp", addr, tlsCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := proto.ClientHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := proto.ClientAuth(conn, name, opts.Token); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, peer, nil
+}
+
+var remoteSubCommands = CommandMap{
+	"listen": &Command{
+		name:       "listen",
+		handler:    handleCmdRemoteListen,
+		subCommand: nil,
+		desc:       "accept attaching from other hosts",
+		help:       "\tUsage: /remote listen <addr> [--cert <file> --key <file>]",
+	},
+	"stop": &Command{
+		name:       "stop",
+		handler:    handleCmdRemoteStop,
+		subCommand: nil,
+		desc:       "stop accepting attaching from other hosts",
+		help:       "\tUsage: /remote stop",
+	},
+	"status": &Command{
+		name:       "status",
+		handler:    handleCmdRemoteStatus,
+		subCommand: nil,
+		desc:       "show status of remote listener",
+		help:       "\tUsage: /remote status",
+	},
+}
+
+func handleCmdRemoteListen(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) != 1 {
+		return c.help, nil, errors.New("address is required")
+	}
+	e := &remoteEntry{Addr: args[0]}
+	for name, value := range opts {
+		switch name {
+		case "cert":
+			e.Cert = value
+		case "key":
+			e.Key = value
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	if (len(e.Cert) == 0) != (len(e.Key) == 0) {
+		return c.help, nil, errors.New("--cert and --key must be set together")
+	}
+
+	if err := remote.Listen(e.Addr, e.Cert, e.Key); err != nil {
+		return "", nil, err
+	}
+	conns.mu.Lock()
+	conns.remote = e
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return "remote: " + remote.Status(), nil, nil
+}
+
+func handleCmdRemoteStop(c *Command, p *bufio.Reader) (string, []byte, error) {
+	remote.Stop()
+	conns.mu.Lock()
+	conns.remote = nil
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return "remote: " + remote.Status(), nil, nil
+}
+
+func handleCmdRemoteStatus(c *Command, p *bufio.Reader) (string, []byte, error) {
+	return "remote: " + remote.Status(), nil, nil
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/proto"
+)
+
+func TestRemoteAttach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+
+	token, err := NewToken("mud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _ := ProfileHomeDir("mud")
+
+	term := NewTerminal()
+	term.buffer = NewLineBuffer(100, 1<<20)
+	term.output("", []byte("welcome\n"))
+
+	now := time.Now()
+	r := &remoteListener{limiter: newAuthLimiter(maxAuthFails, authFailWindow)}
+	r.limiter.now = func() time.Time { return now }
+	r.setSession("mud", profile, term)
+	if err := r.Listen("127.0.0.1:0", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	addr := r.ln.Addr().String()
+	opts := RemoteOptions{Token: token, Fingerprint: RemoteFingerprint("mud")}
+
+	conn, peer, err := DialRemote(addr, "mud", opts)
+	if err != nil || !peer.Has(proto.FeatureHistory) {
+		t.Fatalf("got %+v, %v", peer, err)
+	}
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_ATTACH_REQ
+	p.WriteByte(0)
+	proto.WritePacket(conn, p)
+	if p, err := proto.ReadPacket(conn); err != nil || p.Opcode != proto.SM_ATTACH_ACK {
+		t.Fatalf("got %v, %v on attaching", p, err)
+	}
+	if p, err := proto.ReadPacket(conn); err != nil || !strings.Contains(p.String(), "welcome") {
+		t.Fatalf("got %v, %v for first screen", p, err)
+	}
+	conn.Close()
+
+	// certificate not matching fingerprint is refused
+	bad := opts
+	bad.Fingerprint = strings.Repeat("0", 64)
+	if _, _, err := DialRemote(addr, "mud", bad); err == nil {
+		t.Fatal("certificate with wrong fingerprint is accepted")
+	}
+
+	// wrong token and wrong session are denied, then host is blocked
+	bad = opts
+	bad.Token = "wrong"
+	for i := 0; i < maxAuthFails; i++ {
+		name := "mud"
+		if i == 0 {
+			name = "other"
+		}
+		if _, _, err := DialRemote(addr, name, bad); err == nil || !strings.Contains(err.Error(), errAuthFailed.Error()) {
+			t.Fatalf("attempt %d: got %v", i, err)
+		}
+	}
+	if _, _, err := DialRemote(addr, "mud", opts); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Fatalf("got %v when blocked", err)
+	}
+
+	// block is lifted after the window
+	now = now.Add(authFailWindow + time.Second)
+	conn, _, err = DialRemote(addr, "mud", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	RevokeToken("mud")
+	if _, _, err := DialRemote(addr, "mud", opts); err == nil {
+		t.Fatal("revoked token is accepted")
+	}
+}
+
+func TestAuthLimiter(t *testing.T) {
+	now := time.Now()
+	l := newAuthLimiter(3, time.Minute)
+	l.now = func() time.Time { return now }
+
+	// attempts in progress are counted
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("attempt %d is refused", i)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("attempt over limit is allowed")
+	}
+	l.release("a")
+	if !l.allow("a") {
+		t.Fatal("succeeded attempt is counted")
+	}
+
+	// hosts never coming back are removed
+	l.allow("b")
+	now = now.Add(2 * time.Minute)
+	l.allow("c")
+	if _, ok := l.fails["a"]; ok || len(l.fails) != 1 {
+		t.Fatalf("got %d hosts after window", len(l.fails))
+	}
+}
@@ -0,0 +1,460 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/defsky/xtelnet/shared/lua"
+	"github.com/defsky/xtelnet/telnet"
+	glua "github.com/yuin/gopher-lua"
+)
+
+const scriptFileName = "init.lua"
+
+// VarStore keeps variables shared by scripts and commands
+type VarStore struct {
+	mu   sync.Mutex
+	data map[string]interface{}
+}
+
+func NewVarStore() *VarStore {
+	return &VarStore{
+		data: make(map[string]interface{}),
+	}
+}
+
+// Get return value of variable name, nil is returned if it's not set
+func (s *VarStore) Get(name string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data[name]
+}
+
+// Set set value of variable name, nil value deletes it
+func (s *VarStore) Set(name string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == nil {
+		delete(s.data, name)
+		return
+	}
+	s.data[name] = value
+}
+
+// Names return sorted names of all variables
+func (s *VarStore) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.data))
+	for n := range s.data {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var vars = NewVarStore()
+var luaEngine = lua.NewEngine()
+
+// scriptHook is a callback registered by script, prefix is the GMCP
+// package of on_gmcp
+type scriptHook struct {
+	script string
+	prefix string
+	fn     *glua.LFunction
+}
+
+// scriptHooks are callbacks registered by scripts, they are only accessed
+// in goroutine of luaEngine
+var scriptHooks = struct {
+	line   []scriptHook
+	prompt []scriptHook
+	gmcp   []scriptHook
+	event  []scriptHook
+}{}
+
+// hookCount is the number of callbacks in scriptHooks, it's read by other
+// goroutines to skip posting jobs when nothing is registered
+var hookCount struct {
+	line, prompt, gmcp, event int32
+}
+
+// scriptLoading is the script file being loaded, it's only accessed in
+// goroutine of luaEngine
+var scriptLoading string
+
+// addHook append callback fn to hooks, it's tagged by the script being
+// loaded
+func addHook(hooks *[]scriptHook, prefix string, fn *glua.LFunction) {
+	*hooks = append(*hooks, scriptHook{
+		script: scriptLoading,
+		prefix: prefix,
+		fn:     fn,
+	})
+	countHooks()
+}
+
+// dropHooks remove callbacks registered by script
+func dropHooks(script string) {
+	for _, hooks := range []*[]scriptHook{
+		&scriptHooks.line, &scriptHooks.prompt, &scriptHooks.gmcp, &scriptHooks.event,
+	} {
+		kept := (*hooks)[:0]
+		for _, h := range *hooks {
+			if h.script != script {
+				kept = append(kept, h)
+			}
+		}
+		*hooks = kept
+	}
+	countHooks()
+}
+
+func countHooks() {
+	atomic.StoreInt32(&hookCount.line, int32(len(scriptHooks.line)))
+	atomic.StoreInt32(&hookCount.prompt, int32(len(scriptHooks.prompt)))
+	atomic.StoreInt32(&hookCount.gmcp, int32(len(scriptHooks.gmcp)))
+	atomic.StoreInt32(&hookCount.event, int32(len(scriptHooks.event)))
+}
+
+// loadScript run lua file fname, callbacks registered by its former run
+// are removed first, so reloading it doesn't register them twice
+func loadScript(fname string) {
+	if abs, err := filepath.Abs(fname); err == nil {
+		fname = abs
+	}
+	luaEngine.Post(func(L *glua.LState) error {
+		dropHooks(fname)
+		scriptLoading = fname
+		defer func() {
+			scriptLoading = ""
+		}()
+		return L.DoFile(fname)
+	})
+}
+
+// scriptTimerID is used to generate names of timers added by scripts, it's
+// only accessed in goroutine of luaEngine
+var scriptTimerID int
+
+// startScripts start lua engine with host module and run startup scripts,
+// init.lua in profile directory runs first, then fname if it's not empty
+func startScripts(profile, fname string) {
+	luaEngine.OnError(func(err error) {
+		outCh <- []byte(fmt.Sprintf("lua: %s\n", err.Error()))
+	})
+	luaEngine.Post(func(L *glua.LState) error {
+		L.PreloadModule("xtelnet", luaLoader)
+		luaLoader(L)
+		L.SetGlobal("xtelnet", L.Get(-1))
+		return nil
+	})
+
+	if len(profile) > 0 {
+		script := filepath.Join(profile, scriptFileName)
+		if _, err := os.Stat(script); err == nil {
+			loadScript(script)
+		}
+	}
+	if len(fname) > 0 {
+		loadScript(fname)
+	}
+	luaEngine.Start()
+}
+
+// runScriptHooks post line of connection c to callbacks registered by
+// on_line or on_prompt
+func runScriptHooks(c *Connection, line string, prompt bool) {
+	count := &hookCount.line
+	if prompt {
+		count = &hookCount.prompt
+	}
+	if atomic.LoadInt32(count) == 0 {
+		return
+	}
+
+	luaEngine.Post(func(L *glua.LState) error {
+		hooks := scriptHooks.line
+		if prompt {
+			hooks = scriptHooks.prompt
+		}
+
+		var first error
+		for _, h := range hooks {
+			err := L.CallByParam(glua.P{Fn: h.fn, NRet: 0, Protect: true},
+				glua.LString(line), glua.LString(c.name))
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// runGMCPHooks post GMCP message of connection c to callbacks registered by
+// on_gmcp
+func runGMCPHooks(c *Connection, msg *telnet.GMCPMessage) {
+	if atomic.LoadInt32(&hookCount.gmcp) == 0 {
+		return
+	}
+
+	luaEngine.Post(func(L *glua.LState) error {
+		name := strings.ToLower(msg.Package)
+
+		var first error
+		for _, h := range scriptHooks.gmcp {
+			if len(h.prefix) > 0 && name != h.prefix && !strings.HasPrefix(name, h.prefix+".") {
+				continue
+			}
+			err := L.CallByParam(glua.P{Fn: h.fn, NRet: 0, Protect: true},
+				glua.LString(msg.Package), lua.ToLValue(L, msg.Data), glua.LString(c.name))
+			if err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+func luaLoader(L *glua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]glua.LGFunction{
+		"send":      luaSend,
+		"echo":      luaEcho,
+		"on_line":   luaOnLine,
+		"on_prompt": luaOnPrompt,
+		"on_gmcp":   luaOnGMCP,
+		"on_event":  luaOnEvent,
+		"timer":     luaTimer,
+		"alias":     luaAlias,
+		"trigger":   luaTrigger,
+		"var":       luaVar,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// xtelnet.send(text [, conn]) expand aliases in text and send it to the
+// current connection or conn, it return false if it's not connected
+func luaSend(L *glua.LState) int {
+	text := L.CheckString(1)
+	conn := conns.Current()
+	if name := L.OptString(2, ""); len(name) > 0 {
+		var ok bool
+		if conn, ok = conns.Get(name); !ok {
+			L.ArgError(2, "connection not found: "+name)
+		}
+	}
+
+	msg, err := execInput(text, conn)
+	if len(msg) > 0 {
+		outCh <- []byte(msg + "\n")
+	}
+	if err != nil && err != errNoConnection {
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(glua.LBool(err == nil))
+	return 1
+}
+
+// xtelnet.echo(...) output arguments separated by space
+func luaEcho(L *glua.LState) int {
+	args := make([]string, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		args = append(args, L.ToStringMeta(L.Get(i)).String())
+	}
+	outCh <- []byte(strings.Join(args, " ") + "\n")
+	return 0
+}
+
+// xtelnet.on_line(fn) call fn with every line from server and name of the
+// connection
+func luaOnLine(L *glua.LState) int {
+	addHook(&scriptHooks.line, "", L.CheckFunction(1))
+	return 0
+}
+
+// xtelnet.on_prompt(fn) call fn with every prompt from server and name of
+// the connection
+func luaOnPrompt(L *glua.LState) int {
+	addHook(&scriptHooks.prompt, "", L.CheckFunction(1))
+	return 0
+}
+
+// xtelnet.on_gmcp(package, fn) call fn with package name, decoded data and
+// connection name of GMCP messages under package
+func luaOnGMCP(L *glua.LState) int {
+	addHook(&scriptHooks.gmcp, strings.ToLower(L.CheckString(1)), L.CheckFunction(2))
+	return 0
+}
+
+// xtelnet.on_event(fn) call fn with event name, connection name and detail
+// of connection lifecycle events
+func luaOnEvent(L *glua.LState) int {
+	addHook(&scriptHooks.event, "", L.CheckFunction(1))
+	return 0
+}
+
+// xtelnet.timer(seconds, fn [, repeat [, name]]) call fn after seconds, it
+// return a function which deletes the timer. Timer with the same name is
+// replaced, name is generated if it's not given.
+func luaTimer(L *glua.LState) int {
+	seconds := float64(L.CheckNumber(1))
+	fn := L.CheckFunction(2)
+	t := &NamedTimer{
+		Name:     L.OptString(4, ""),
+		Interval: time.Duration(seconds * float64(time.Second)),
+		Type:     Timer,
+		Script:   true,
+		handler: func() {
+			luaEngine.Call(fn)
+		},
+	}
+	if L.OptBool(3, false) {
+		t.Type = Ticker
+	}
+	if len(t.Name) == 0 {
+		scriptTimerID++
+		t.Name = fmt.Sprintf("lua-%d", scriptTimerID)
+	}
+	t.Commands = fmt.Sprintf("<lua %s>", fn)
+
+	if err := timers.Add(t); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	name := t.Name
+	L.Push(L.NewFunction(func(L *glua.LState) int {
+		timers.Del(name)
+		return 0
+	}))
+	return 1
+}
+
+// xtelnet.alias(name, body [, regex]) add an alias
+func luaAlias(L *glua.LState) int {
+	a := &Alias{
+		Name:   L.CheckString(1),
+		Body:   L.CheckString(2),
+		Regex:  L.OptBool(3, false),
+		Script: true,
+	}
+	if err := aliases.Add(a); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	return 0
+}
+
+// xtelnet.trigger(name, pattern, body [, options]) add a trigger, options
+// is a table of fields: conn, glob, prompt, action, group and priority
+func luaTrigger(L *glua.LState) int {
+	t := &Trigger{
+		Name:    L.CheckString(1),
+		Pattern: L.CheckString(2),
+		Body:    L.CheckString(3),
+		Type:    TriggerRegex,
+		Action:  ActionSend,
+		Script:  true,
+	}
+	set := triggers
+	if opts := L.OptTable(4, nil); opts != nil {
+		if v := opts.RawGetString("conn"); v != glua.LNil {
+			conn, err := conns.GetOrCreate(v.String())
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			set = conn.triggers
+		}
+		if glua.LVAsBool(opts.RawGetString("glob")) {
+			t.Type = TriggerGlob
+		}
+		t.Prompt = glua.LVAsBool(opts.RawGetString("prompt"))
+		if v := opts.RawGetString("action"); v != glua.LNil {
+			a, ok := parseTriggerAction(v.String())
+			if !ok {
+				L.RaiseError("unknown action: %s", v.String())
+			}
+			t.Action = a
+		}
+		if v := opts.RawGetString("group"); v != glua.LNil {
+			t.Group = v.String()
+		}
+		if v, ok := opts.RawGetString("priority").(glua.LNumber); ok {
+			t.Priority = int(v)
+		}
+	}
+
+	if err := set.Add(t); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	return 0
+}
+
+// xtelnet.var(name [, value]) return value of variable name, or set it if
+// value is given
+func luaVar(L *glua.LState) int {
+	name := L.CheckString(1)
+	if L.GetTop() >= 2 {
+		vars.Set(name, lua.FromLValue(L.Get(2)))
+		return 0
+	}
+	L.Push(lua.ToLValue(L, vars.Get(name)))
+	return 1
+}
+
+var luaSubCommands = CommandMap{
+	"run": &Command{
+		name:       "run",
+		handler:    handleCmdLuaRun,
+		subCommand: nil,
+		desc:       "run lua code",
+		help:       "\tUsage: /lua run <code>",
+	},
+	"load": &Command{
+		name:       "load",
+		handler:    handleCmdLuaLoad,
+		subCommand: nil,
+		desc:       "load a lua script file",
+		help:       "\tUsage: /lua load <file>",
+	},
+}
+
+func handleCmdLuaRun(c *Command, p *bufio.Reader) (string, []byte, error) {
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		return "", nil, err
+	}
+	code := strings.TrimSpace(string(b))
+	if len(code) == 0 {
+		return c.help, nil, errors.New("need param: <code>")
+	}
+
+	luaEngine.DoString(code, nil, nil)
+	return "", nil, nil
+}
+
+func handleCmdLuaLoad(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) == 0 {
+		return c.help, nil, errors.New("need param: <file>")
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		return "", nil, err
+	}
+
+	loadScript(args[0])
+	return fmt.Sprintf("loading %s ...", args[0]), nil, nil
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	scrollbackDir = "scrollback"
+
+	defaultScrollbackLines = 100000
+	defaultScrollbackSize  = 64 << 20
+)
+
+// scrollback keeps output of session for attached clients
+var scrollback = NewLineBuffer(defaultScrollbackLines, defaultScrollbackSize)
+
+// scrollbackEntry is the persisted scrollback setting of session
+type scrollbackEntry struct {
+	Lines int    `json:"lines,omitempty"`
+	Size  string `json:"size,omitempty"`
+	Spill bool   `json:"spill,omitempty"`
+}
+
+// parse return max lines and memory of e, zero values are defaults
+func (e *scrollbackEntry) parse() (int, int64, error) {
+	lines, size := defaultScrollbackLines, int64(defaultScrollbackSize)
+	if e.Lines < 0 {
+		return 0, 0, fmt.Errorf("invalid lines: %d", e.Lines)
+	}
+	if e.Lines > 0 {
+		lines = e.Lines
+	}
+	if len(e.Size) > 0 {
+		var err error
+		if size, err = parseSize(e.Size); err != nil {
+			return 0, 0, err
+		}
+	}
+	return lines, size, nil
+}
+
+// ScrollbackSpillDir return directory of spilled scrollback of session name
+// in this process
+func ScrollbackSpillDir(name string) (string, error) {
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHome, cacheDir, scrollbackDir, fmt.Sprintf("%d.%s", os.Getpid(), name)), nil
+}
+
+// applyScrollback set limits and spilling of scrollback by e
+func applyScrollback(e *scrollbackEntry) error {
+	lines, size, err := e.parse()
+	if err != nil {
+		return err
+	}
+	if err := scrollback.SetSpill(e.Spill); err != nil {
+		return err
+	}
+	scrollback.SetLimits(lines, size)
+	return nil
+}
+
+func handleCmdSetScrollback(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) > 0 {
+		return c.help, nil, errors.New("too many params")
+	}
+	if len(opts) == 0 {
+		return "scrollback: " + scrollback.Status(), nil, nil
+	}
+
+	conns.mu.Lock()
+	e := scrollbackEntry{}
+	if conns.scrollback != nil {
+		e = *conns.scrollback
+	}
+	conns.mu.Unlock()
+	for name, value := range opts {
+		switch name {
+		case "lines":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return c.help, nil, fmt.Errorf("invalid lines: %s", value)
+			}
+			e.Lines = n
+		case "size":
+			if _, err := parseSize(value); err != nil {
+				return c.help, nil, err
+			}
+			e.Size = value
+		case "spill":
+			if e.Spill, err = parseSwitch(name, value); err != nil {
+				return c.help, nil, err
+			}
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+
+	if err := applyScrollback(&e); err != nil {
+		return "", nil, err
+	}
+	conns.mu.Lock()
+	conns.scrollback = &e
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return "scrollback: " + scrollback.Status(), nil, nil
+}
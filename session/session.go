@@ -2,22 +2,30 @@ package session
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 
-	"github.com/defsky/xtelnet/telnet"
+	"github.com/defsky/xtelnet/proto"
 )
 
 const socketRunDir string = "run"
+const profileDir string = "profiles"
 
 var outCh = make(chan []byte, 100)
-var closeCh = make(chan struct{})
 
-var nvtConfig = &telnet.SessionOption{
-	NVTOptionCfg: telnet.NewNVTOptionConfig(),
+// connOutput is output of connection conn
+type connOutput struct {
+	conn string
+	data []byte
 }
-var nvt *telnet.NVT
+
+var connOutCh = make(chan connOutput, 100)
+
+// eventCh carries lifecycle events of connections to attached client
+var eventCh = make(chan *proto.Packet, 10)
+var closeCh = make(chan struct{})
 
 type Session struct {
 	name  string
@@ -25,9 +33,51 @@ type Session struct {
 	ln    net.Listener
 	fd    *os.File
 	fname string
+	// apiFile is control socket of session
+	apiFile string
 }
 
 func NewSession(name, fname string) *Session {
+	dir, err := ProfileHomeDir(name)
+	if err == nil {
+		conns.SetProfile(dir)
+		if err := conns.loadSettings(filepath.Join(dir, sessionFileName)); err != nil {
+			outCh <- []byte(err.Error() + "\n")
+		}
+		if err := triggers.Load(filepath.Join(dir, triggerFileName)); err != nil {
+			outCh <- []byte(err.Error() + "\n")
+		}
+		if err := aliases.Load(filepath.Join(dir, aliasFileName)); err != nil {
+			outCh <- []byte(err.Error() + "\n")
+		}
+		if err := timers.Load(filepath.Join(dir, timerFileName)); err != nil {
+			outCh <- []byte(err.Error() + "\n")
+		}
+	}
+	if logs, err := LogHomeDir(name); err == nil {
+		sessionLog.SetDir(logs)
+		conns.mu.Lock()
+		auto := conns.autoLog
+		conns.mu.Unlock()
+		if auto != nil {
+			if err := sessionLog.Start(auto.File, auto.options()); err != nil {
+				outCh <- []byte(err.Error() + "\n")
+			}
+		}
+	}
+	if spill, err := ScrollbackSpillDir(name); err == nil {
+		scrollback.SetSpillDir(spill)
+		conns.mu.Lock()
+		e := conns.scrollback
+		conns.mu.Unlock()
+		if e != nil {
+			if err := applyScrollback(e); err != nil {
+				outCh <- []byte(err.Error() + "\n")
+			}
+		}
+	}
+	startScripts(dir, fname)
+
 	return &Session{
 		name: name,
 		term: NewTerminal(),
@@ -36,6 +86,29 @@ func NewSession(name, fname string) *Session {
 func (s *Session) Start() {
 	s.term.Start()
 
+	dir, _ := ProfileHomeDir(s.name)
+	remote.setSession(s.name, dir, s.term)
+	webUI.setSession(dir, s.term)
+	conns.mu.Lock()
+	e, w := conns.remote, conns.web
+	conns.mu.Unlock()
+	if e != nil {
+		if err := remote.Listen(e.Addr, e.Cert, e.Key); err != nil {
+			outCh <- []byte("remote: " + err.Error() + "\n")
+		}
+	}
+	if w != nil {
+		if err := webUI.Listen(w); err != nil {
+			outCh <- []byte("web: " + err.Error() + "\n")
+		}
+	}
+	if ln, fname, err := listenAPI(s.name); err != nil {
+		outCh <- []byte("api: " + err.Error() + "\n")
+	} else {
+		s.apiFile = fname
+		go apiServer.Serve(ln)
+	}
+
 	fname, err := socketFileName(s.name)
 	if err != nil {
 		return
@@ -61,7 +134,14 @@ func (s *Session) Start() {
 	go s.listenUnixSocket()
 
 	<-closeCh
+	timers.Stop()
+	luaEngine.Stop()
+	remote.Stop()
+	webUI.Stop()
+	apiServer.Close()
 	s.term.Stop()
+	sessionLog.Stop()
+	scrollback.Close()
 	if s.ln != nil {
 		s.ln.Close()
 	}
@@ -71,6 +151,9 @@ func (s *Session) Start() {
 	if s.fname != "" {
 		os.Remove(s.fname)
 	}
+	if s.apiFile != "" {
+		os.Remove(s.apiFile)
+	}
 }
 
 func (s *Session) listenUnixSocket() {
@@ -107,6 +190,15 @@ func mkdirIfNotExist(path string, mode os.FileMode) error {
 	return err
 }
 
+// writePrivateFile write data to fname readable by the user only, mode of
+// existing file is changed too
+func writePrivateFile(fname string, data []byte) error {
+	if err := ioutil.WriteFile(fname, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(fname, 0600)
+}
+
 func socketFileName(name string) (string, error) {
 	homedir, err := SocketHomeDir()
 	if err != nil {
@@ -147,6 +239,20 @@ func SocketHomeDir() (string, error) {
 	return baseDir, nil
 }
 
+// ProfileHomeDir return directory keeping settings of session name
+func ProfileHomeDir(name string) (string, error) {
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(userHome, cacheDir, profileDir, name)
+	err = mkdirIfNotExist(dir, os.ModeDir|os.FileMode(0775))
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
 func GetSessionList(dir string) ([]string, error) {
 	files, err := filepath.Glob(filepath.Join(dir, "*"))
 	if err != nil {
@@ -2,13 +2,11 @@ package session
 
 import (
 	"bufio"
+	"fmt"
 	"strings"
-
-	"github.com/defsky/xtelnet/telnet"
 )
 
 type Shell struct {
-	nvt *telnet.NVT
 }
 
 func NewShell() *Shell {
@@ -18,10 +16,65 @@ func NewShell() *Shell {
 
 func (s *Shell) Exec(cmd string) (string, []byte, error) {
 	if len(cmd) <= 0 || cmd[0] != '/' {
-		return "", []byte(cmd + "\r\n"), nil
+		msg, err := execInput(cmd, conns.Current())
+		return msg, nil, err
 	}
+	return execCommand(cmd)
+}
+
+// execCommand run cmd which is started with '/'
+func execCommand(cmd string) (string, []byte, error) {
 	rd := bufio.NewReader(strings.NewReader(cmd[1:]))
 	rd.Peek(1)
 
 	return rootCMD.Exec(rd)
 }
+
+// execInput expand aliases in input and send commands to conn. Command
+// prefixed by "#name " is sent to connection name, commands started with
+// '/' are executed.
+func execInput(input string, conn *Connection) (string, error) {
+	cmds, err := aliases.Expand(input)
+	if err != nil {
+		return "", err
+	}
+
+	msgs := []string{}
+	for _, cmd := range cmds {
+		var msg string
+		var err error
+		switch {
+		case strings.HasPrefix(cmd, "#"):
+			msg, err = execRouted(cmd[1:])
+		case strings.HasPrefix(cmd, "/"):
+			var data []byte
+			msg, data, err = execCommand(cmd)
+			if err == nil && len(data) > 0 {
+				err = conn.Send(data)
+			}
+		default:
+			err = conn.Send([]byte(cmd + "\r\n"))
+		}
+
+		if len(msg) > 0 {
+			msgs = append(msgs, msg)
+		}
+		if err != nil {
+			return strings.Join(msgs, "\n"), err
+		}
+	}
+	return strings.Join(msgs, "\n"), nil
+}
+
+// execRouted run input like "name command" with connection name
+func execRouted(input string) (string, error) {
+	name, cmd := input, ""
+	if n := strings.IndexAny(input, " \t"); n >= 0 {
+		name, cmd = input[:n], strings.TrimLeft(input[n+1:], " \t")
+	}
+	conn, ok := conns.Get(name)
+	if !ok {
+		return "", fmt.Errorf("connection not found: %s", name)
+	}
+	return execInput(cmd, conn)
+}
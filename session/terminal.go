@@ -1,50 +1,45 @@
 package session
 
 import (
-	"bufio"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/defsky/xtelnet/proto"
+	"github.com/defsky/xtelnet/telnet"
 )
 
-type TaskType int
-
 const historyCmdLength = 1000
 
-const (
-	Timer TaskType = iota
-	Ticker
-)
+// historyMaxBytes limits size of data in a SM_HISTORY packet
+const historyMaxBytes = 16 * 1024
 
-type TaskHandler func()
-type ScheduleTask struct {
-	ttype   TaskType
-	handler TaskHandler
-}
-type TickTaskMap map[time.Duration][]ScheduleTask
+// firstScreenLines is the number of lines sent to client on attaching
+const firstScreenLines = 25
 
 // Terminal is the interface wraps basic methods for terminal
 type Terminal struct {
-	wg         sync.WaitGroup
-	history    *HistoryCmd
-	shell      *Shell
-	conn       net.Conn
-	buffer     *OutBuffer
-	netWriter  *bufio.Writer
-	close      chan struct{}
-	closeTimer chan struct{}
+	history *HistoryCmd
+	shell   *Shell
+	buffer  *LineBuffer
+	close   chan struct{}
+
+	// output is sent to all attached clients, lastEvent is sent to client
+	// on attaching
+	mu        sync.Mutex
+	clients   map[*client]struct{}
+	lastEvent *proto.Packet
 }
 
 func NewTerminal() *Terminal {
 	return &Terminal{
-		history:    NewHistoryCmd(historyCmdLength),
-		shell:      NewShell(),
-		buffer:     NewBuffer(500),
-		close:      make(chan struct{}),
-		closeTimer: make(chan struct{}),
+		history: NewHistoryCmd(historyCmdLength),
+		shell:   NewShell(),
+		buffer:  scrollback,
+		close:   make(chan struct{}),
+		clients: make(map[*client]struct{}),
 	}
 }
 
@@ -57,12 +52,12 @@ func (t *Terminal) Start() {
 }
 
 func (t *Terminal) Stop() {
-	if nvt != nil {
-		nvt.Close()
-	}
-	if t.conn != nil {
-		t.conn.Close()
+	conns.CloseAll()
+	t.mu.Lock()
+	for c := range t.clients {
+		c.conn.Close()
 	}
+	t.mu.Unlock()
 	close(t.close)
 }
 
@@ -76,66 +71,143 @@ DONE:
 			if !ok {
 				break DONE
 			}
+			t.output("", msg)
+		case o := <-connOutCh:
+			t.output(o.conn, o.data)
+		case p := <-eventCh:
+			t.mu.Lock()
+			t.lastEvent = p
+			t.broadcast(p, proto.FeatureConnEvent)
+			t.mu.Unlock()
+		}
+	}
+}
 
-			t.buffer.Put(msg)
+// output keep msg from connection conn in buffer and log, and send it to
+// attached clients. conn is empty for messages of session.
+func (t *Terminal) output(conn string, msg []byte) {
+	sessionLog.Output(msg)
 
-			if t.conn != nil {
-				p := &proto.Packet{}
-				p.Write(msg)
+	p := &proto.Packet{}
+	p.Write(msg)
 
-				proto.WritePacket(t.conn, p)
-			}
-		}
-	}
+	// client attaching gets msg either in first screen or from here
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buffer.Put(conn, msg)
+	t.broadcast(p, "")
 }
 
-func (t *Terminal) GetBufferdLines(count int) [][]byte {
-	if count <= 0 {
-		return nil
+// broadcast send p to attached clients supporting feature, or all of them
+// if feature is empty. Clients whose queue is full are detached. It must be
+// called with mu locked.
+func (t *Terminal) broadcast(p *proto.Packet, feature string) {
+	for c := range t.clients {
+		if len(feature) > 0 && !c.peer.Has(feature) {
+			continue
+		}
+		if !c.send(p) {
+			t.detach(c)
+		}
 	}
+}
 
-	return t.buffer.Get(count)
+// detach close client c, it must be called with mu locked
+func (t *Terminal) detach(c *client) {
+	delete(t.clients, c)
+	c.close()
+	c.conn.Close()
 }
-func (t *Terminal) SetConn(c *net.UnixConn) {
-	t.conn = c
+
+// writeLines write raw text of lines into p, the last one may be not ended
+// by newline yet
+func (t *Terminal) writeLines(p *proto.Packet, lines []Line) {
+	for _, l := range lines {
+		p.Write(l.Raw)
+		if !l.Partial {
+			p.WriteByte('\n')
+		}
+	}
 }
-func (t *Terminal) sendFirstScreenData(conn net.Conn) error {
+
+// firstScreen return packet of the latest lines
+func (t *Terminal) firstScreen() *proto.Packet {
 	p := &proto.Packet{}
 
-	lines := t.GetBufferdLines(25)
-	if lines != nil && len(lines) > 0 {
-		for _, l := range lines {
-			if len(l) > 0 {
-				_, err := p.Write(l)
-				if err != nil {
-					p.WriteString(err.Error())
-					break
-				}
-			}
-		}
+	_, lines := t.buffer.Before(0, firstScreenLines, historyMaxBytes)
+	if len(lines) > 0 {
+		t.writeLines(p, lines)
 	} else {
 		_, err := p.WriteString("No buffered message\n")
 		if err != nil {
 			p.WriteString(err.Error())
 		}
 	}
-
-	return proto.WritePacket(conn, p)
+	return p
 }
 
 func (t *Terminal) sendDetachStatus(c net.Conn) error {
 	p := &proto.Packet{}
 	p.Opcode = proto.SM_DETACH_STATUS
 
+	t.mu.Lock()
+	modes := []byte{}
+	for c := range t.clients {
+		if c.readonly {
+			modes = append(modes, 1)
+		} else {
+			modes = append(modes, 0)
+		}
+	}
+	t.mu.Unlock()
+
 	status := uint8(1)
-	if t.conn != nil {
+	if len(modes) > 0 {
 		status = uint8(0)
 	}
 	p.WriteByte(byte(status))
+	binary.Write(p, binary.BigEndian, uint16(len(modes)))
+	p.Write(modes)
 	return proto.WritePacket(c, p)
 }
 
+// handleLegacy answer client of the first protocol, which sends no hello.
+// It's only told status of session, or that it's too old to attach.
+func (t *Terminal) handleLegacy(conn net.Conn, p *proto.Packet) {
+	defer conn.Close()
+
+	switch p.Opcode {
+	case proto.CM_QUERY_DETACH_STATUS:
+		t.sendDetachStatus(conn)
+	case proto.CM_ATTACH_REQ:
+		retp := &proto.Packet{}
+		retp.Opcode = proto.SM_ATTACH_ACK
+		retp.WriteByte(byte(0))
+		retp.WriteString(fmt.Sprintf("client is too old, protocol version %d is required", proto.Version))
+		proto.WritePacket(conn, retp)
+	}
+}
+
 func (t *Terminal) HandleIncoming(conn net.Conn) {
+	p, err := proto.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if p.Opcode != proto.CM_HELLO {
+		t.handleLegacy(conn, p)
+		return
+	}
+	peer, err := proto.ServerHandshake(conn, p)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	t.serve(conn, peer)
+}
+
+// serve handle requests of client conn after handshake
+func (t *Terminal) serve(conn net.Conn, peer *proto.Hello) {
 	for {
 		p, err := proto.ReadPacket(conn)
 		if err != nil {
@@ -148,50 +220,53 @@ func (t *Terminal) HandleIncoming(conn net.Conn) {
 			t.sendDetachStatus(conn)
 
 		case proto.CM_SCREEN_SIZE:
+			t.handleScreenSize(p)
 
 		case proto.CM_ATTACH_REQ:
 			b, _ := p.ReadByte()
-			detach := false
-			if uint8(b) == 1 {
-				detach = true
+			readonly := b&attachReadonly != 0
+			if b&attachDetachOthers != 0 && !readonly {
+				t.mu.Lock()
+				for c := range t.clients {
+					t.detach(c)
+				}
+				t.mu.Unlock()
 			}
+
 			retp := &proto.Packet{}
 			retp.Opcode = proto.SM_ATTACH_ACK
-
-			if t.conn != nil {
-				if detach {
-					t.conn.Close()
-				} else {
-					retp.WriteByte(byte(0))
-					retp.WriteString("already attached")
-					proto.WritePacket(conn, retp)
-					return
-				}
-			}
 			retp.WriteByte(byte(1))
-
-			proto.WritePacket(conn, retp)
-			t.handleAttaching(conn)
+			if err := proto.WritePacket(conn, retp); err != nil {
+				conn.Close()
+				return
+			}
+			t.handleAttaching(conn, peer, readonly)
+			return
 		}
 	}
 }
 
-func (t *Terminal) handleAttaching(conn net.Conn) {
-	defer conn.Close()
-
-	err := t.sendFirstScreenData(conn)
-	if err != nil {
-		return
+func (t *Terminal) handleAttaching(conn net.Conn, peer *proto.Hello, readonly bool) {
+	c := newClient(conn, peer, readonly)
+	t.mu.Lock()
+	c.send(t.firstScreen())
+	if t.lastEvent != nil && peer.Has(proto.FeatureConnEvent) {
+		c.send(t.lastEvent)
 	}
-	t.conn = conn
+	t.clients[c] = struct{}{}
+	t.mu.Unlock()
+
 	defer func() {
-		t.conn = nil
+		t.mu.Lock()
+		if _, ok := t.clients[c]; ok {
+			delete(t.clients, c)
+			c.close()
+		}
+		t.mu.Unlock()
 	}()
 
-	// r := bufio.NewReader(conn)
 DONE:
 	for {
-		// b, err := r.ReadBytes('\n')
 		p, err := proto.ReadPacket(conn)
 		if err != nil {
 			break DONE
@@ -199,62 +274,112 @@ DONE:
 
 		switch p.Opcode {
 		case proto.CM_USER_INPUT:
+			if readonly {
+				t.reply(c, []byte("[red]read-only client, input refused[-]\n"))
+				continue
+			}
 			b := p.Bytes()
 			t.Input(b)
+		case proto.CM_SCREEN_SIZE:
+			if !readonly {
+				t.handleScreenSize(p)
+			}
+		case proto.CM_CLIENT_COLORS:
+			if !readonly {
+				t.handleClientColors(p)
+			}
+		case proto.CM_HISTORY_REQ:
+			t.sendHistory(c, p)
 		}
 	}
 }
 
-func (t *Terminal) Input(cmd []byte) {
-	msg, data, err := t.shell.Exec(strings.TrimRight(string(cmd), "\r\n"))
-	if len(msg) > 0 {
-		outCh <- []byte(msg + "\n")
+// reply send msg to client c only
+func (t *Terminal) reply(c *client, msg []byte) {
+	p := &proto.Packet{}
+	p.Write(msg)
+	t.sendTo(c, p)
+}
+
+// sendTo send p to client c only
+func (t *Terminal) sendTo(c *client, p *proto.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !c.send(p) {
+		t.detach(c)
+	}
+}
+
+// sendHistory reply buffered output requested by CM_HISTORY_REQ
+func (t *Terminal) sendHistory(c *client, p *proto.Packet) {
+	if p.Len() < 10 {
+		return
 	}
+	data := p.Next(10)
+	before := binary.BigEndian.Uint64(data[0:8])
+	count := binary.BigEndian.Uint16(data[8:10])
+
+	first, lines := t.buffer.Before(before, int(count), historyMaxBytes)
+	retp := &proto.Packet{}
+	retp.Opcode = proto.SM_HISTORY
+	binary.Write(retp, binary.BigEndian, first)
+	t.writeLines(retp, lines)
+	t.sendTo(c, retp)
+}
+
+// handleClientColors save colors supported by attached client, they are
+// reported by MTTS in later TTYPE cycles
+func (t *Terminal) handleClientColors(p *proto.Packet) {
+	b, err := p.ReadByte()
 	if err != nil {
-		outCh <- []byte(err.Error() + "\n")
+		return
 	}
-	if len(data) > 0 {
-		if nvt == nil || false == nvt.Send(data) {
-			outCh <- []byte("no active conncetion\n")
-		}
+	var colors telnet.MTTSFlag
+	if b&1 != 0 {
+		colors |= telnet.MTTS_256COLORS
 	}
+	if b&2 != 0 {
+		colors |= telnet.MTTS_TRUECOLOR
+	}
+	clientColors.Set(colors)
 }
 
-// RunAfter wil call f only once when d duration elapsed
-func (s *Terminal) RunAfter(d time.Duration, f func()) {
-	timer := time.NewTimer(d)
-
-	s.wg.Add(1)
-	go func(f func()) {
-		defer s.wg.Done()
-		defer timer.Stop()
+// handleScreenSize save screen size of attached client and report it to
+// server if it was changed
+func (t *Terminal) handleScreenSize(p *proto.Packet) {
+	if p.Len() < 4 {
+		return
+	}
+	data := p.Next(4)
+	rows := binary.BigEndian.Uint16(data[0:2])
+	cols := binary.BigEndian.Uint16(data[2:4])
+	if rows == 0 || cols == 0 {
+		return
+	}
 
-		select {
-		case <-timer.C:
-			f()
-		case <-s.closeTimer:
-			// close timer
+	if windowSize.Set(cols, rows) {
+		for _, c := range conns.List() {
+			if nvt := c.NVT(); nvt != nil {
+				nvt.SendWindowSize()
+			}
 		}
-
-	}(f)
+	}
 }
 
-// RunEvery will call f periodly when every d duaration elapsed
-func (s *Terminal) RunEvery(d time.Duration, f func()) {
-	ticker := time.NewTicker(d)
-
-	s.wg.Add(1)
-	go func(f func()) {
-		defer s.wg.Done()
-		defer ticker.Stop()
-	DONE:
-		for {
-			select {
-			case <-ticker.C:
-				f()
-			case <-s.closeTimer:
-				break DONE
-			}
+func (t *Terminal) Input(cmd []byte) {
+	line := strings.TrimRight(string(cmd), "\r\n")
+	sessionLog.Input(line)
+	msg, data, err := t.shell.Exec(line)
+	if len(msg) > 0 {
+		outCh <- []byte(msg + "\n")
+	}
+	if err != nil {
+		outCh <- []byte(err.Error() + "\n")
+	}
+	if len(data) > 0 {
+		if err := conns.Current().Send(data); err != nil {
+			outCh <- []byte(err.Error() + "\n")
 		}
-	}(f)
+	}
 }
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/defsky/xtelnet/proto"
+)
+
+func TestTerminalHandshake(t *testing.T) {
+	term := NewTerminal()
+
+	// client of the first protocol is denied with a reason
+	client, server := net.Pipe()
+	go term.HandleIncoming(server)
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_ATTACH_REQ
+	p.WriteByte(0)
+	proto.WritePacket(client, p)
+	retp, err := proto.ReadPacket(client)
+	if err != nil || retp.Opcode != proto.SM_ATTACH_ACK {
+		t.Fatalf("got %v, %v", retp, err)
+	}
+	if b, _ := retp.ReadByte(); b != 0 || !strings.Contains(retp.String(), "too old") {
+		t.Fatalf("legacy client is not denied: %d %q", b, retp.String())
+	}
+	client.Close()
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go term.HandleIncoming(server)
+	h, err := proto.ClientHandshake(client)
+	if err != nil || !h.Has(proto.FeatureHistory) {
+		t.Fatalf("got %+v, %v", h, err)
+	}
+	p = &proto.Packet{}
+	p.Opcode = proto.CM_QUERY_DETACH_STATUS
+	proto.WritePacket(client, p)
+	if retp, err := proto.ReadPacket(client); err != nil || retp.Opcode != proto.SM_DETACH_STATUS {
+		t.Fatalf("got %v, %v after handshake", retp, err)
+	}
+}
+
+// attachTest attach client to term with flags of CM_ATTACH_REQ, first
+// screen is read already
+func attachTest(t *testing.T, term *Terminal, flags byte) net.Conn {
+	client, server := net.Pipe()
+	go term.HandleIncoming(server)
+	if _, err := proto.ClientHandshake(client); err != nil {
+		t.Fatal(err)
+	}
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_ATTACH_REQ
+	p.WriteByte(flags)
+	proto.WritePacket(client, p)
+	for _, op := range []uint16{proto.SM_ATTACH_ACK, 0} {
+		if p, err := proto.ReadPacket(client); err != nil || p.Opcode != op {
+			t.Fatalf("got %v, %v on attaching", p, err)
+		}
+	}
+	return client
+}
+
+// clientCount return number of clients attached to term
+func clientCount(term *Terminal) int {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+	return len(term.clients)
+}
+
+func TestTerminalClients(t *testing.T) {
+	term := NewTerminal()
+	term.buffer = NewLineBuffer(100, 1<<20)
+
+	rw := attachTest(t, term, 0)
+	defer rw.Close()
+	ro := attachTest(t, term, attachReadonly)
+	defer ro.Close()
+
+	term.output("", []byte("hello\n"))
+	for _, c := range []net.Conn{rw, ro} {
+		if p, err := proto.ReadPacket(c); err != nil || p.String() != "hello\n" {
+			t.Fatalf("got %v, %v", p, err)
+		}
+	}
+
+	// input of read-only client is refused
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_USER_INPUT
+	p.WriteString("look\n")
+	proto.WritePacket(ro, p)
+	if p, err := proto.ReadPacket(ro); err != nil || !strings.Contains(p.String(), "refused") {
+		t.Fatalf("got %v, %v for input of read-only client", p, err)
+	}
+
+	// status shows mode of every client
+	status, server := net.Pipe()
+	go term.sendDetachStatus(server)
+	p, err := proto.ReadPacket(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := p.Bytes(); len(data) != 5 || data[0] != 0 || data[2] != 2 || data[3]+data[4] != 1 {
+		t.Fatalf("got status %v", data)
+	}
+	status.Close()
+
+	// client never reading is detached, others are not blocked
+	slow := attachTest(t, term, 0)
+	defer slow.Close()
+	for i := 0; i < clientQueueSize+10; i++ {
+		term.output("", []byte("x"))
+		for _, c := range []net.Conn{rw, ro} {
+			if p, err := proto.ReadPacket(c); err != nil || p.String() != "x" {
+				t.Fatalf("got %v, %v", p, err)
+			}
+		}
+	}
+	if n := clientCount(term); n != 2 {
+		t.Fatalf("%d clients attached, want 2", n)
+	}
+
+	// spectator can't detach others
+	spectator := attachTest(t, term, attachReadonly|attachDetachOthers)
+	defer spectator.Close()
+	if n := clientCount(term); n != 3 {
+		t.Fatalf("%d clients attached, want 3", n)
+	}
+
+	// detaching others leaves only the new client
+	last := attachTest(t, term, attachDetachOthers)
+	defer last.Close()
+	if n := clientCount(term); n != 1 {
+		t.Fatalf("%d clients attached, want 1", n)
+	}
+}
@@ -0,0 +1,596 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const timerFileName = "timers.json"
+
+// minTimerInterval is the shortest interval of timers
+const minTimerInterval = 100 * time.Millisecond
+
+// keepaliveTimerName is prefix of timers created by /set keepalive, it's
+// followed by "@" and connection name
+const keepaliveTimerName = "keepalive"
+
+// defaultKeepaliveCommand is sent by keepalive if no command is given
+const defaultKeepaliveCommand = "look"
+
+// TaskType is type of timer
+type TaskType int
+
+const (
+	// Timer runs only once
+	Timer TaskType = iota
+	// Ticker runs periodly
+	Ticker
+)
+
+func (t TaskType) String() string {
+	if t == Timer {
+		return "once"
+	}
+	return "every"
+}
+
+// TaskHandler is called when a timer fires
+type TaskHandler func()
+
+// NamedTimer runs commands, or handler if it's set, when interval elapsed
+type NamedTimer struct {
+	Name     string
+	Interval time.Duration
+	Type     TaskType
+	Commands string
+	Paused   bool
+	// Conn is name of connection commands are sent to, it's the current
+	// connection if Conn is empty
+	Conn string
+	// Script is set for timers added by scripts, they are not saved
+	Script bool
+
+	// profile is set for timers kept in connection profile, they are not
+	// saved with timers
+	profile bool
+	handler TaskHandler
+	next    time.Time
+	stop    chan struct{}
+}
+
+func (t *NamedTimer) String() string {
+	if len(t.Conn) > 0 {
+		return fmt.Sprintf("%s %s %q on #%s", t.Type, t.Interval, t.Commands, t.Conn)
+	}
+	return fmt.Sprintf("%s %s %q", t.Type, t.Interval, t.Commands)
+}
+
+// timerEntry is the persisted form of NamedTimer
+type timerEntry struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Once     bool   `json:"once,omitempty"`
+	Commands string `json:"commands"`
+	Conn     string `json:"conn,omitempty"`
+	Paused   bool   `json:"paused,omitempty"`
+}
+
+// TimerManager keeps named timers of session, timers don't depend on
+// connection so they survive reconnects
+type TimerManager struct {
+	mu     sync.Mutex
+	timers map[string]*NamedTimer
+	fname  string
+	closed bool
+	// runner runs commands of timers without handler
+	runner func(*NamedTimer)
+}
+
+func NewTimerManager() *TimerManager {
+	return &TimerManager{
+		timers: make(map[string]*NamedTimer),
+	}
+}
+
+// Add start t, timer with the same name is replaced
+func (m *TimerManager) Add(t *NamedTimer) error {
+	if len(t.Name) == 0 {
+		return errors.New("timer name is empty")
+	}
+	if t.Interval < minTimerInterval {
+		return fmt.Errorf("interval must be at least %s", minTimerInterval)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errors.New("timers are stopped")
+	}
+	m.remove(t.Name)
+	m.timers[t.Name] = t
+	if !t.Paused {
+		m.start(t)
+	}
+	return nil
+}
+
+// Del stop and remove timer name, it return false if timer is not found
+func (m *TimerManager) Del(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.remove(name)
+}
+
+func (m *TimerManager) remove(name string) bool {
+	t, ok := m.timers[name]
+	if !ok {
+		return false
+	}
+	m.halt(t)
+	delete(m.timers, name)
+	return true
+}
+
+// Pause stop timer name until it's resumed
+func (m *TimerManager) Pause(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.timers[name]
+	if !ok {
+		return fmt.Errorf("timer not found: %s", name)
+	}
+	m.halt(t)
+	t.Paused = true
+	return nil
+}
+
+// Resume restart paused timer name, interval is counted from now
+func (m *TimerManager) Resume(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.timers[name]
+	if !ok {
+		return fmt.Errorf("timer not found: %s", name)
+	}
+	if t.stop == nil {
+		t.Paused = false
+		m.start(t)
+	}
+	return nil
+}
+
+// List return timers sorted by name
+func (m *TimerManager) List() []*NamedTimer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*NamedTimer, 0, len(m.timers))
+	for _, t := range m.timers {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Remaining return duration until timer t fires next time, 0 is returned
+// if t is paused
+func (m *TimerManager) Remaining(t *NamedTimer) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.stop == nil {
+		return 0
+	}
+	return time.Until(t.next)
+}
+
+// Stop stop all timers, timers can not be added after it
+func (m *TimerManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.timers {
+		m.halt(t)
+	}
+	m.closed = true
+}
+
+func (m *TimerManager) start(t *NamedTimer) {
+	stop := make(chan struct{})
+	t.stop = stop
+	t.next = time.Now().Add(t.Interval)
+
+	go func() {
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !m.fire(t, stop) {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// fire run t if it's not stopped, it return false if t should not run again
+func (m *TimerManager) fire(t *NamedTimer, stop chan struct{}) bool {
+	m.mu.Lock()
+	if t.stop != stop {
+		m.mu.Unlock()
+		return false
+	}
+	once := t.Type == Timer
+	if once {
+		m.halt(t)
+		delete(m.timers, t.Name)
+	} else {
+		t.next = time.Now().Add(t.Interval)
+	}
+	m.mu.Unlock()
+
+	if t.handler != nil {
+		t.handler()
+	} else if m.runner != nil {
+		m.runner(t)
+	}
+	if once && !t.Script {
+		m.Save()
+	}
+	return !once
+}
+
+func (m *TimerManager) halt(t *NamedTimer) {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+// Load read timers from file fname and start them, later changes are saved
+// into it. A not existing file is taken as empty.
+func (m *TimerManager) Load(fname string) error {
+	m.mu.Lock()
+	m.fname = fname
+	m.mu.Unlock()
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	entries := []*timerEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("%s: %s", fname, err.Error())
+	}
+	for _, e := range entries {
+		d, err := parseInterval(e.Interval)
+		if err != nil {
+			return fmt.Errorf("%s: timer %s: %s", fname, e.Name, err.Error())
+		}
+		t := &NamedTimer{
+			Name:     e.Name,
+			Interval: d,
+			Type:     Ticker,
+			Commands: e.Commands,
+			Conn:     e.Conn,
+			Paused:   e.Paused,
+		}
+		if e.Once {
+			t.Type = Timer
+		}
+		if err := m.Add(t); err != nil {
+			return fmt.Errorf("%s: timer %s: %s", fname, e.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Save write timers into the file loaded from
+func (m *TimerManager) Save() error {
+	list := m.List()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.fname) == 0 {
+		return nil
+	}
+
+	entries := make([]*timerEntry, 0, len(list))
+	for _, t := range list {
+		if t.Script || t.profile {
+			continue
+		}
+		entries = append(entries, &timerEntry{
+			Name:     t.Name,
+			Interval: t.Interval.String(),
+			Once:     t.Type == Timer,
+			Commands: t.Commands,
+			Conn:     t.Conn,
+			Paused:   t.Paused,
+		})
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.fname, b, 0644)
+}
+
+// parseInterval parse s as time.Duration, number without unit is taken as
+// seconds
+func parseInterval(s string) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// runTimerCommands run commands of t like user input of its connection,
+// it's quiet if the connection is not active
+func runTimerCommands(t *NamedTimer) {
+	conn := conns.Current()
+	if len(t.Conn) > 0 {
+		var ok bool
+		if conn, ok = conns.Get(t.Conn); !ok {
+			return
+		}
+	}
+
+	msg, err := execInput(t.Commands, conn)
+	if len(msg) > 0 {
+		outCh <- []byte(msg + "\n")
+	}
+	if err != nil && err != errNoConnection {
+		outCh <- []byte(fmt.Sprintf("timer %s: %s\n", t.Name, err.Error()))
+	}
+}
+
+var timers = NewTimerManager()
+
+func init() {
+	timers.runner = runTimerCommands
+}
+
+var timerSubCommands = CommandMap{
+	"add": &Command{
+		name:       "add",
+		handler:    handleCmdTimerAdd,
+		subCommand: nil,
+		desc:       "add or replace a timer",
+		help:       "\tUsage: /timer add [--conn <conn>] <name> <interval> [once] <commands>",
+	},
+	"del": &Command{
+		name:       "del",
+		handler:    handleCmdTimerDel,
+		subCommand: nil,
+		desc:       "delete a timer",
+		help:       "\tUsage: /timer del <name>",
+	},
+	"list": &Command{
+		name:       "list",
+		handler:    handleCmdTimerList,
+		subCommand: nil,
+		desc:       "list timers",
+		help:       "\tUsage: /timer list",
+	},
+	"pause": &Command{
+		name:       "pause",
+		handler:    handleCmdTimerPause,
+		subCommand: nil,
+		desc:       "pause a timer",
+		help:       "\tUsage: /timer pause <name>",
+	},
+	"resume": &Command{
+		name:       "resume",
+		handler:    handleCmdTimerPause,
+		subCommand: nil,
+		desc:       "resume a paused timer",
+		help:       "\tUsage: /timer resume <name>",
+	},
+}
+
+func handleCmdTimerAdd(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	for name := range opts {
+		if name != "conn" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	// timer keeps sending to the same connection after /switch
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) < 3 {
+		return c.help, nil, errors.New("need params: <name> <interval> <commands>")
+	}
+
+	d, err := parseInterval(args[1])
+	if err != nil {
+		return c.help, nil, err
+	}
+	t := &NamedTimer{
+		Name:     args[0],
+		Interval: d,
+		Type:     Ticker,
+		Conn:     conn.Name(),
+	}
+	cmds := args[2:]
+	if cmds[0] == "once" {
+		t.Type = Timer
+		cmds = cmds[1:]
+	}
+	if len(cmds) == 0 {
+		return c.help, nil, errors.New("need param: <commands>")
+	}
+	t.Commands = strings.Join(cmds, " ")
+
+	if err := timers.Add(t); err != nil {
+		return "", nil, err
+	}
+	if err := timers.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("timer %s: %s", t.Name, t), nil, nil
+}
+
+func handleCmdTimerDel(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) == 0 {
+		return c.help, nil, errors.New("need param: <name>")
+	}
+
+	if !timers.Del(args[0]) {
+		return "", nil, fmt.Errorf("timer not found: %s", args[0])
+	}
+	if err := timers.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("timer %s deleted", args[0]), nil, nil
+}
+
+func handleCmdTimerList(c *Command, p *bufio.Reader) (string, []byte, error) {
+	list := timers.List()
+	if len(list) == 0 {
+		return "No timer defined", nil, nil
+	}
+
+	msg := fmt.Sprintf("\t%-16s%-10s%s\n", "NAME", "NEXT", "TIMER")
+	for _, t := range list {
+		next := "paused"
+		if d := timers.Remaining(t); d > 0 {
+			next = d.Round(time.Second).String()
+		}
+		msg = msg + fmt.Sprintf("\t%-16s%-10s%s\n", t.Name, next, t)
+	}
+	return strings.TrimRight(msg, "\n"), nil, nil
+}
+
+func handleCmdTimerPause(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, _, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) == 0 {
+		return c.help, nil, errors.New("need param: <name>")
+	}
+
+	if c.name == "pause" {
+		err = timers.Pause(args[0])
+	} else {
+		err = timers.Resume(args[0])
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err := timers.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("timer %s %sd", args[0], c.name), nil, nil
+}
+
+// setKeepalive send command to c every interval, 0 interval stops it
+func (c *Connection) setKeepalive(interval time.Duration, command string) error {
+	name := keepaliveTimerName + "@" + c.name
+	if interval == 0 {
+		timers.Del(name)
+	} else {
+		if len(command) == 0 {
+			command = defaultKeepaliveCommand
+		}
+		err := timers.Add(&NamedTimer{
+			Name:     name,
+			Interval: interval,
+			Type:     Ticker,
+			Commands: command,
+			Conn:     c.name,
+			profile:  true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keepalive = interval
+	c.keepaliveCmd = command
+	return nil
+}
+
+// keepaliveString describe keepalive setting of c
+func (c *Connection) keepaliveString() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keepalive == 0 {
+		return fmt.Sprintf("keepalive of %s: off", c.name)
+	}
+	return fmt.Sprintf("keepalive of %s: every %s %q", c.name, c.keepalive, c.keepaliveCmd)
+}
+
+func handleCmdSetKeepalive(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	for name := range opts {
+		if name != "conn" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(args) == 0 {
+		return conn.keepaliveString(), nil, nil
+	}
+
+	var d time.Duration
+	var cmd string
+	if args[0] != "off" {
+		if d, err = parseInterval(args[0]); err != nil {
+			return c.help, nil, err
+		}
+		cmd = strings.Join(args[1:], " ")
+	}
+	if err := conn.setKeepalive(d, cmd); err != nil {
+		return "", nil, err
+	}
+	if err := conn.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return conn.keepaliveString(), nil, nil
+}
@@ -0,0 +1,115 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"60":    time.Minute,
+		"1.5":   1500 * time.Millisecond,
+		"2m30s": 150 * time.Second,
+	} {
+		d, err := parseInterval(s)
+		if err != nil || d != want {
+			t.Fatalf("parseInterval(%q) = %s, %v", s, d, err)
+		}
+	}
+	if _, err := parseInterval("soon"); err == nil {
+		t.Fatal("want error for bad interval")
+	}
+}
+
+func TestTimerManager(t *testing.T) {
+	m := NewTimerManager()
+	defer m.Stop()
+
+	fired := make(chan string, 10)
+	add := func(name string, tt TaskType, paused bool) {
+		err := m.Add(&NamedTimer{
+			Name:     name,
+			Interval: minTimerInterval,
+			Type:     tt,
+			Paused:   paused,
+			handler:  func() { fired <- name },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("once", Timer, false)
+	add("paused", Ticker, true)
+
+	select {
+	case name := <-fired:
+		if name != "once" {
+			t.Fatalf("timer %s fired", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer not fired")
+	}
+	if list := m.List(); len(list) != 1 || list[0].Name != "paused" {
+		t.Fatal("once timer is not removed")
+	}
+
+	if err := m.Resume("paused"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("resumed timer not fired")
+	}
+	if !m.Del("paused") || m.Del("paused") {
+		t.Fatal("bad deletion")
+	}
+	if err := m.Add(&NamedTimer{Name: "fast", Interval: time.Millisecond}); err == nil {
+		t.Fatal("want error for short interval")
+	}
+}
+
+func TestKeepaliveSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, connFileName)
+
+	c, cleanup := newTestConn(t, NewReconnectPolicy())
+	defer cleanup()
+	if err := c.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setKeepalive(time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveSettings(); err != nil {
+		t.Fatal(err)
+	}
+	timers.Del(keepaliveTimerName + "@" + c.name)
+
+	c2 := newConnection(c.manager, c.name)
+	if err := c2.loadSettings(fname); err != nil {
+		t.Fatal(err)
+	}
+	if c2.keepalive != time.Minute || c2.keepaliveCmd != defaultKeepaliveCommand {
+		t.Fatalf("keepalive not restored: %s %q", c2.keepalive, c2.keepaliveCmd)
+	}
+	var found *NamedTimer
+	for _, nt := range timers.List() {
+		if nt.Name == keepaliveTimerName+"@"+c.name {
+			found = nt
+		}
+	}
+	if found == nil || found.Conn != c.name || !found.profile {
+		t.Fatal("keepalive timer not bound to connection")
+	}
+	if err := c2.setKeepalive(0, ""); err != nil {
+		t.Fatal(err)
+	}
+}
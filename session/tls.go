@@ -0,0 +1,103 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+// parseSwitch parse value of on/off option
+func parseSwitch(name, value string) (bool, error) {
+	switch value {
+	case "on", "true":
+		return true, nil
+	case "off", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("--%s must be on or off", name)
+}
+
+// setTLSOption apply option name of /open or /set tls to cfg, it return
+// false if name is not a TLS option
+func setTLSOption(cfg *telnet.TLSConfig, name, value string) (bool, error) {
+	var err error
+	switch name {
+	case "tls":
+		cfg.Enabled, err = parseSwitch(name, value)
+	case "ca":
+		cfg.CAFile = value
+	case "cert":
+		cfg.CertFile = value
+	case "key":
+		cfg.KeyFile = value
+	case "insecure":
+		cfg.Insecure, err = parseSwitch(name, value)
+	case "starttls":
+		cfg.StartTLS, err = parseSwitch(name, value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// tlsString describe TLS settings cfg
+func tlsString(cfg telnet.TLSConfig) string {
+	items := []string{"off"}
+	if cfg.Enabled {
+		items[0] = "on"
+	}
+	if len(cfg.CAFile) > 0 {
+		items = append(items, "ca "+cfg.CAFile)
+	}
+	if len(cfg.CertFile) > 0 {
+		items = append(items, "cert "+cfg.CertFile, "key "+cfg.KeyFile)
+	}
+	if cfg.Insecure {
+		items = append(items, "[red]insecure[-]")
+	}
+	if cfg.StartTLS {
+		items = append(items, "starttls")
+	}
+	return strings.Join(items, ", ")
+}
+
+func handleCmdSetTLS(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	conn, err := selectConn(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cfg := conn.config.TLS.Get()
+	if len(args) == 0 && len(opts) == 0 {
+		return fmt.Sprintf("tls of %s: %s", conn.name, tlsString(cfg)), nil, nil
+	}
+	if len(args) > 0 {
+		if cfg.Enabled, err = parseSwitch("tls", args[0]); err != nil {
+			return c.help, nil, err
+		}
+	}
+	for name, value := range opts {
+		if name == "conn" {
+			continue
+		}
+		ok, err := setTLSOption(&cfg, name, value)
+		if err != nil {
+			return c.help, nil, err
+		}
+		if !ok || name == "tls" {
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+
+	conn.config.TLS.Set(cfg)
+	if err := conn.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("tls of %s: %s", conn.name, tlsString(cfg)), nil, nil
+}
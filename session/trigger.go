@@ -0,0 +1,562 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const triggerFileName = "triggers.json"
+
+// TriggerType is type of trigger pattern
+type TriggerType string
+
+const (
+	TriggerRegex TriggerType = "regex"
+	TriggerGlob  TriggerType = "glob"
+)
+
+// TriggerAction is what to do when a trigger matches
+type TriggerAction string
+
+const (
+	// ActionSend send body to server, aliases in body are expanded
+	ActionSend TriggerAction = "send"
+	// ActionEcho output body to screen
+	ActionEcho TriggerAction = "echo"
+	// ActionLua run body as lua script
+	ActionLua TriggerAction = "lua"
+	// ActionEnable enable trigger group named by body
+	ActionEnable TriggerAction = "enable"
+	// ActionDisable disable trigger group named by body
+	ActionDisable TriggerAction = "disable"
+)
+
+func parseTriggerAction(name string) (TriggerAction, bool) {
+	switch a := TriggerAction(name); a {
+	case ActionSend, ActionEcho, ActionLua, ActionEnable, ActionDisable:
+		return a, true
+	}
+	return "", false
+}
+
+// Trigger runs action when a line or prompt from server matches pattern.
+// Captures can be referenced in body by $1 or ${name}, lua scripts get them
+// from global table "matches".
+type Trigger struct {
+	Name     string        `json:"name"`
+	Pattern  string        `json:"pattern"`
+	Type     TriggerType   `json:"type"`
+	Action   TriggerAction `json:"action"`
+	Body     string        `json:"body"`
+	Group    string        `json:"group,omitempty"`
+	Priority int           `json:"priority"`
+	Prompt   bool          `json:"prompt,omitempty"`
+	Disabled bool          `json:"disabled,omitempty"`
+	// Script is set for triggers added by scripts, they are not saved
+	Script bool `json:"-"`
+
+	re *regexp.Regexp
+}
+
+// compile prepare regular expression of trigger pattern
+func (t *Trigger) compile() error {
+	expr := t.Pattern
+	switch t.Type {
+	case TriggerRegex:
+	case TriggerGlob:
+		expr = globToRegexp(t.Pattern)
+	default:
+		return fmt.Errorf("unknown trigger type: %s", t.Type)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	t.re = re
+	return nil
+}
+
+// Match return captures of line, nil is returned if line doesn't match
+func (t *Trigger) Match(line string) []int {
+	return t.re.FindStringSubmatchIndex(line)
+}
+
+// Expand return body with captures of match replaced
+func (t *Trigger) Expand(line string, match []int) string {
+	return string(t.re.ExpandString(nil, t.Body, line, match))
+}
+
+// captures return text of match and its named captures
+func (t *Trigger) captures(line string, match []int) ([]string, map[string]string) {
+	names := t.re.SubexpNames()
+	caps := make([]string, 0, len(match)/2)
+	named := make(map[string]string)
+	for i := 0; i+1 < len(match); i += 2 {
+		s := ""
+		if match[i] >= 0 {
+			s = line[match[i]:match[i+1]]
+		}
+		caps = append(caps, s)
+		if n := names[i/2]; len(n) > 0 {
+			named[n] = s
+		}
+	}
+	return caps, named
+}
+
+func (t *Trigger) String() string {
+	kind := "line"
+	if t.Prompt {
+		kind = "prompt"
+	}
+	return fmt.Sprintf("%s %s %q -> %s %q", kind, t.Type, t.Pattern, t.Action, t.Body)
+}
+
+// globToRegexp convert glob pattern to an anchored regular expression,
+// '*' and '?' are captured
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString("(.*?)")
+		case '?':
+			b.WriteString("(.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
+
+// TriggerSet keeps triggers sorted by priority, triggers with higher
+// priority run first
+type TriggerSet struct {
+	mu             sync.Mutex
+	triggers       []*Trigger
+	disabledGroups map[string]bool
+	fname          string
+}
+
+// triggerFile is the persisted form of TriggerSet
+type triggerFile struct {
+	Triggers       []*Trigger `json:"triggers"`
+	DisabledGroups []string   `json:"disabled_groups,omitempty"`
+}
+
+func NewTriggerSet() *TriggerSet {
+	return &TriggerSet{
+		triggers:       make([]*Trigger, 0),
+		disabledGroups: make(map[string]bool),
+	}
+}
+
+// Add compile t and add it into set, trigger with the same name is replaced
+func (s *TriggerSet) Add(t *Trigger) error {
+	if len(t.Name) == 0 {
+		return errors.New("trigger name is empty")
+	}
+	if err := t.compile(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(t.Name)
+	s.triggers = append(s.triggers, t)
+	sort.SliceStable(s.triggers, func(i, j int) bool {
+		return s.triggers[i].Priority > s.triggers[j].Priority
+	})
+	return nil
+}
+
+// Del remove trigger name, it return false if trigger is not found
+func (s *TriggerSet) Del(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(name)
+}
+
+func (s *TriggerSet) remove(name string) bool {
+	for i, t := range s.triggers {
+		if t.Name == name {
+			s.triggers = append(s.triggers[:i], s.triggers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List return all triggers in order of running
+func (s *TriggerSet) List() []*Trigger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]*Trigger, len(s.triggers))
+	copy(ret, s.triggers)
+	return ret
+}
+
+// SetEnabled enable or disable trigger name
+func (s *TriggerSet) SetEnabled(name string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.triggers {
+		if t.Name == name {
+			t.Disabled = !enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("trigger not found: %s", name)
+}
+
+// SetGroupEnabled enable or disable all triggers of group
+func (s *TriggerSet) SetGroupEnabled(group string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		delete(s.disabledGroups, group)
+	} else {
+		s.disabledGroups[group] = true
+	}
+}
+
+// IsActive report if t is enabled and its group is not disabled
+func (s *TriggerSet) IsActive(t *Trigger) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !t.Disabled && !s.disabledGroups[t.Group]
+}
+
+// Load read triggers from file fname, later changes are saved into it.
+// A not existing file is taken as empty.
+func (s *TriggerSet) Load(fname string) error {
+	s.mu.Lock()
+	s.fname = fname
+	s.mu.Unlock()
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	f := &triggerFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("%s: %s", fname, err.Error())
+	}
+	for _, t := range f.Triggers {
+		if err := s.Add(t); err != nil {
+			return fmt.Errorf("%s: trigger %s: %s", fname, t.Name, err.Error())
+		}
+	}
+	for _, g := range f.DisabledGroups {
+		s.SetGroupEnabled(g, false)
+	}
+	return nil
+}
+
+// Save write triggers into the file loaded from
+func (s *TriggerSet) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.fname) == 0 {
+		return nil
+	}
+
+	f := &triggerFile{
+		Triggers: make([]*Trigger, 0, len(s.triggers)),
+	}
+	for _, t := range s.triggers {
+		if !t.Script {
+			f.Triggers = append(f.Triggers, t)
+		}
+	}
+	for g := range s.disabledGroups {
+		f.DisabledGroups = append(f.DisabledGroups, g)
+	}
+	sort.Strings(f.DisabledGroups)
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.fname, b, 0644)
+}
+
+// triggers run on lines of all connections
+var triggers = NewTriggerSet()
+
+// triggerEntry is a trigger with the set it belongs to
+type triggerEntry struct {
+	set *TriggerSet
+	t   *Trigger
+}
+
+// handleServerLine runs actions of triggers of session and connection c
+// matching line, and posts line to script callbacks. Output of actions is
+// returned.
+func handleServerLine(c *Connection, line string, prompt bool) []byte {
+	list := []triggerEntry{}
+	for _, set := range []*TriggerSet{triggers, c.triggers} {
+		for _, t := range set.List() {
+			list = append(list, triggerEntry{set: set, t: t})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].t.Priority > list[j].t.Priority
+	})
+
+	var out bytes.Buffer
+	for _, e := range list {
+		t := e.t
+		if t.Prompt != prompt || !e.set.IsActive(t) {
+			continue
+		}
+		m := t.Match(line)
+		if m == nil {
+			continue
+		}
+
+		if err := runTriggerAction(c, t, line, m, &out); err != nil {
+			out.WriteString(fmt.Sprintf("trigger %s: %s\n", t.Name, err.Error()))
+		}
+	}
+	runScriptHooks(c, line, prompt)
+	publishLine(c, line, prompt)
+	return out.Bytes()
+}
+
+func runTriggerAction(c *Connection, t *Trigger, line string, m []int, out *bytes.Buffer) error {
+	switch t.Action {
+	case ActionSend:
+		msg, err := execInput(t.Expand(line, m), c)
+		if len(msg) > 0 {
+			out.WriteString(msg + "\n")
+		}
+		return err
+	case ActionEcho:
+		out.WriteString(t.Expand(line, m) + "\n")
+	case ActionLua:
+		caps, named := t.captures(line, m)
+		luaEngine.DoString(t.Body, caps, named)
+	case ActionEnable:
+		triggers.SetGroupEnabled(t.Expand(line, m), true)
+		c.triggers.SetGroupEnabled(t.Expand(line, m), true)
+	case ActionDisable:
+		triggers.SetGroupEnabled(t.Expand(line, m), false)
+		c.triggers.SetGroupEnabled(t.Expand(line, m), false)
+	default:
+		return fmt.Errorf("unknown action: %s", t.Action)
+	}
+	return nil
+}
+
+// selectTriggers return triggers of connection named by option "conn", or
+// triggers of session if it's not given
+func selectTriggers(opts map[string]string) (*TriggerSet, error) {
+	name, ok := opts["conn"]
+	if !ok {
+		return triggers, nil
+	}
+	delete(opts, "conn")
+
+	conn, err := conns.GetOrCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	return conn.triggers, nil
+}
+
+var triggerSubCommands = CommandMap{
+	"add": &Command{
+		name:       "add",
+		handler:    handleCmdTriggerAdd,
+		subCommand: nil,
+		desc:       "add or replace a trigger",
+		help: "\tUsage: /trigger add [--conn <conn>] [--glob] [--prompt] [--action send|echo|lua|enable|disable]\n" +
+			"\t\t[--group <group>] [--priority <n>] <name> <pattern> <body>",
+	},
+	"del": &Command{
+		name:       "del",
+		handler:    handleCmdTriggerDel,
+		subCommand: nil,
+		desc:       "delete a trigger",
+		help:       "\tUsage: /trigger del [--conn <conn>] <name>",
+	},
+	"list": &Command{
+		name:       "list",
+		handler:    handleCmdTriggerList,
+		subCommand: nil,
+		desc:       "list triggers in order of running",
+		help:       "\tUsage: /trigger list [--conn <conn>]",
+	},
+	"enable": &Command{
+		name:       "enable",
+		handler:    handleCmdTriggerEnable,
+		subCommand: nil,
+		desc:       "enable a trigger or a group of triggers",
+		help:       "\tUsage: /trigger enable [--conn <conn>] <name> | --group <group>",
+	},
+	"disable": &Command{
+		name:       "disable",
+		handler:    handleCmdTriggerEnable,
+		subCommand: nil,
+		desc:       "disable a trigger or a group of triggers",
+		help:       "\tUsage: /trigger disable [--conn <conn>] <name> | --group <group>",
+	},
+}
+
+func handleCmdTriggerAdd(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "glob", "prompt")
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) < 3 {
+		return c.help, nil, errors.New("need params: <name> <pattern> <body>")
+	}
+	set, err := selectTriggers(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := &Trigger{
+		Name:    args[0],
+		Pattern: args[1],
+		Type:    TriggerRegex,
+		Action:  ActionSend,
+		Body:    strings.Join(args[2:], " "),
+	}
+	for name, value := range opts {
+		switch name {
+		case "glob":
+			t.Type = TriggerGlob
+		case "prompt":
+			t.Prompt = true
+		case "action":
+			a, ok := parseTriggerAction(value)
+			if !ok {
+				return c.help, nil, fmt.Errorf("unknown action: %s", value)
+			}
+			t.Action = a
+		case "group":
+			t.Group = value
+		case "priority":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "", nil, errors.New("priority must be a number")
+			}
+			t.Priority = n
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+
+	if err := set.Add(t); err != nil {
+		return "", nil, err
+	}
+	if err := set.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("trigger %s: %s", t.Name, t), nil, nil
+}
+
+func handleCmdTriggerDel(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	set, err := selectTriggers(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) == 0 {
+		return c.help, nil, errors.New("need param: <name>")
+	}
+
+	if !set.Del(args[0]) {
+		return "", nil, fmt.Errorf("trigger not found: %s", args[0])
+	}
+	if err := set.Save(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("trigger %s deleted", args[0]), nil, nil
+}
+
+func handleCmdTriggerList(c *Command, p *bufio.Reader) (string, []byte, error) {
+	_, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	set, err := selectTriggers(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	list := set.List()
+	if len(list) == 0 {
+		return "No trigger defined", nil, nil
+	}
+
+	msg := fmt.Sprintf("\t%-16s%-10s%-12s%-10s%s\n", "NAME", "PRIORITY", "GROUP", "STATE", "TRIGGER")
+	for _, t := range list {
+		state := "on"
+		if !set.IsActive(t) {
+			state = "off"
+		}
+		msg = msg + fmt.Sprintf("\t%-16s%-10d%-12s%-10s%s\n", t.Name, t.Priority, t.Group, state, t)
+	}
+	return strings.TrimRight(msg, "\n"), nil, nil
+}
+
+func handleCmdTriggerEnable(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p)
+	if err != nil {
+		return c.help, nil, err
+	}
+	set, err := selectTriggers(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	enabled := c.name == "enable"
+
+	var msg string
+	if group, ok := opts["group"]; ok {
+		set.SetGroupEnabled(group, enabled)
+		msg = fmt.Sprintf("trigger group %s %sd", group, c.name)
+	} else {
+		if len(args) == 0 {
+			return c.help, nil, errors.New("need param: <name>")
+		}
+		if err := set.SetEnabled(args[0], enabled); err != nil {
+			return "", nil, err
+		}
+		msg = fmt.Sprintf("trigger %s %sd", args[0], c.name)
+	}
+
+	if err := set.Save(); err != nil {
+		return "", nil, err
+	}
+	return msg, nil, nil
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"testing"
+)
+
+func TestTriggerMatch(t *testing.T) {
+	tr := &Trigger{Name: "t", Pattern: "* tells you: ?ello", Type: TriggerGlob, Body: "tell $1 hi $2"}
+	if err := tr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	line := "Bob tells you: hello"
+	m := tr.Match(line)
+	if m == nil {
+		t.Fatal("glob doesn't match")
+	}
+	if s := tr.Expand(line, m); s != "tell Bob hi h" {
+		t.Fatalf("bad expansion: %s", s)
+	}
+	if tr.Match("Bob says: hello") != nil {
+		t.Fatal("glob should not match")
+	}
+
+	tr = &Trigger{Name: "hp", Pattern: `HP:(?P<hp>\d+)`, Type: TriggerRegex}
+	if err := tr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	line = "HP:42 MP:10"
+	caps, named := tr.captures(line, tr.Match(line))
+	if len(caps) != 2 || caps[1] != "42" || named["hp"] != "42" {
+		t.Fatalf("bad captures: %v %v", caps, named)
+	}
+}
+
+func TestTriggerSet(t *testing.T) {
+	s := NewTriggerSet()
+	for i, name := range []string{"low", "high", "mid"} {
+		tr := &Trigger{Name: name, Pattern: "x", Type: TriggerRegex, Priority: []int{1, 10, 5}[i], Group: "g"}
+		if err := s.Add(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := s.List()
+	if list[0].Name != "high" || list[1].Name != "mid" || list[2].Name != "low" {
+		t.Fatalf("bad order: %s %s %s", list[0].Name, list[1].Name, list[2].Name)
+	}
+
+	s.SetGroupEnabled("g", false)
+	if s.IsActive(list[0]) {
+		t.Fatal("trigger of disabled group is active")
+	}
+	s.SetGroupEnabled("g", true)
+	if err := s.SetEnabled("mid", false); err != nil || s.IsActive(list[1]) {
+		t.Fatal("disabled trigger is active")
+	}
+
+	if !s.Del("mid") || s.Del("mid") || len(s.List()) != 2 {
+		t.Fatal("bad deletion")
+	}
+	if err := s.Add(&Trigger{Name: "bad", Pattern: "(", Type: TriggerRegex}); err == nil {
+		t.Fatal("want error for bad pattern")
+	}
+}
@@ -0,0 +1,468 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/defsky/xtelnet/proto"
+	"github.com/defsky/xtelnet/shared/websocket"
+	"github.com/defsky/xtelnet/telnet"
+)
+
+// htmlRenderer converts output with ANSI sequences and color tags into HTML
+// for web client, style is kept across calls
+type htmlRenderer struct {
+	style telnet.SGRStyle
+	// pending is incomplete escape sequence of last output
+	pending []byte
+}
+
+// render return HTML of msg, text of each style is enclosed in its own span
+func (h *htmlRenderer) render(msg []byte) string {
+	if len(h.pending) > 0 {
+		msg = append(h.pending, msg...)
+		h.pending = nil
+	}
+
+	out := new(bytes.Buffer)
+	text := new(bytes.Buffer)
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		s := html.EscapeString(text.String())
+		if css := styleCSS(&h.style); len(css) > 0 {
+			s = `<span style="` + css + `">` + s + "</span>"
+		}
+		out.WriteString(s)
+		text.Reset()
+	}
+
+	r := bytes.NewReader(msg)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+
+		switch b {
+		case '\r':
+		case 0x1b:
+			start := len(msg) - r.Len() - 1
+			seq, ctrl, err := telnet.ReadEscSeq(r)
+			if err != nil {
+				// incomplete sequence, wait for the rest
+				h.pending = append([]byte{}, msg[start:]...)
+				flush()
+				return out.String()
+			}
+			text.Write(ctrl)
+			if seq != nil && seq.Type == telnet.ESC_SGR {
+				flush()
+				h.style.Apply(seq.ParamString, true)
+			}
+		case '[':
+			rest := msg[len(msg)-r.Len()-1:]
+			m := colorTag.FindSubmatch(rest)
+			if m == nil || len(m[0]) == 2 {
+				text.WriteByte(b)
+				continue
+			}
+			flush()
+			r.Seek(int64(len(m[0])-1), 1)
+			applyColorTag(&h.style, m)
+		default:
+			text.WriteByte(b)
+		}
+	}
+	flush()
+	return out.String()
+}
+
+// webMessage is message between web client and session in JSON.
+//
+// From client:
+//  auth: Token, Readonly, it must be the first message
+//  input: Text, a command line
+//  size: Rows and Cols of output area
+// From session:
+//  ready: Readonly, client is attached
+//  output: HTML of output
+//  event: Text, connection name and lifecycle event
+//  error: Text, client is closed after it
+type webMessage struct {
+	Type     string `json:"type"`
+	Token    string `json:"token,omitempty"`
+	Readonly bool   `json:"readonly,omitempty"`
+	Text     string `json:"text,omitempty"`
+	HTML     string `json:"html,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	Cols     uint16 `json:"cols,omitempty"`
+}
+
+func webSend(ws *websocket.Conn, m *webMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.TextMessage, b)
+}
+
+func webRead(ws *websocket.Conn) (*webMessage, error) {
+	_, b, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	m := &webMessage{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// webServer serves web client and bridges its websocket to terminal like
+// an attached client. Failed authentication counts for remote listener
+// too.
+type webServer struct {
+	mu      sync.Mutex
+	dir     string
+	term    *Terminal
+	ln      net.Listener
+	srv     *http.Server
+	scheme  string
+	limiter *authLimiter
+}
+
+var webUI = &webServer{
+	limiter: remote.limiter,
+}
+
+// webEntry is the persisted web client setting of session
+type webEntry struct {
+	Addr string `json:"addr"`
+	TLS  bool   `json:"tls,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// setSession set profile directory of session and terminal serving clients
+func (s *webServer) setSession(dir string, term *Terminal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dir = dir
+	s.term = term
+}
+
+// Listen start serving web client as e, server started before is stopped
+func (s *webServer) Listen(e *webEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.term == nil {
+		return errors.New("session is not started")
+	}
+	var cfg *tls.Config
+	if e.TLS {
+		cert, err := loadOrCreateCert(s.dir, e.Cert, e.Key)
+		if err != nil {
+			return err
+		}
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", e.Addr)
+	if err != nil {
+		return err
+	}
+	if s.srv != nil {
+		s.srv.Close()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleAsset)
+	mux.HandleFunc("/ws", s.handleWebsocket)
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: authTimeout}
+	s.ln = ln
+	s.scheme = "http"
+	if cfg != nil {
+		s.scheme = "https"
+		ln = tls.NewListener(ln, cfg)
+	}
+	go s.srv.Serve(ln)
+	return nil
+}
+
+// Stop close the server, attached web clients are kept
+func (s *webServer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv != nil {
+		s.srv.Close()
+		s.srv = nil
+		s.ln = nil
+	}
+}
+
+// Status describe the server
+func (s *webServer) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv == nil {
+		return "not serving"
+	}
+	st := fmt.Sprintf("serving on %s://%s/", s.scheme, s.ln.Addr())
+	if _, err := os.Stat(filepath.Join(s.dir, tokenFileName)); err != nil {
+		st += ", [red]no access token[-], run: xtelnet token <session>"
+	}
+	return st
+}
+
+func (s *webServer) handleAsset(w http.ResponseWriter, r *http.Request) {
+	a, ok := webAssets[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(a.content))
+}
+
+func (s *webServer) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	readonly, err := s.auth(ws, host)
+	if err == nil {
+		err = s.bridge(ws, readonly)
+	}
+	if err != nil {
+		webSend(ws, &webMessage{Type: "error", Text: err.Error()})
+		ws.WriteClose(websocket.ClosePolicy, "")
+	}
+}
+
+// auth read auth message of client from host and check its token, it
+// return if client is read-only
+func (s *webServer) auth(ws *websocket.Conn, host string) (bool, error) {
+	ws.SetReadDeadline(time.Now().Add(authTimeout))
+	m, err := webRead(ws)
+	if err != nil {
+		return false, err
+	}
+	ws.SetReadDeadline(time.Time{})
+	if m.Type != "auth" {
+		return false, errors.New("authentication is required")
+	}
+	if !s.limiter.allow(host) {
+		return false, errAuthLimited
+	}
+
+	s.mu.Lock()
+	fname := filepath.Join(s.dir, tokenFileName)
+	s.mu.Unlock()
+	if err := checkToken(fname, m.Token); err != nil {
+		return false, err
+	}
+	s.limiter.release(host)
+	return m.Readonly, nil
+}
+
+// attach connect terminal like a local client, handshake and attaching are
+// done on return
+func (s *webServer) attach(readonly bool) (net.Conn, error) {
+	s.mu.Lock()
+	term := s.term
+	s.mu.Unlock()
+
+	conn, server := net.Pipe()
+	go term.HandleIncoming(server)
+	if _, err := proto.ClientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_ATTACH_REQ
+	var flags byte
+	if readonly {
+		flags |= attachReadonly
+	}
+	p.WriteByte(flags)
+	if err := proto.WritePacket(conn, p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	retp, err := proto.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if b, _ := retp.ReadByte(); retp.Opcode != proto.SM_ATTACH_ACK || b != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("attaching denied: %s", retp.String())
+	}
+	return conn, nil
+}
+
+// bridge attach terminal for web client, then pass output to it and its
+// input to terminal until either side is closed
+func (s *webServer) bridge(ws *websocket.Conn, readonly bool) error {
+	conn, err := s.attach(readonly)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := webSend(ws, &webMessage{Type: "ready", Readonly: readonly}); err != nil {
+		return nil
+	}
+
+	go func() {
+		defer ws.Close()
+
+		h := &htmlRenderer{}
+		for {
+			p, err := proto.ReadPacket(conn)
+			if err != nil {
+				ws.WriteClose(websocket.CloseGoingAway, "detached")
+				return
+			}
+			var m *webMessage
+			switch p.Opcode {
+			case 0:
+				// output of session
+				m = &webMessage{Type: "output", HTML: h.render(p.Bytes())}
+			case proto.SM_CONN_EVENT:
+				m = &webMessage{Type: "event", Text: p.String()}
+			default:
+				continue
+			}
+			if err := webSend(ws, m); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := webRead(ws)
+		if err != nil {
+			return nil
+		}
+		p := &proto.Packet{}
+		switch m.Type {
+		case "input":
+			p.Opcode = proto.CM_USER_INPUT
+			p.WriteString(m.Text + "\n")
+		case "size":
+			p.Opcode = proto.CM_SCREEN_SIZE
+			binary.Write(p, binary.BigEndian, m.Rows)
+			binary.Write(p, binary.BigEndian, m.Cols)
+		default:
+			continue
+		}
+		if err := proto.WritePacket(conn, p); err != nil {
+			return nil
+		}
+	}
+}
+
+var webSubCommands = CommandMap{
+	"listen": &Command{
+		name:       "listen",
+		handler:    handleCmdWebListen,
+		subCommand: nil,
+		desc:       "serve web client of session",
+		help:       "\tUsage: /web listen <addr> [--tls] [--cert <file> --key <file>]",
+	},
+	"stop": &Command{
+		name:       "stop",
+		handler:    handleCmdWebStop,
+		subCommand: nil,
+		desc:       "stop serving web client",
+		help:       "\tUsage: /web stop",
+	},
+	"status": &Command{
+		name:       "status",
+		handler:    handleCmdWebStatus,
+		subCommand: nil,
+		desc:       "show status of web client server",
+		help:       "\tUsage: /web status",
+	},
+}
+
+func handleCmdWebListen(c *Command, p *bufio.Reader) (string, []byte, error) {
+	args, opts, err := readArgs(p, "tls")
+	if err != nil {
+		return c.help, nil, err
+	}
+	if len(args) != 1 {
+		return c.help, nil, errors.New("address is required")
+	}
+	e := &webEntry{Addr: args[0]}
+	for name, value := range opts {
+		switch name {
+		case "tls":
+			if e.TLS, err = parseSwitch(name, value); err != nil {
+				return c.help, nil, err
+			}
+		case "cert":
+			e.Cert = value
+		case "key":
+			e.Key = value
+		default:
+			return c.help, nil, fmt.Errorf("unknown option: --%s", name)
+		}
+	}
+	if (len(e.Cert) == 0) != (len(e.Key) == 0) {
+		return c.help, nil, errors.New("--cert and --key must be set together")
+	}
+	if len(e.Cert) > 0 {
+		e.TLS = true
+	}
+
+	if err := webUI.Listen(e); err != nil {
+		return "", nil, err
+	}
+	conns.mu.Lock()
+	conns.web = e
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return "web: " + webUI.Status(), nil, nil
+}
+
+func handleCmdWebStop(c *Command, p *bufio.Reader) (string, []byte, error) {
+	webUI.Stop()
+	conns.mu.Lock()
+	conns.web = nil
+	conns.mu.Unlock()
+	if err := conns.saveSettings(); err != nil {
+		return "", nil, err
+	}
+	return "web: " + webUI.Status(), nil, nil
+}
+
+func handleCmdWebStatus(c *Command, p *bufio.Reader) (string, []byte, error) {
+	return "web: " + webUI.Status(), nil, nil
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/shared/websocket"
+)
+
+func TestHTMLRenderer(t *testing.T) {
+	h := &htmlRenderer{}
+	got := ""
+	for _, msg := range []string{
+		"[yellow]connecting[-]\n",
+		"\x1b[31mred\x1b[0m <b> & \x1b[38;5",
+		";208mx\x1b[m\r\n",
+	} {
+		got += h.render([]byte(msg))
+	}
+	want := `<span style="color:yellow">connecting</span>` + "\n" +
+		`<span style="color:maroon">red</span> &lt;b&gt; &amp; <span style="color:#ff8700">x</span>` + "\n"
+	if got != want {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestWebClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+
+	token, err := NewToken("mud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _ := ProfileHomeDir("mud")
+
+	term := NewTerminal()
+	term.buffer = NewLineBuffer(100, 1<<20)
+	term.output("", []byte("\x1b[32mwelcome\x1b[0m\n"))
+
+	s := &webServer{limiter: newAuthLimiter(maxAuthFails, authFailWindow)}
+	s.setSession(profile, term)
+	if err := s.Listen(&webEntry{Addr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	base := "http://" + s.ln.Addr().String()
+
+	resp, err := http.Get(base + "/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/javascript") {
+		t.Fatalf("got %s %s for asset", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	// attach return websocket after auth, and the first message
+	attach := func(token string, readonly bool) (*websocket.Conn, *webMessage) {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		webSend(ws, &webMessage{Type: "auth", Token: token, Readonly: readonly})
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		m, err := webRead(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws, m
+	}
+
+	ws, m := attach("wrong", false)
+	ws.Close()
+	if m.Type != "error" || m.Text != errAuthFailed.Error() {
+		t.Fatalf("got %+v for wrong token", m)
+	}
+
+	ws, m = attach(token, true)
+	defer ws.Close()
+	if m.Type != "ready" || !m.Readonly {
+		t.Fatalf("got %+v", m)
+	}
+	if m, err := webRead(ws); err != nil || m.Type != "output" || m.HTML != `<span style="color:green">welcome</span>`+"\n" {
+		t.Fatalf("got %+v, %v for first screen", m, err)
+	}
+
+	// input goes the same path as attached client
+	webSend(ws, &webMessage{Type: "input", Text: "look"})
+	if m, err := webRead(ws); err != nil || !strings.Contains(m.HTML, "refused") {
+		t.Fatalf("got %+v, %v for input of read-only client", m, err)
+	}
+
+	term.output("", []byte("bye\n"))
+	if m, err := webRead(ws); err != nil || m.HTML != "bye\n" {
+		t.Fatalf("got %+v, %v", m, err)
+	}
+	if n := clientCount(term); n != 1 {
+		t.Fatalf("%d clients attached, want 1", n)
+	}
+}
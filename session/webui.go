@@ -0,0 +1,227 @@
+package session
+
+// webAsset is a static file of web client
+type webAsset struct {
+	contentType string
+	content     string
+}
+
+// webAssets are files of web client by path, they are built into binary so
+// that daemon serves them without any file installed
+var webAssets = map[string]webAsset{
+	"/":           {"text/html; charset=utf-8", webIndexHTML},
+	"/index.html": {"text/html; charset=utf-8", webIndexHTML},
+	"/app.js":     {"application/javascript; charset=utf-8", webAppJS},
+	"/app.css":    {"text/css; charset=utf-8", webAppCSS},
+}
+
+const webIndexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>xtelnet</title>
+<link rel="stylesheet" href="app.css">
+</head>
+<body>
+<form id="login">
+  <h1>xtelnet</h1>
+  <input id="token" type="password" placeholder="access token" autocomplete="off" autofocus>
+  <label><input id="readonly" type="checkbox"> read-only</label>
+  <button type="submit">Attach</button>
+  <p id="login-error"></p>
+</form>
+<div id="term" hidden>
+  <div id="status"></div>
+  <pre id="output"></pre>
+  <input id="input" type="text" autocomplete="off" spellcheck="false">
+</div>
+<script src="app.js"></script>
+</body>
+</html>
+`
+
+const webAppCSS = `html, body { height: 100%; margin: 0; background: black; color: silver; font-family: monospace; }
+#login { max-width: 20em; margin: 4em auto; display: flex; flex-direction: column; gap: 0.6em; }
+#login h1 { color: green; font-size: 1.4em; }
+#login input, #login button, #input { font: inherit; background: #111; color: silver; border: 1px solid #444; padding: 0.3em; }
+#login-error { color: red; }
+#term { display: flex; flex-direction: column; height: 100%; }
+#term[hidden] { display: none; }
+#status { color: gray; padding: 0.2em 0.4em; border-bottom: 1px solid #333; }
+#status.closed { color: red; }
+#output { flex: 1; overflow-y: auto; margin: 0; padding: 0.4em; white-space: pre-wrap; word-break: break-all; }
+#input { border-width: 1px 0 0 0; padding: 0.4em; outline: none; }
+`
+
+const webAppJS = `(function() {
+  "use strict";
+
+  var maxChunks = 5000;
+  var maxHistory = 100;
+
+  var login = document.getElementById("login");
+  var tokenBox = document.getElementById("token");
+  var readonlyBox = document.getElementById("readonly");
+  var loginError = document.getElementById("login-error");
+  var term = document.getElementById("term");
+  var status = document.getElementById("status");
+  var output = document.getElementById("output");
+  var input = document.getElementById("input");
+
+  var ws = null;
+  var cmds = [];
+  var historyPos = 0;
+  try {
+    cmds = JSON.parse(localStorage.getItem("xtelnet.history")) || [];
+  } catch (e) {}
+  historyPos = cmds.length;
+
+  // token may be given in fragment of url, it's never sent to server
+  var m = /token=([^&]+)/.exec(location.hash);
+  if (m) {
+    sessionStorage.setItem("xtelnet.token", decodeURIComponent(m[1]));
+    window.history.replaceState(null, "", location.pathname);
+  }
+  if (sessionStorage.getItem("xtelnet.token")) {
+    tokenBox.value = sessionStorage.getItem("xtelnet.token");
+    connect();
+  }
+
+  login.addEventListener("submit", function(e) {
+    e.preventDefault();
+    sessionStorage.setItem("xtelnet.token", tokenBox.value);
+    connect();
+  });
+
+  function setStatus(text, closed) {
+    status.textContent = text;
+    status.className = closed ? "closed" : "";
+  }
+
+  function send(msg) {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+      ws.send(JSON.stringify(msg));
+    }
+  }
+
+  function append(html) {
+    var atBottom = output.scrollTop + output.clientHeight >= output.scrollHeight - 4;
+    var span = document.createElement("span");
+    span.innerHTML = html;
+    output.appendChild(span);
+    while (output.childNodes.length > maxChunks) {
+      output.removeChild(output.firstChild);
+    }
+    if (atBottom) {
+      output.scrollTop = output.scrollHeight;
+    }
+  }
+
+  function sendSize() {
+    var probe = document.createElement("span");
+    probe.textContent = "0";
+    output.appendChild(probe);
+    var w = probe.getBoundingClientRect().width || 8;
+    var h = probe.getBoundingClientRect().height || 16;
+    output.removeChild(probe);
+    send({type: "size", rows: Math.floor(output.clientHeight / h), cols: Math.floor(output.clientWidth / w)});
+  }
+
+  function connect() {
+    var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    var readonly = readonlyBox.checked;
+    var ready = false;
+    ws = new WebSocket(scheme + location.host + "/ws");
+    ws.onopen = function() {
+      send({type: "auth", token: tokenBox.value, readonly: readonly});
+    };
+    ws.onmessage = function(e) {
+      var msg = JSON.parse(e.data);
+      switch (msg.type) {
+      case "ready":
+        ready = true;
+        login.hidden = true;
+        term.hidden = false;
+        input.placeholder = msg.readonly ? "read-only" : "";
+        setStatus("attached" + (msg.readonly ? ", read-only" : ""));
+        input.focus();
+        sendSize();
+        break;
+      case "output":
+        append(msg.html);
+        break;
+      case "event":
+        setStatus("attached, " + msg.text);
+        break;
+      case "error":
+        if (!ready) {
+          sessionStorage.removeItem("xtelnet.token");
+          loginError.textContent = msg.text;
+        } else {
+          setStatus(msg.text, true);
+        }
+        break;
+      }
+    };
+    ws.onclose = function() {
+      ws = null;
+      if (ready) {
+        setStatus("detached, press Enter to attach again", true);
+      }
+    };
+  }
+
+  input.addEventListener("keydown", function(e) {
+    switch (e.key) {
+    case "Enter":
+      if (!ws) {
+        connect();
+        return;
+      }
+      var cmd = input.value;
+      input.value = "";
+      send({type: "input", text: cmd});
+      if (cmd.length > 0 && cmd !== cmds[cmds.length - 1]) {
+        cmds.push(cmd);
+        if (cmds.length > maxHistory) {
+          cmds.shift();
+        }
+        try {
+          localStorage.setItem("xtelnet.history", JSON.stringify(cmds));
+        } catch (err) {}
+      }
+      historyPos = cmds.length;
+      break;
+    case "ArrowUp":
+      if (historyPos > 0) {
+        historyPos--;
+        input.value = cmds[historyPos];
+      }
+      e.preventDefault();
+      break;
+    case "ArrowDown":
+      if (historyPos < cmds.length) {
+        historyPos++;
+        input.value = historyPos < cmds.length ? cmds[historyPos] : "";
+      }
+      e.preventDefault();
+      break;
+    case "PageUp":
+      output.scrollTop -= output.clientHeight;
+      e.preventDefault();
+      break;
+    case "PageDown":
+      output.scrollTop += output.clientHeight;
+      e.preventDefault();
+      break;
+    }
+  });
+
+  var resizeTimer = null;
+  window.addEventListener("resize", function() {
+    clearTimeout(resizeTimer);
+    resizeTimer = setTimeout(sendSize, 200);
+  });
+})();
+`
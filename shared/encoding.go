@@ -1,41 +1,247 @@
 package shared
 
-import "golang.org/x/text/encoding/simplifiedchinese"
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
 
 type Charset string
 
 const (
-	UTF8    = Charset("UTF-8")
-	GB18030 = Charset("GB18030")
+	UTF8     = Charset("UTF-8")
+	GB18030  = Charset("GB18030")
+	GBK      = Charset("GBK")
+	BIG5     = Charset("BIG5")
+	LATIN1   = Charset("ISO-8859-1")
+	SHIFTJIS = Charset("SHIFT_JIS")
+	EUCJP    = Charset("EUC-JP")
+	EUCKR    = Charset("EUC-KR")
+	CP1252   = Charset("WINDOWS-1252")
+	KOI8R    = Charset("KOI8-R")
 )
 
+var EUnknownCharset = errors.New("unknown charset")
+
+type charsetRegistry struct {
+	mu        sync.RWMutex
+	encodings map[Charset]encoding.Encoding
+	aliases   map[string]Charset
+}
+
+var charsets = &charsetRegistry{
+	encodings: make(map[Charset]encoding.Encoding),
+	aliases:   make(map[string]Charset),
+}
+
+func init() {
+	RegisterCharset(UTF8, unicode.UTF8, "UTF8")
+	RegisterCharset(GB18030, simplifiedchinese.GB18030)
+	RegisterCharset(GBK, simplifiedchinese.GBK, "CP936", "GB2312")
+	RegisterCharset(BIG5, traditionalchinese.Big5, "BIG-5", "CP950")
+	RegisterCharset(LATIN1, charmap.ISO8859_1, "LATIN1", "LATIN-1", "ISO8859-1")
+	RegisterCharset(SHIFTJIS, japanese.ShiftJIS, "SHIFT-JIS", "SJIS", "CP932")
+	RegisterCharset(EUCJP, japanese.EUCJP, "EUCJP")
+	RegisterCharset(EUCKR, korean.EUCKR, "EUCKR", "CP949")
+	RegisterCharset(CP1252, charmap.Windows1252, "CP1252")
+	RegisterCharset(KOI8R, charmap.KOI8R, "KOI8R")
+}
+
+func normalizeCharsetName(name string) string {
+	return strings.ToUpper(strings.TrimSpace(name))
+}
+
+// RegisterCharset add enc into registry with name and aliases,
+// names are case insensitive
+func RegisterCharset(name Charset, enc encoding.Encoding, aliases ...string) {
+	charsets.mu.Lock()
+	defer charsets.mu.Unlock()
+
+	name = Charset(normalizeCharsetName(string(name)))
+	charsets.encodings[name] = enc
+	for _, a := range aliases {
+		charsets.aliases[normalizeCharsetName(a)] = name
+	}
+}
+
+// LookupCharset return the canonical charset of name, names which are not
+// registered will be looked up in IANA index
+func LookupCharset(name string) (Charset, error) {
+	n := normalizeCharsetName(name)
+
+	charsets.mu.RLock()
+	if _, ok := charsets.encodings[Charset(n)]; ok {
+		charsets.mu.RUnlock()
+		return Charset(n), nil
+	}
+	if c, ok := charsets.aliases[n]; ok {
+		charsets.mu.RUnlock()
+		return c, nil
+	}
+	charsets.mu.RUnlock()
+
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return "", EUnknownCharset
+	}
+	canonical, err := ianaindex.IANA.Name(enc)
+	if err != nil {
+		return "", EUnknownCharset
+	}
+	c := Charset(normalizeCharsetName(canonical))
+	RegisterCharset(c, enc, name)
+
+	return c, nil
+}
+
+// Charsets return sorted names of registered charsets
+func Charsets() []string {
+	charsets.mu.RLock()
+	defer charsets.mu.RUnlock()
+
+	names := make([]string, 0, len(charsets.encodings))
+	for c := range charsets.encodings {
+		names = append(names, string(c))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getEncoding(charset Charset) encoding.Encoding {
+	c, err := LookupCharset(string(charset))
+	if err != nil {
+		return nil
+	}
+
+	charsets.mu.RLock()
+	defer charsets.mu.RUnlock()
+	return charsets.encodings[c]
+}
+
+// IsUTF8 report if charset is UTF-8
+func (c Charset) IsUTF8() bool {
+	cs, err := LookupCharset(string(c))
+	return err == nil && cs == UTF8
+}
+
 func DecodeFrom(charset Charset, data []byte) []byte {
+	enc := getEncoding(charset)
+	if enc == nil {
+		return data
+	}
 
-	var str []byte
-	switch charset {
-	case GB18030:
-		var decodeBytes, _ = simplifiedchinese.GB18030.NewDecoder().Bytes(data)
-		str = decodeBytes
-	case UTF8:
-		fallthrough
-	default:
-		str = data
+	str, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data
 	}
 
 	return str
 }
 
 func EncodeTo(charset Charset, s []byte) []byte {
-	var str []byte
-
-	switch charset {
-	case GB18030:
-		str, _ = simplifiedchinese.GB18030.NewEncoder().Bytes(s)
-	case UTF8:
-		fallthrough
-	default:
+	enc := getEncoding(charset)
+	if enc == nil {
+		return s
+	}
 
+	str, err := encoding.ReplaceUnsupported(enc.NewEncoder()).Bytes(s)
+	if err != nil {
+		return s
 	}
 
 	return str
 }
+
+// Decoder decode a stream of data into UTF-8, multibyte character split
+// across reads is kept until the rest bytes arrived
+type Decoder struct {
+	charset Charset
+	t       transform.Transformer
+	pending []byte
+}
+
+// NewDecoder return a Decoder for charset, unknown charset will be
+// passed through
+func NewDecoder(charset Charset) *Decoder {
+	d := &Decoder{charset: charset}
+	if enc := getEncoding(charset); enc != nil {
+		d.t = enc.NewDecoder()
+	}
+	return d
+}
+
+// Charset return charset of decoder
+func (d *Decoder) Charset() Charset {
+	return d.charset
+}
+
+// Decode return decoded UTF-8 data of p, an incomplete character at the end
+// of p will be returned by next call
+func (d *Decoder) Decode(p []byte) []byte {
+	if d.t == nil {
+		return p
+	}
+	src := append(d.pending, p...)
+	d.pending = nil
+
+	out, n := d.transform(src, false)
+	if n < len(src) {
+		d.pending = append([]byte{}, src[n:]...)
+	}
+	return out
+}
+
+// Flush return decoded data of all pending bytes
+func (d *Decoder) Flush() []byte {
+	if d.t == nil || len(d.pending) == 0 {
+		return nil
+	}
+	src := d.pending
+	d.pending = nil
+
+	out, _ := d.transform(src, true)
+	d.t.Reset()
+	return out
+}
+
+func (d *Decoder) transform(src []byte, atEOF bool) ([]byte, int) {
+	dst := make([]byte, len(src)*2+utf8MaxLen)
+	out := make([]byte, 0, len(dst))
+	consumed := 0
+
+	for {
+		nDst, nSrc, err := d.t.Transform(dst, src[consumed:], atEOF)
+		out = append(out, dst[:nDst]...)
+		consumed += nSrc
+
+		switch err {
+		case transform.ErrShortDst:
+			if nDst == 0 {
+				dst = make([]byte, len(dst)*2)
+			}
+			continue
+		case transform.ErrShortSrc:
+			// incomplete character at the end
+			return out, consumed
+		case nil:
+			return out, consumed
+		default:
+			// should not happen, decoders replace invalid bytes
+			out = append(out, src[consumed:]...)
+			return out, len(src)
+		}
+	}
+}
+
+const utf8MaxLen = 4
@@ -0,0 +1,48 @@
+package shared
+
+import "testing"
+
+func TestDecoderSplitCharacter(t *testing.T) {
+	data := EncodeTo(GB18030, []byte("吃了吗"))
+	d := NewDecoder(GB18030)
+
+	out := []byte{}
+	for i := range data {
+		out = append(out, d.Decode(data[i:i+1])...)
+	}
+	out = append(out, d.Flush()...)
+	if string(out) != "吃了吗" {
+		t.Fatalf("got %q", out)
+	}
+
+	d = NewDecoder(UTF8)
+	out = append(d.Decode([]byte("caf\xc3")), d.Decode([]byte("\xa9"))...)
+	if string(out) != "café" {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestLookupCharset(t *testing.T) {
+	cases := map[string]Charset{
+		"utf8":      UTF8,
+		"big5":      BIG5,
+		"latin1":    LATIN1,
+		"Shift_JIS": SHIFTJIS,
+	}
+	for name, want := range cases {
+		got, err := LookupCharset(name)
+		if err != nil || got != want {
+			t.Errorf("%s: got %s %v, want %s", name, got, err, want)
+		}
+	}
+	if _, err := LookupCharset("no-such-charset"); err != EUnknownCharset {
+		t.Errorf("want EUnknownCharset, got %v", err)
+	}
+
+	if got := EncodeTo(UTF8, []byte("abc")); string(got) != "abc" {
+		t.Errorf("EncodeTo UTF-8: got %q", got)
+	}
+	if got := EncodeTo(LATIN1, []byte("é")); len(got) != 1 || got[0] != 0xe9 {
+		t.Errorf("EncodeTo latin1: got %v", got)
+	}
+}
@@ -1,95 +1,218 @@
-package lua
-
-import (
-	"bufio"
-	"os"
-	"sync"
-
-	lua "github.com/yuin/gopher-lua"
-	"github.com/yuin/gopher-lua/parse"
-)
-
-// LStatePool is a pool for lua LState object
-type LStatePool struct {
-	m     sync.Mutex
-	saved []*lua.LState
-}
-
-//Get a LState object
-func (pl *LStatePool) Get() *lua.LState {
-	pl.m.Lock()
-	defer pl.m.Unlock()
-	n := len(pl.saved)
-	if n == 0 {
-		return pl.New()
-	}
-	// x := pl.saved[n-1]
-	// pl.saved = pl.saved[0 : n-1]
-	x := pl.saved[0]
-	pl.saved = pl.saved[1:]
-
-	return x
-}
-
-// Put LState return to pool
-func (pl *LStatePool) Put(L *lua.LState) {
-	pl.m.Lock()
-	defer pl.m.Unlock()
-	pl.saved = append(pl.saved, L)
-}
-
-// New create a new LState object
-func (pl *LStatePool) New() *lua.LState {
-	L := lua.NewState()
-	// setting the L up here.
-	// load scripts, set global variables, share channels, etc...
-	return L
-}
-
-// Shutdown close all LState object
-func (pl *LStatePool) Shutdown() {
-	for _, L := range pl.saved {
-		L.Close()
-	}
-}
-
-// Engine is a lua script engine
-type Engine struct {
-	pool *LStatePool
-}
-
-// NewEngine create a new Engine
-func NewEngine() *Engine {
-	return &Engine{
-		pool: &LStatePool{
-			saved: make([]*lua.LState, 0, 4),
-		},
-	}
-}
-func (e *Engine) Load(fname string) {
-
-}
-
-// Stop will stop the engine
-func (e *Engine) Stop() {
-	e.pool.Shutdown()
-}
-
-// Compile reads the passed lua file from disk and compiles it.
-func (e *Engine) Compile(filePath string) (*lua.FunctionProto, error) {
-	file, err := os.Open(filePath)
-	defer file.Close()
-	if err != nil {
-		return nil, err
-	}
-	reader := bufio.NewReader(file)
-	chunk, err := parse.Parse(reader, filePath)
-	if err != nil {
-		return nil, err
-	}
-	proto, err := lua.Compile(chunk, filePath)
-	if err != nil {
-		return nil, err
-	}
-	return proto, nil
-}
+package lua
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// LStatePool is a pool for lua LState object
+type LStatePool struct {
+	m     sync.Mutex
+	saved []*lua.LState
+}
+
+//Get a LState object
+func (pl *LStatePool) Get() *lua.LState {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	n := len(pl.saved)
+	if n == 0 {
+		return pl.New()
+	}
+	// x := pl.saved[n-1]
+	// pl.saved = pl.saved[0 : n-1]
+	x := pl.saved[0]
+	pl.saved = pl.saved[1:]
+
+	return x
+}
+
+// Put LState return to pool
+func (pl *LStatePool) Put(L *lua.LState) {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	pl.saved = append(pl.saved, L)
+}
+
+// New create a new LState object
+func (pl *LStatePool) New() *lua.LState {
+	L := lua.NewState()
+	// setting the L up here.
+	// load scripts, set global variables, share channels, etc...
+	return L
+}
+
+// Shutdown close all LState object
+func (pl *LStatePool) Shutdown() {
+	for _, L := range pl.saved {
+		L.Close()
+	}
+}
+
+// ErrQueueFull is reported when a job is dropped as engine is too busy
+var ErrQueueFull = errors.New("lua engine is busy, job dropped")
+
+// ErrorHandler is called with errors raised by scripts
+type ErrorHandler func(error)
+
+// Job is a function run in goroutine of engine
+type Job func(L *lua.LState) error
+
+// Engine is a lua script engine, scripts and callbacks are run one by one
+// in a single goroutine with the same LState, so they never race
+type Engine struct {
+	pool    *LStatePool
+	jobs    chan Job
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	started bool
+	onError ErrorHandler
+	// startOnce makes Start run engine only once
+	startOnce sync.Once
+}
+
+// NewEngine create a new Engine
+func NewEngine() *Engine {
+	return &Engine{
+		pool: &LStatePool{
+			saved: make([]*lua.LState, 0, 4),
+		},
+		jobs: make(chan Job, 100),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// OnError set h as handler of errors raised by scripts
+func (e *Engine) OnError(h ErrorHandler) {
+	e.onError = h
+}
+
+// Start run jobs posted to engine, jobs posted before Start are kept.
+// Calls after the first one do nothing.
+func (e *Engine) Start() {
+	e.startOnce.Do(func() {
+		e.started = true
+		go e.run()
+	})
+}
+
+func (e *Engine) run() {
+	defer close(e.done)
+
+	L := e.pool.Get()
+	defer e.pool.Put(L)
+
+	for {
+		select {
+		case job := <-e.jobs:
+			e.exec(L, job)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *Engine) exec(L *lua.LState, job Job) {
+	top := L.GetTop()
+	defer func() {
+		if r := recover(); r != nil {
+			e.report(fmt.Errorf("%v", r))
+		}
+		// drop values left by job
+		L.SetTop(top)
+	}()
+	if err := job(L); err != nil {
+		e.report(err)
+	}
+}
+
+func (e *Engine) report(err error) {
+	if e.onError != nil {
+		e.onError(err)
+	}
+}
+
+// Post put job into queue of engine, it never blocks. Job is dropped if
+// engine is stopped, or reported by ErrQueueFull if the queue is full. Job
+// posted by a running job is run after it.
+func (e *Engine) Post(job Job) {
+	select {
+	case e.jobs <- job:
+	case <-e.stop:
+	default:
+		e.report(ErrQueueFull)
+	}
+}
+
+// Load run lua file fname
+func (e *Engine) Load(fname string) {
+	e.Post(func(L *lua.LState) error {
+		return L.DoFile(fname)
+	})
+}
+
+// DoString run src, captures of a pattern match are set into global table
+// "matches", named captures are set by their names
+func (e *Engine) DoString(src string, matches []string, named map[string]string) {
+	e.Post(func(L *lua.LState) error {
+		tbl := L.NewTable()
+		for i, m := range matches {
+			tbl.RawSetInt(i, lua.LString(m))
+		}
+		for k, v := range named {
+			tbl.RawSetString(k, lua.LString(v))
+		}
+		L.SetGlobal("matches", tbl)
+
+		return L.DoString(src)
+	})
+}
+
+// Call call fn with args converted by ToLValue
+func (e *Engine) Call(fn *lua.LFunction, args ...interface{}) {
+	e.Post(func(L *lua.LState) error {
+		values := make([]lua.LValue, 0, len(args))
+		for _, v := range args {
+			values = append(values, ToLValue(L, v))
+		}
+		return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, values...)
+	})
+}
+
+// Stop will stop the engine
+func (e *Engine) Stop() {
+	e.once.Do(func() {
+		close(e.stop)
+	})
+	if e.started {
+		<-e.done
+	}
+	e.pool.Shutdown()
+}
+
+// Compile reads the passed lua file from disk and compiles it.
+func (e *Engine) Compile(filePath string) (*lua.FunctionProto, error) {
+	file, err := os.Open(filePath)
+	defer file.Close()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	chunk, err := parse.Parse(reader, filePath)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return proto, nil
+}
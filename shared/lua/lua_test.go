@@ -0,0 +1,112 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestEngine(t *testing.T) {
+	e := NewEngine()
+	errCh := make(chan error, 1)
+	e.OnError(func(err error) {
+		errCh <- err
+	})
+	e.Start()
+	defer e.Stop()
+
+	e.DoString(`n = (n or 0) + tonumber(matches[1])`, []string{"x 2", "2"}, nil)
+	e.DoString(`n = n + 1`, nil, nil)
+
+	result := make(chan lua.LValue, 1)
+	e.Post(func(L *lua.LState) error {
+		result <- L.GetGlobal("n")
+		return nil
+	})
+	if v := <-result; v.String() != "3" {
+		t.Fatalf("bad result: %s", v)
+	}
+
+	e.Post(func(L *lua.LState) error {
+		return errors.New("boom")
+	})
+	select {
+	case err := <-errCh:
+		if err.Error() != "boom" {
+			t.Fatalf("bad error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error not reported")
+	}
+}
+
+func TestEnginePost(t *testing.T) {
+	e := NewEngine()
+	errCh := make(chan error, 1)
+	e.OnError(func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	})
+
+	// queue is full before engine starts
+	for i := 0; i < cap(e.jobs)+1; i++ {
+		e.Post(func(L *lua.LState) error { return nil })
+	}
+	if err := <-errCh; err != ErrQueueFull {
+		t.Fatalf("want ErrQueueFull, got %v", err)
+	}
+
+	e.Stop()
+
+	e = NewEngine()
+	e.Start()
+	defer e.Stop()
+
+	// job posted by a running job is run after it
+	done := make(chan struct{})
+	e.Post(func(L *lua.LState) error {
+		L.SetGlobal("step", lua.LString("outer"))
+		e.Post(func(L *lua.LState) error {
+			if s := L.GetGlobal("step").String(); s != "outer done" {
+				t.Errorf("nested job is run in %s", s)
+			}
+			close(done)
+			return nil
+		})
+		L.SetGlobal("step", lua.LString("outer done"))
+		return nil
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("nested job is not run")
+	}
+}
+
+func TestLValueConvert(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	v := ToLValue(L, json.RawMessage(`{"hp":100,"exits":["n","s"],"ok":true}`))
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		t.Fatalf("want table, got %s", v.Type())
+	}
+	if tbl.RawGetString("hp").String() != "100" {
+		t.Fatalf("bad hp: %s", tbl.RawGetString("hp"))
+	}
+
+	m, ok := FromLValue(tbl).(map[string]interface{})
+	if !ok {
+		t.Fatal("want map")
+	}
+	exits, ok := m["exits"].([]interface{})
+	if !ok || len(exits) != 2 || exits[1] != "s" || m["ok"] != true {
+		t.Fatalf("bad conversion: %v", m)
+	}
+}
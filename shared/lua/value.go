@@ -0,0 +1,88 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ToLValue convert go value v into lua value, json.RawMessage is decoded,
+// values of unsupported types are converted to string
+func ToLValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case lua.LValue:
+		return v
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case json.RawMessage:
+		if len(v) == 0 {
+			return lua.LNil
+		}
+		var data interface{}
+		if err := json.Unmarshal(v, &data); err != nil {
+			return lua.LString(v)
+		}
+		return ToLValue(L, data)
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, item := range v {
+			tbl.Append(ToLValue(L, item))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for k, item := range v {
+			tbl.RawSetString(k, ToLValue(L, item))
+		}
+		return tbl
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// FromLValue convert lua value v into go value, tables with only positive
+// integer keys are converted into slices, other tables into maps
+func FromLValue(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && n == countTable(v) {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, FromLValue(v.RawGetInt(i)))
+			}
+			return list
+		}
+		m := make(map[string]interface{})
+		v.ForEach(func(k, item lua.LValue) {
+			m[k.String()] = FromLValue(item)
+		})
+		return m
+	default:
+		return nil
+	}
+}
+
+func countTable(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
@@ -0,0 +1,417 @@
+// Package websocket implements the subset of RFC 6455 used by web client of
+// session: unfragmented writes, fragmented reads and close handshake.
+// Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, they are opcodes of frame
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Status codes of close frame
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	ClosePolicy        = 1008
+	CloseTooBig        = 1009
+	closeNoStatus      = 1005
+)
+
+// MaxMessageSize is the max size of message read, larger one closes the
+// connection
+const MaxMessageSize = 1 << 20
+
+// acceptGUID is appended to key of client to compute accept key
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeTimeout is the max time to write close frame
+const closeTimeout = time.Second
+
+var ErrProtocol = errors.New("websocket: protocol error")
+var ErrTooBig = errors.New("websocket: message too big")
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// CloseError is returned by ReadMessage when close frame is received
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed %d %s", e.Code, e.Text)
+}
+
+// Conn is a websocket connection, ReadMessage must be called by one
+// goroutine, write methods are safe for concurrent use
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	client bool
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, r: r, client: client}
+}
+
+// acceptKey return Sec-WebSocket-Accept of key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken report if comma separated header value v has token
+func hasToken(v, token string) bool {
+	for _, s := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin report if Origin of r is missing or matches its host, so
+// pages of other sites can't connect with cookies of user
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade switch HTTP request r to websocket, error is replied if it's not a
+// valid websocket handshake
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!hasToken(r.Header.Get("Connection"), "upgrade") ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || len(key) == 0 {
+		http.Error(w, "websocket handshake is expected", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, ErrBadHandshake
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, rw.Reader, false), nil
+}
+
+// Dial open websocket connection to rawurl with scheme ws or wss, header is
+// added to the handshake request
+func Dial(rawurl string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if len(u.Port()) == 0 {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.Dial("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	key := base64.StdEncoding.EncodeToString(b)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, ErrBadHandshake
+	}
+	return newConn(conn, r, true), nil
+}
+
+// RemoteAddr return address of peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline set deadline of reading, see net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close close the connection without close handshake
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage return type and data of next text or binary message. Ping is
+// answered, and CloseError is returned after close frame is received.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	msgType := -1
+	var msg []byte
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			switch err {
+			case ErrProtocol:
+				c.WriteClose(CloseProtocolError, "")
+			case ErrTooBig:
+				c.WriteClose(CloseTooBig, "")
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case PingMessage:
+			if err := c.write(PongMessage, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			e := &CloseError{Code: closeNoStatus}
+			if len(data) >= 2 {
+				e.Code = int(binary.BigEndian.Uint16(data))
+				e.Text = string(data[2:])
+			}
+			c.WriteClose(CloseNormal, "")
+			return 0, nil, e
+		case TextMessage, BinaryMessage:
+			if msgType >= 0 {
+				c.WriteClose(CloseProtocolError, "")
+				return 0, nil, ErrProtocol
+			}
+			msgType = op
+		case continuationFrame:
+			if msgType < 0 {
+				c.WriteClose(CloseProtocolError, "")
+				return 0, nil, ErrProtocol
+			}
+		default:
+			c.WriteClose(CloseProtocolError, "")
+			return 0, nil, ErrProtocol
+		}
+
+		if len(msg)+len(data) > MaxMessageSize {
+			c.WriteClose(CloseTooBig, "")
+			return 0, nil, ErrTooBig
+		}
+		msg = append(msg, data...)
+		if !fin {
+			continue
+		}
+		if msgType == TextMessage && !utf8.Valid(msg) {
+			c.WriteClose(CloseInvalidData, "")
+			return 0, nil, ErrProtocol
+		}
+		return msgType, msg, nil
+	}
+}
+
+// readFrame return fin bit, opcode and unmasked payload of next frame
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7f)
+	if head[0]&0x70 != 0 || masked == c.client {
+		return false, 0, nil, ErrProtocol
+	}
+	if op >= CloseMessage && (!fin || n > 125) {
+		return false, 0, nil, ErrProtocol
+	}
+
+	switch n {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b)
+	}
+	if n > MaxMessageSize {
+		return false, 0, nil, ErrTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, data, nil
+}
+
+// WriteMessage write data as a message of type msgType
+func (c *Conn) WriteMessage(msgType int, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+	return c.write(msgType, data)
+}
+
+// WriteClose start close handshake with status code and reason text, it's
+// sent only once
+func (c *Conn) WriteClose(code int, text string) error {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, uint16(code))
+	data = append(data, text...)
+	if len(data) > 125 {
+		data = data[:125]
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	return c.writeFrame(CloseMessage, data)
+}
+
+func (c *Conn) write(op int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return &CloseError{Code: CloseNormal}
+	}
+	return c.writeFrame(op, data)
+}
+
+// writeFrame write a frame with fin set, it must be called with wmu locked
+func (c *Conn) writeFrame(op int, data []byte) error {
+	frame := make([]byte, 0, 14+len(data))
+	frame = append(frame, 0x80|byte(op))
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(data); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(n))
+	}
+
+	if !c.client {
+		frame = append(frame, data...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range data {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer return server echoing messages, error of ReadMessage is sent
+// to errCh
+func echoServer(errCh chan<- error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			op, data, err := c.ReadMessage()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			c.WriteMessage(op, data)
+		}
+	}))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// example of RFC 6455
+	if k := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); k != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s", k)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	errCh := make(chan error, 1)
+	srv := echoServer(errCh)
+	defer srv.Close()
+
+	c, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, msg := range []string{"", "hello", strings.Repeat("x", 200), strings.Repeat("y", 70000)} {
+		if err := c.WriteMessage(TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		op, data, err := c.ReadMessage()
+		if err != nil || op != TextMessage || string(data) != msg {
+			t.Fatalf("echo of %d bytes: got %d %d bytes, %v", len(msg), op, len(data), err)
+		}
+	}
+
+	// ping is answered without disturbing messages
+	c.write(PingMessage, []byte("p"))
+	c.WriteMessage(BinaryMessage, []byte{0, 1})
+	if op, data, err := c.ReadMessage(); err != nil || op != BinaryMessage || len(data) != 2 {
+		t.Fatalf("got %d %v %v after ping", op, data, err)
+	}
+
+	// fragmented message is joined
+	c.writeFrameRaw(TextMessage, false, "frag")
+	c.writeFrameRaw(continuationFrame, true, "ment")
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "fragment" {
+		t.Fatalf("got %q, %v for fragments", data, err)
+	}
+
+	c.WriteClose(CloseNormal, "bye")
+	if e, ok := (<-errCh).(*CloseError); !ok || e.Code != CloseNormal || e.Text != "bye" {
+		t.Fatalf("got %v on server", e)
+	}
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Fatal("close is not replied")
+	}
+}
+
+// writeFrameRaw write a frame with fin given, used to test fragments
+func (c *Conn) writeFrameRaw(op int, fin bool, data string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	b := []byte{byte(op), 0x80 | byte(len(data)), 0, 0, 0, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	c.conn.Write(append(b, data...))
+}
+
+func TestProtocolError(t *testing.T) {
+	errCh := make(chan error, 1)
+	srv := echoServer(errCh)
+	defer srv.Close()
+
+	c, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// frame of client must be masked
+	c.conn.Write([]byte{0x81, 1, 'a'})
+	if err := <-errCh; err != ErrProtocol {
+		t.Fatalf("got %v for unmasked frame", err)
+	}
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Fatal("connection is not closed")
+	} else if e, ok := err.(*CloseError); !ok || e.Code != CloseProtocolError {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	srv := echoServer(make(chan error, 1))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s for plain request", resp.Status)
+	}
+
+	h := http.Header{}
+	h.Set("Origin", "http://evil.example")
+	if _, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), h); err != ErrBadHandshake {
+		t.Fatalf("got %v for other origin", err)
+	}
+}
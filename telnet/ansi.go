@@ -0,0 +1,395 @@
+package telnet
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EscSeqType is type of escape sequence
+type EscSeqType int
+
+const (
+	ESC_UNKNOWN EscSeqType = iota
+	ESC_SGR
+	ESC_CURSOR
+	ESC_ERASE
+	ESC_OSC
+	ESC_DCS
+)
+
+func (t EscSeqType) String() string {
+	switch t {
+	case ESC_SGR:
+		return "SGR"
+	case ESC_CURSOR:
+		return "CURSOR"
+	case ESC_ERASE:
+		return "ERASE"
+	case ESC_OSC:
+		return "OSC"
+	case ESC_DCS:
+		return "DCS"
+	}
+	return "UNKNOWN"
+}
+
+const (
+	ascESC = 0x1b
+	ascBEL = 0x07
+	ascCAN = 0x18
+	ascSUB = 0x1a
+	ascDEL = 0x7f
+	ascCR  = 0x0d
+	ascLF  = 0x0a
+	ascIAC = 0xff
+)
+
+// maxEscStringLen is the limit of OSC, DCS, SOS, PM and APC string, a
+// longer string is taken as broken and dropped
+const maxEscStringLen = 4096
+
+// EscSeq is a complete ECMA-48 escape sequence
+type EscSeq struct {
+	Type EscSeqType
+	// Private is the private parameter marker of CSI, one of '<', '=', '>', '?'
+	Private byte
+	// Params are parameters of CSI separated by ';', missing parameter is 0.
+	// For OSC, Params[0] is the command number.
+	Params       []int
+	ParamString  string
+	Intermediate []byte
+	Final        byte
+	// Data is the string of OSC and DCS
+	Data []byte
+	// Raw is the whole sequence starting with ESC
+	Raw []byte
+}
+
+// Param return parameter i, def is returned if it's missing or 0
+func (s *EscSeq) Param(i, def int) int {
+	if i >= len(s.Params) || s.Params[i] == 0 {
+		return def
+	}
+	return s.Params[i]
+}
+
+// IsCSI report if sequence is a control sequence
+func (s *EscSeq) IsCSI() bool {
+	return len(s.Raw) > 1 && s.Raw[1] == '['
+}
+
+func (s *EscSeq) String() string {
+	return s.Type.String() + " " + strconv.Quote(string(s.Raw))
+}
+
+type escState int
+
+const (
+	escStateEscape escState = iota
+	escStateEscIntermediate
+	escStateCSIEntry
+	escStateCSIParam
+	escStateCSIIntermediate
+	escStateCSIIgnore
+	escStateOSC
+	escStateString
+	escStateStringEsc
+)
+
+// escParser is a state machine parsing an escape sequence byte by byte,
+// the leading ESC is consumed before parsing
+type escParser struct {
+	state  escState
+	seq    *EscSeq
+	params bytes.Buffer
+	data   bytes.Buffer
+	// ctrl holds C0 controls executed while parsing
+	ctrl []byte
+	done bool
+	// unread is set when the sequence is aborted by the last byte fed,
+	// which is not part of the sequence and must be processed again
+	unread bool
+}
+
+func newEscParser() *escParser {
+	p := &escParser{}
+	p.reset()
+	return p
+}
+
+func (p *escParser) reset() {
+	p.state = escStateEscape
+	p.seq = &EscSeq{Raw: []byte{ascESC}}
+	p.params.Reset()
+	p.data.Reset()
+	p.done = false
+	p.unread = false
+}
+
+// abort drop the sequence, the last byte fed is left to caller
+func (p *escParser) abort() bool {
+	p.seq = nil
+	p.unread = true
+	return true
+}
+
+// feed put b into parser, it return true when the sequence is complete or
+// cancelled, p.seq is nil if the sequence is cancelled.
+func (p *escParser) feed(b byte) bool {
+	// CAN and SUB cancel sequence anywhere
+	if b == ascCAN || b == ascSUB {
+		p.seq = nil
+		return true
+	}
+	// IAC belongs to telnet, it never appears in escape sequence
+	if b == ascIAC {
+		return p.abort()
+	}
+
+	switch p.state {
+	case escStateOSC, escStateString:
+		return p.feedString(b)
+	case escStateStringEsc:
+		if b == '\\' {
+			p.seq.Raw = append(p.seq.Raw, ascESC, b)
+			return p.finishString()
+		}
+		// ESC not followed by '\' ends string and starts a new sequence
+		p.reset()
+		return p.feed(b)
+	}
+
+	if b == ascESC {
+		// ESC starts a new sequence, current one is dropped
+		p.reset()
+		return false
+	}
+	if b < 0x20 {
+		// C0 control is executed immediately
+		p.ctrl = append(p.ctrl, b)
+		return false
+	}
+	if b == ascDEL {
+		return false
+	}
+	if b > ascDEL {
+		// not a 7-bit sequence, it's text following a broken one
+		return p.abort()
+	}
+
+	p.seq.Raw = append(p.seq.Raw, b)
+
+	switch p.state {
+	case escStateEscape:
+		switch {
+		case b == '[':
+			p.state = escStateCSIEntry
+		case b == ']':
+			p.state = escStateOSC
+			p.seq.Type = ESC_OSC
+		case b == 'P':
+			p.state = escStateString
+			p.seq.Type = ESC_DCS
+		case b == 'X' || b == '^' || b == '_':
+			// SOS, PM, APC
+			p.state = escStateString
+		case b <= 0x2f:
+			p.seq.Intermediate = append(p.seq.Intermediate, b)
+			p.state = escStateEscIntermediate
+		default:
+			return p.finishEsc(b)
+		}
+	case escStateEscIntermediate:
+		if b <= 0x2f {
+			p.seq.Intermediate = append(p.seq.Intermediate, b)
+			return false
+		}
+		return p.finishEsc(b)
+	case escStateCSIEntry, escStateCSIParam:
+		switch {
+		case b >= '<' && b <= '?':
+			if p.state == escStateCSIEntry {
+				p.seq.Private = b
+				p.state = escStateCSIParam
+			} else {
+				p.state = escStateCSIIgnore
+			}
+		case b >= 0x30 && b <= 0x3b:
+			p.params.WriteByte(b)
+			p.state = escStateCSIParam
+		case b <= 0x2f:
+			p.seq.Intermediate = append(p.seq.Intermediate, b)
+			p.state = escStateCSIIntermediate
+		default:
+			return p.finishCSI(b)
+		}
+	case escStateCSIIntermediate:
+		switch {
+		case b <= 0x2f:
+			p.seq.Intermediate = append(p.seq.Intermediate, b)
+		case b <= 0x3f:
+			p.state = escStateCSIIgnore
+		default:
+			return p.finishCSI(b)
+		}
+	case escStateCSIIgnore:
+		if b >= 0x40 {
+			p.seq.Final = b
+			p.seq.Type = ESC_UNKNOWN
+			return true
+		}
+	}
+
+	return false
+}
+
+// feedString put b into OSC, DCS, SOS, PM or APC string. Line end or a too
+// long string aborts it, so an unterminated string can't swallow output.
+func (p *escParser) feedString(b byte) bool {
+	if p.data.Len() >= maxEscStringLen {
+		p.seq = nil
+		return true
+	}
+
+	switch b {
+	case ascCR, ascLF:
+		return p.abort()
+	case ascESC:
+		p.state = escStateStringEsc
+		return false
+	case ascBEL:
+		if p.state == escStateOSC {
+			p.seq.Raw = append(p.seq.Raw, b)
+			return p.finishString()
+		}
+	}
+	p.seq.Raw = append(p.seq.Raw, b)
+	p.data.WriteByte(b)
+	return false
+}
+
+func (p *escParser) finishEsc(final byte) bool {
+	p.seq.Final = final
+	if len(p.seq.Intermediate) == 0 && (final == '7' || final == '8') {
+		// DECSC and DECRC
+		p.seq.Type = ESC_CURSOR
+	}
+	return true
+}
+
+func (p *escParser) finishCSI(final byte) bool {
+	seq := p.seq
+	seq.Final = final
+	seq.ParamString = p.params.String()
+	seq.Params = parseEscParams(seq.ParamString)
+
+	if seq.Private != 0 || len(seq.Intermediate) > 0 {
+		seq.Type = ESC_UNKNOWN
+		return true
+	}
+
+	switch final {
+	case 'm':
+		seq.Type = ESC_SGR
+	case 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'f', 'd', 'e', 'a', '`', 's', 'u':
+		seq.Type = ESC_CURSOR
+	case 'J', 'K', 'X', 'P', '@', 'L', 'M':
+		seq.Type = ESC_ERASE
+	default:
+		seq.Type = ESC_UNKNOWN
+	}
+	return true
+}
+
+func (p *escParser) finishString() bool {
+	seq := p.seq
+	data := p.data.Bytes()
+	if seq.Type == ESC_OSC {
+		// OSC Ps ; Pt
+		n := bytes.IndexByte(data, ';')
+		if n < 0 {
+			n = len(data)
+		}
+		cmd, err := strconv.Atoi(string(data[:n]))
+		if err == nil {
+			seq.Params = []int{cmd}
+		}
+		if n < len(data) {
+			data = data[n+1:]
+		} else {
+			data = nil
+		}
+	}
+	seq.Data = append([]byte{}, data...)
+	return true
+}
+
+// parseEscParams parse parameters separated by ';', only the first value
+// of a parameter with sub parameters separated by ':' is kept
+func parseEscParams(s string) []int {
+	if len(s) == 0 {
+		return nil
+	}
+	fields := strings.Split(s, ";")
+	params := make([]int, len(fields))
+	for i, f := range fields {
+		if n := strings.IndexByte(f, ':'); n >= 0 {
+			f = f[:n]
+		}
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			v = 0
+		}
+		params[i] = v
+	}
+	return params
+}
+
+// ReadEscSeq read a complete escape sequence from r, the leading ESC must
+// be consumed already. C0 controls met in sequence are returned in ctrl,
+// they should be handled before the sequence. seq is nil if the sequence
+// is cancelled by CAN or SUB, or aborted by a byte can't be in it, which
+// is unread to r.
+func ReadEscSeq(r io.ByteScanner) (seq *EscSeq, ctrl []byte, err error) {
+	p := newEscParser()
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, p.ctrl, err
+		}
+		if p.feed(b) {
+			if p.unread {
+				if err := r.UnreadByte(); err != nil {
+					return nil, p.ctrl, err
+				}
+			}
+			return p.seq, p.ctrl, nil
+		}
+	}
+}
+
+// StripEscSeq return p with all escape sequences removed
+func StripEscSeq(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	var parser *escParser
+	for _, b := range p {
+		if parser != nil {
+			if !parser.feed(b) {
+				continue
+			}
+			unread := parser.unread
+			parser = nil
+			if !unread {
+				continue
+			}
+		}
+		if b == ascESC {
+			parser = newEscParser()
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package telnet
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadEscSeq(t *testing.T) {
+	cases := []struct {
+		input  string
+		typ    EscSeqType
+		final  byte
+		params []int
+		data   string
+		rest   string
+	}{
+		{"[1;31mred", ESC_SGR, 'm', []int{1, 31}, "", "red"},
+		{"[38;5;208mx", ESC_SGR, 'm', []int{38, 5, 208}, "", "x"},
+		{"[mx", ESC_SGR, 'm', nil, "", "x"},
+		{"[10;20Htext", ESC_CURSOR, 'H', []int{10, 20}, "", "text"},
+		{"[2Jtext", ESC_ERASE, 'J', []int{2}, "", "text"},
+		{"[Ktext", ESC_ERASE, 'K', nil, "", "text"},
+		{"[?25lhidden", ESC_UNKNOWN, 'l', []int{25}, "", "hidden"},
+		{"]0;window title\x07text", ESC_OSC, 0, []int{0}, "window title", "text"},
+		{"]2;title\x1b\\text", ESC_OSC, 0, []int{2}, "title", "text"},
+		{"Pq#0;2;0;0;0\x1b\\text", ESC_DCS, 0, nil, "q#0;2;0;0;0", "text"},
+		{"7text", ESC_CURSOR, '7', nil, "", "text"},
+		{"(Btext", ESC_UNKNOWN, 'B', nil, "", "text"},
+	}
+
+	for _, c := range cases {
+		r := bytes.NewBufferString(c.input)
+		seq, ctrl, err := ReadEscSeq(r)
+		if err != nil || seq == nil || len(ctrl) > 0 {
+			t.Errorf("%q: seq %v ctrl %v err %v", c.input, seq, ctrl, err)
+			continue
+		}
+		if seq.Type != c.typ || seq.Final != c.final {
+			t.Errorf("%q: got %s %q, want %s %q", c.input, seq.Type, seq.Final, c.typ, c.final)
+		}
+		if !reflect.DeepEqual(seq.Params, c.params) {
+			t.Errorf("%q: got params %v, want %v", c.input, seq.Params, c.params)
+		}
+		if string(seq.Data) != c.data {
+			t.Errorf("%q: got data %q, want %q", c.input, seq.Data, c.data)
+		}
+		if r.String() != c.rest {
+			t.Errorf("%q: sequence swallowed text, rest %q", c.input, r.String())
+		}
+		if want := "\x1b" + c.input[:len(c.input)-len(c.rest)]; string(seq.Raw) != want {
+			t.Errorf("%q: got raw %q, want %q", c.input, seq.Raw, want)
+		}
+	}
+}
+
+func TestReadEscSeqControls(t *testing.T) {
+	// C0 controls inside sequence are returned separately
+	seq, ctrl, err := ReadEscSeq(bytes.NewBufferString("[1\r;32m"))
+	if err != nil || seq == nil || seq.Type != ESC_SGR || string(ctrl) != "\r" {
+		t.Fatalf("got %v %q %v", seq, ctrl, err)
+	}
+	if string(seq.Raw) != "\x1b[1;32m" {
+		t.Fatalf("got raw %q", seq.Raw)
+	}
+
+	// CAN cancels sequence
+	r := bytes.NewBufferString("[12\x18text")
+	seq, _, err = ReadEscSeq(r)
+	if err != nil || seq != nil || r.String() != "text" {
+		t.Fatalf("got %v %v, rest %q", seq, err, r.String())
+	}
+
+	// ESC restarts sequence
+	seq, _, _ = ReadEscSeq(bytes.NewBufferString("[12\x1b[0m"))
+	if seq == nil || string(seq.Raw) != "\x1b[0m" {
+		t.Fatalf("got %v", seq)
+	}
+}
+
+func TestReadEscSeqAbort(t *testing.T) {
+	// IAC aborts sequence and is left for telnet
+	r := bytes.NewBufferString("[1\xff\xf9text")
+	seq, _, err := ReadEscSeq(r)
+	if err != nil || seq != nil || r.String() != "\xff\xf9text" {
+		t.Fatalf("got %v %v, rest %q", seq, err, r.String())
+	}
+
+	// unterminated OSC ends at line end
+	r = bytes.NewBufferString("]0;title\r\nnext line")
+	seq, _, err = ReadEscSeq(r)
+	if err != nil || seq != nil || r.String() != "\r\nnext line" {
+		t.Fatalf("got %v %v, rest %q", seq, err, r.String())
+	}
+
+	// too long string is dropped
+	r = bytes.NewBufferString("]0;" + strings.Repeat("x", maxEscStringLen) + "text")
+	seq, _, err = ReadEscSeq(r)
+	if err != nil || seq != nil || len(r.String()) >= maxEscStringLen {
+		t.Fatalf("got %v %v, rest %d bytes", seq, err, len(r.String()))
+	}
+
+	if got := StripEscSeq([]byte("a\x1b]0;t\r\nb\x1b[1\xffc")); string(got) != "a\r\nb\xffc" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,167 @@
+package telnet
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/defsky/xtelnet/shared"
+)
+
+// subnegotiation commands of CHARSET, see RFC 2066
+const (
+	CHARSET_REQUEST         byte = 1
+	CHARSET_ACCEPTED        byte = 2
+	CHARSET_REJECTED        byte = 3
+	CHARSET_TTABLE_IS       byte = 4
+	CHARSET_TTABLE_REJECTED byte = 5
+	CHARSET_TTABLE_ACK      byte = 6
+	CHARSET_TTABLE_NAK      byte = 7
+)
+
+const charsetTTablePrefix = "[TTABLE]"
+
+// charsetPacket return CHARSET subnegotiation packet with cmd and data
+//
+//	IAC SB CHARSET <cmd> <data> IAC SE
+func charsetPacket(cmd byte, data []byte) *IACPacket {
+	p := &IACPacket{
+		cmd: SB,
+		opt: O_CHARSET,
+	}
+	p.data.WriteByte(cmd)
+	p.data.Write(escapeIAC(data))
+	p.data.Write([]byte{byte(IAC), byte(SE)})
+
+	return p
+}
+
+// parseCharsetRequest return charsets offered in REQUEST data,
+// data does not contain the REQUEST command byte
+func parseCharsetRequest(data []byte) []string {
+	if bytes.HasPrefix(data, []byte(charsetTTablePrefix)) {
+		// skip "[TTABLE]" and version byte
+		data = data[len(charsetTTablePrefix):]
+		if len(data) > 0 {
+			data = data[1:]
+		}
+	}
+	if len(data) < 2 {
+		return nil
+	}
+
+	sep := string(data[0:1])
+	names := []string{}
+	for _, name := range strings.Split(string(data[1:]), sep) {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// selectCharset return the first charset in names which is supported
+func selectCharset(names []string) (string, shared.Charset, bool) {
+	for _, name := range names {
+		cs, err := shared.LookupCharset(name)
+		if err == nil {
+			return name, cs, true
+		}
+	}
+	return "", "", false
+}
+
+// RequestCharset will offer charsets to server, UTF-8 is offered first if
+// charsets is empty
+func (s *NVT) RequestCharset(charsets ...shared.Charset) error {
+	if !s.alive() {
+		return errors.New("no active connection")
+	}
+	cfg := s.Option.NVTOptionCfg
+	if !cfg.GetLocal(O_CHARSET) && !cfg.GetRemote(O_CHARSET) {
+		return errors.New("CHARSET is not enabled")
+	}
+
+	if len(charsets) == 0 {
+		charsets = []shared.Charset{shared.UTF8}
+		if cs := s.Charset(); !cs.IsUTF8() {
+			charsets = append(charsets, cs)
+		}
+	}
+	names := make([]string, 0, len(charsets))
+	for _, cs := range charsets {
+		names = append(names, string(cs))
+	}
+
+	s.mu.Lock()
+	s.charsetRequested = true
+	s.mu.Unlock()
+
+	s.sendIAC(charsetPacket(CHARSET_REQUEST, []byte(" "+strings.Join(names, " "))))
+	return nil
+}
+
+// handleCharset handle CHARSET subnegotiation
+func (s *NVT) handleCharset(pkt *IACPacket) {
+	cmd, err := pkt.data.ReadByte()
+	if err != nil {
+		return
+	}
+	data := pkt.data.Bytes()
+
+	switch cmd {
+	case CHARSET_REQUEST:
+		// answer server's request and drop ours if there is one
+		s.mu.Lock()
+		s.charsetRequested = false
+		s.mu.Unlock()
+
+		name, cs, ok := selectCharset(parseCharsetRequest(data))
+		if !ok {
+			s.sendIAC(charsetPacket(CHARSET_REJECTED, nil))
+			return
+		}
+		s.sendIAC(charsetPacket(CHARSET_ACCEPTED, []byte(name)))
+		s.switchCharset(cs)
+
+	case CHARSET_ACCEPTED:
+		s.mu.Lock()
+		requested := s.charsetRequested
+		s.charsetRequested = false
+		s.mu.Unlock()
+		if !requested {
+			return
+		}
+
+		cs, err := shared.LookupCharset(string(data))
+		if err != nil {
+			return
+		}
+		s.switchCharset(cs)
+
+	case CHARSET_REJECTED:
+		s.mu.Lock()
+		s.charsetRequested = false
+		s.mu.Unlock()
+		if s.Option.DebugIAC {
+			writeBytes(s.inBuffer, []byte("charset request rejected by server\r\n"))
+		}
+
+	case CHARSET_TTABLE_IS:
+		// translation table is not supported
+		s.sendIAC(charsetPacket(CHARSET_TTABLE_REJECTED, nil))
+	}
+}
+
+// switchCharset change charset and mark the position in incoming data, so
+// data received after the subnegotiation is decoded by cs. The mark is sent
+// without mu held, or sender waits for a full inBuffer to drain.
+func (s *NVT) switchCharset(cs shared.Charset) {
+	s.mu.Lock()
+	s.charset = cs
+	s.mu.Unlock()
+	s.inBuffer <- inEvent{mark: markCharset, charset: cs}
+	if s.Option.DebugIAC {
+		writeBytes(s.inBuffer, []byte("charset negotiated: "+string(cs)+"\r\n"))
+	}
+}
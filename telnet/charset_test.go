@@ -0,0 +1,58 @@
+package telnet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/defsky/xtelnet/shared"
+)
+
+func TestParseCharsetRequest(t *testing.T) {
+	cases := map[string][]string{
+		";UTF-8;ISO-8859-1": {"UTF-8", "ISO-8859-1"},
+		" x-unknown gbk":    {"x-unknown", "gbk"},
+		"[TTABLE]\x01;BIG5": {"BIG5"},
+		";":                 nil,
+	}
+	for data, want := range cases {
+		got := parseCharsetRequest([]byte(data))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", data, got, want)
+		}
+	}
+}
+
+func TestHandleCharsetRequest(t *testing.T) {
+	s := &NVT{
+		Option:    &SessionOption{},
+		charset:   shared.GB18030,
+		outBuffer: make(chan []byte, 10),
+		inBuffer:  make(chan inEvent, 10),
+	}
+
+	req := &IACPacket{cmd: SB, opt: O_CHARSET}
+	req.data.WriteByte(CHARSET_REQUEST)
+	req.data.WriteString(";x-unknown;UTF-8;GBK")
+	s.handleCharset(req)
+
+	want := append([]byte{byte(IAC), byte(SB), byte(O_CHARSET), CHARSET_ACCEPTED}, "UTF-8"...)
+	want = append(want, byte(IAC), byte(SE))
+	if got := <-s.outBuffer; !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if s.Charset() != shared.UTF8 {
+		t.Fatalf("charset not switched: %s", s.Charset())
+	}
+	if ev := <-s.inBuffer; ev.mark != markCharset || ev.charset != shared.UTF8 {
+		t.Fatalf("charset switch not marked in incoming data: %+v", ev)
+	}
+
+	req = &IACPacket{cmd: SB, opt: O_CHARSET}
+	req.data.WriteByte(CHARSET_REQUEST)
+	req.data.WriteString(" x-unknown")
+	s.handleCharset(req)
+	if got := <-s.outBuffer; got[3] != CHARSET_REJECTED {
+		t.Fatalf("want REJECTED, got %q", got)
+	}
+}
@@ -0,0 +1,266 @@
+package telnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	ClientName    = "xtelnet"
+	ClientVersion = "0.1.0"
+)
+
+var EInvalidGMCP = errors.New("invalid gmcp message")
+
+// GMCPMessage is a message received from or sent to server by GMCP
+//
+// Wire format:
+//
+//	IAC SB GMCP <Package.SubPackage.Message> [<json data>] IAC SE
+type GMCPMessage struct {
+	Package string
+	Data    json.RawMessage
+}
+
+// Module return the top level package name, eg. "Char" for "Char.Vitals"
+func (m *GMCPMessage) Module() string {
+	n := strings.IndexByte(m.Package, '.')
+	if n < 0 {
+		return m.Package
+	}
+	return m.Package[:n]
+}
+
+// Decode will unmarshal json data of message into v
+func (m *GMCPMessage) Decode(v interface{}) error {
+	if len(m.Data) == 0 {
+		return EInvalidGMCP
+	}
+	return json.Unmarshal(m.Data, v)
+}
+
+// Event return typed value of message for well-known packages,
+// unknown packages will return nil.
+func (m *GMCPMessage) Event() (interface{}, error) {
+	f, ok := gmcpEventTypes[strings.ToLower(m.Package)]
+	if !ok {
+		return nil, nil
+	}
+	v := f()
+	if err := m.Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Bytes return message in wire format without IAC SB GMCP and IAC SE
+func (m *GMCPMessage) Bytes() []byte {
+	b := []byte(m.Package)
+	if len(m.Data) > 0 {
+		b = append(b, ' ')
+		b = append(b, m.Data...)
+	}
+	return b
+}
+
+func (m *GMCPMessage) String() string {
+	return string(m.Bytes())
+}
+
+// NewGMCPMessage create a message with package name and data, data will be
+// encoded to json if it's not nil
+func NewGMCPMessage(pkg string, data interface{}) (*GMCPMessage, error) {
+	m := &GMCPMessage{Package: pkg}
+	if data == nil {
+		return m, nil
+	}
+
+	switch v := data.(type) {
+	case json.RawMessage:
+		m.Data = v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = b
+	}
+
+	return m, nil
+}
+
+// ParseGMCP parse subnegotiation data of GMCP into message
+func ParseGMCP(data []byte) (*GMCPMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, EInvalidGMCP
+	}
+
+	m := &GMCPMessage{}
+	n := bytes.IndexAny(data, " \t\r\n")
+	if n < 0 {
+		m.Package = string(data)
+		return m, nil
+	}
+	m.Package = string(data[:n])
+
+	payload := bytes.TrimSpace(data[n:])
+	if len(payload) > 0 {
+		if !json.Valid(payload) {
+			return nil, EInvalidGMCP
+		}
+		m.Data = json.RawMessage(payload)
+	}
+
+	return m, nil
+}
+
+// GMCPCharVitals is data of Char.Vitals, values are server specific
+type GMCPCharVitals map[string]interface{}
+
+// GMCPCharStatus is data of Char.Status
+type GMCPCharStatus map[string]interface{}
+
+// GMCPRoomInfo is data of Room.Info
+type GMCPRoomInfo struct {
+	Num         int            `json:"num"`
+	Name        string         `json:"name"`
+	Area        string         `json:"area"`
+	Environment string         `json:"environment"`
+	Coords      string         `json:"coords"`
+	Exits       map[string]int `json:"exits"`
+	Details     []string       `json:"details"`
+}
+
+// GMCPCommChannelText is data of Comm.Channel.Text
+type GMCPCommChannelText struct {
+	Channel string `json:"channel"`
+	Talker  string `json:"talker"`
+	Text    string `json:"text"`
+}
+
+var gmcpEventTypes = map[string]func() interface{}{
+	"char.vitals":       func() interface{} { return &GMCPCharVitals{} },
+	"char.status":       func() interface{} { return &GMCPCharStatus{} },
+	"room.info":         func() interface{} { return &GMCPRoomInfo{} },
+	"comm.channel.text": func() interface{} { return &GMCPCommChannelText{} },
+}
+
+// GMCPHandler will be called on each matched GMCP message,
+// it runs in the IAC processing goroutine, so it should not block
+type GMCPHandler func(msg *GMCPMessage)
+
+type gmcpSubscriber struct {
+	prefix  string
+	handler GMCPHandler
+}
+
+// GMCPOption contains GMCP settings of client and subscribers of messages
+type GMCPOption struct {
+	mu          sync.Mutex
+	Supports    []string
+	subscribers map[int]*gmcpSubscriber
+	nextID      int
+}
+
+// NewGMCPOption return GMCPOption with default supported packages
+func NewGMCPOption() *GMCPOption {
+	return &GMCPOption{
+		Supports: []string{
+			"Core 1",
+			"Char 1",
+			"Char.Vitals 1",
+			"Char.Status 1",
+			"Room 1",
+			"Comm.Channel 1",
+		},
+		subscribers: make(map[int]*gmcpSubscriber),
+	}
+}
+
+// Subscribe register h for messages whose package name starts with prefix,
+// matching is case insensitive, empty prefix matches all messages.
+// It returns an id which can be used to unsubscribe.
+func (o *GMCPOption) Subscribe(prefix string, h GMCPHandler) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.nextID++
+	o.subscribers[o.nextID] = &gmcpSubscriber{
+		prefix:  strings.ToLower(prefix),
+		handler: h,
+	}
+	return o.nextID
+}
+
+// Unsubscribe remove subscriber by id
+func (o *GMCPOption) Unsubscribe(id int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.subscribers, id)
+}
+
+// Dispatch will call all matched subscribers with msg
+func (o *GMCPOption) Dispatch(msg *GMCPMessage) {
+	o.mu.Lock()
+	handlers := make([]GMCPHandler, 0, len(o.subscribers))
+	name := strings.ToLower(msg.Package)
+	for _, s := range o.subscribers {
+		if matchGMCPPrefix(name, s.prefix) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+}
+
+// matchGMCPPrefix check if name equals prefix or is a sub package of prefix
+func matchGMCPPrefix(name, prefix string) bool {
+	if prefix == "" || name == prefix {
+		return true
+	}
+	return strings.HasPrefix(name, prefix+".")
+}
+
+// gmcpHello return messages should be sent after GMCP enabled
+func (o *GMCPOption) gmcpHello() []*GMCPMessage {
+	hello, _ := NewGMCPMessage("Core.Hello", map[string]string{
+		"client":  ClientName,
+		"version": ClientVersion,
+	})
+
+	o.mu.Lock()
+	supports := append([]string{}, o.Supports...)
+	o.mu.Unlock()
+
+	set, _ := NewGMCPMessage("Core.Supports.Set", supports)
+
+	return []*GMCPMessage{hello, set}
+}
+
+// gmcpPacket wraps msg into a subnegotiation packet
+func gmcpPacket(msg *GMCPMessage) *IACPacket {
+	p := &IACPacket{
+		cmd: SB,
+		opt: O_GMCP,
+	}
+	p.data.Write(escapeIAC(msg.Bytes()))
+	p.data.Write([]byte{byte(IAC), byte(SE)})
+
+	return p
+}
+
+// escapeIAC will double every IAC byte in data
+func escapeIAC(data []byte) []byte {
+	if bytes.IndexByte(data, byte(IAC)) < 0 {
+		return data
+	}
+	return bytes.Replace(data, []byte{byte(IAC)}, []byte{byte(IAC), byte(IAC)}, -1)
+}
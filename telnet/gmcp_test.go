@@ -0,0 +1,71 @@
+package telnet
+
+import (
+	"testing"
+)
+
+func TestParseGMCP(t *testing.T) {
+	m, err := ParseGMCP([]byte(`Char.Vitals {"hp":"100","maxhp":"120"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Package != "Char.Vitals" || m.Module() != "Char" {
+		t.Fatalf("bad package: %s", m.Package)
+	}
+	ev, err := m.Event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vitals, ok := ev.(*GMCPCharVitals)
+	if !ok || (*vitals)["hp"] != "100" {
+		t.Fatalf("bad event: %v", ev)
+	}
+
+	if _, err := ParseGMCP([]byte(`Room.Info {bad json`)); err == nil {
+		t.Fatal("want error for invalid json")
+	}
+}
+
+func TestScanGMCPPacket(t *testing.T) {
+	// 0xF0 is a valid UTF-8 lead byte and must not end the subnegotiation
+	data := append([]byte{byte(SB), byte(O_GMCP)}, []byte("Comm.Channel.Text {\"text\":\"\xf0\x9f\x98\x80\"}")...)
+	data = append(data, byte(IAC), byte(SE))
+
+	p := &IACPacket{}
+	for _, b := range data {
+		if !p.Scan(b) {
+			break
+		}
+	}
+
+	m, err := ParseGMCP(p.data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text GMCPCommChannelText
+	if err := m.Decode(&text); err != nil {
+		t.Fatal(err)
+	}
+	if text.Text != "\U0001F600" {
+		t.Fatalf("bad text: %q", text.Text)
+	}
+}
+
+func TestGMCPDispatch(t *testing.T) {
+	o := NewGMCPOption()
+	got := 0
+	id := o.Subscribe("char", func(msg *GMCPMessage) { got++ })
+	o.Subscribe("Char.Vitals", func(msg *GMCPMessage) { got += 10 })
+
+	o.Dispatch(&GMCPMessage{Package: "Char.Vitals"})
+	o.Dispatch(&GMCPMessage{Package: "Character.Name"})
+	if got != 11 {
+		t.Fatalf("got %d, want 11", got)
+	}
+
+	o.Unsubscribe(id)
+	o.Dispatch(&GMCPMessage{Package: "Char.Status"})
+	if got != 11 {
+		t.Fatalf("got %d after unsubscribe, want 11", got)
+	}
+}
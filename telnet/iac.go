@@ -3,6 +3,10 @@ package telnet
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type IACParseStatus int
@@ -33,18 +37,24 @@ const (
 	AYT  nvtCmd = 246 // 0xF6	Are You Here?
 	NOP  nvtCmd = 241 // 0xF1	No operation
 	SE   nvtCmd = 240 // 0xF0	Subnegotiation End
+	EOR  nvtCmd = 239 // 0xEF	End of Record
 )
 
 const (
-	O_GMCP   nvtOpt = 201 // 0xC9	Generic MUD Communication Protocol
-	O_ZMP    nvtOpt = 93  // 0x5D	Zenith MUD Protocol
-	O_MXP    nvtOpt = 91  // 0x5B	MUD eXtension Protocol
-	O_MSSP   nvtOpt = 70  // 0x46	MUD Server Status Protocol
-	O_NENV   nvtOpt = 39  // 0x27	[RFC1572] New Environment
-	O_NAWS   nvtOpt = 31  // 0x1F	[RFC1073] Negotiate About Window Size
-	O_TTYPE  nvtOpt = 24  // 0x18	[RFC1091] Terminal Type
-	O_ECHO   nvtOpt = 1   // 0x01	[RFC857]  Echo
-	O_BINARY nvtOpt = 0   // 0x00	[RFC856]  Binary Transmission
+	O_GMCP      nvtOpt = 201 // 0xC9	Generic MUD Communication Protocol
+	O_ZMP       nvtOpt = 93  // 0x5D	Zenith MUD Protocol
+	O_MXP       nvtOpt = 91  // 0x5B	MUD eXtension Protocol
+	O_MCCP3     nvtOpt = 87  // 0x57	MUD Client Compression Protocol v3
+	O_MCCP2     nvtOpt = 86  // 0x56	MUD Client Compression Protocol v2
+	O_MSSP      nvtOpt = 70  // 0x46	MUD Server Status Protocol
+	O_START_TLS nvtOpt = 46  // 0x2E	[draft-altman-telnet-starttls] START_TLS
+	O_CHARSET   nvtOpt = 42  // 0x2A	[RFC2066] Charset
+	O_NENV      nvtOpt = 39  // 0x27	[RFC1572] New Environment
+	O_NAWS      nvtOpt = 31  // 0x1F	[RFC1073] Negotiate About Window Size
+	O_EOR       nvtOpt = 25  // 0x19	[RFC885]  End of Record
+	O_TTYPE     nvtOpt = 24  // 0x18	[RFC1091] Terminal Type
+	O_ECHO      nvtOpt = 1   // 0x01	[RFC857]  Echo
+	O_BINARY    nvtOpt = 0   // 0x00	[RFC856]  Binary Transmission
 )
 
 func (c nvtCmd) String() string {
@@ -61,6 +71,7 @@ func (c nvtCmd) String() string {
 		EC:   "EC",
 		AYT:  "AYT",
 		NOP:  "NOP",
+		EOR:  "EOR",
 	}
 
 	name, ok := cmdName[c]
@@ -75,25 +86,46 @@ func (c nvtCmd) Byte() byte {
 	return byte(c)
 }
 
-func (o nvtOpt) String() string {
-	optName := map[NVTOption]string{
-		O_TTYPE: "TTYPE",
-		O_NAWS:  "NAWS",
-		O_NENV:  "NENV",
-		O_MXP:   "MXP",
-		O_MSSP:  "MSSP",
-		O_ZMP:   "ZMP",
-		O_GMCP:  "GMCP",
-		O_ECHO:  "ECHO",
-	}
+var optName = map[NVTOption]string{
+	O_TTYPE:     "TTYPE",
+	O_EOR:       "EOR",
+	O_NAWS:      "NAWS",
+	O_NENV:      "NENV",
+	O_CHARSET:   "CHARSET",
+	O_START_TLS: "START_TLS",
+	O_MXP:       "MXP",
+	O_MSSP:      "MSSP",
+	O_MCCP2:     "MCCP2",
+	O_MCCP3:     "MCCP3",
+	O_ZMP:       "ZMP",
+	O_GMCP:      "GMCP",
+	O_ECHO:      "ECHO",
+	O_BINARY:    "BINARY",
+}
 
+func (o nvtOpt) String() string {
 	name, ok := optName[o]
 	if ok {
 		return name
 	}
 
-	return string(o)
+	return strconv.Itoa(int(o))
+}
+
+// ParseOption return option by name or number, name is case insensitive
+func ParseOption(s string) (NVTOption, bool) {
+	for o, name := range optName {
+		if strings.EqualFold(name, s) {
+			return o, true
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 255 {
+		return nil, false
+	}
+	return nvtOpt(n), true
 }
+
 func (o nvtOpt) Byte() byte {
 	return byte(o)
 }
@@ -111,6 +143,7 @@ type IACPacket struct {
 	cmd    NVTCommand
 	opt    NVTOption
 	status IACParseStatus
+	iac    bool
 }
 
 func (c *IACPacket) Bytes() []byte {
@@ -135,6 +168,9 @@ func (c *IACPacket) Bytes() []byte {
 
 // Scan will put b in packet, return false indicate not need any more byte
 func (c *IACPacket) Scan(b byte) bool {
+	if c.status == WANT_DATA {
+		return c.scanData(b)
+	}
 	// drop IAC
 	if b == byte(IAC) {
 		return true
@@ -160,11 +196,29 @@ func (c *IACPacket) Scan(b byte) bool {
 			c.status = WANT_NOTHING
 		}
 		return c.status != WANT_NOTHING
-	case WANT_DATA:
-		if SE == nvtCmd(b) {
-			return false
+	}
+
+	return true
+}
+
+// scanData put subnegotiation data in packet, IAC IAC is unescaped to IAC
+// and IAC SE ends the packet
+func (c *IACPacket) scanData(b byte) bool {
+	if !c.iac {
+		if b == byte(IAC) {
+			c.iac = true
+			return true
 		}
 		c.data.WriteByte(b)
+		return true
+	}
+
+	c.iac = false
+	switch nvtCmd(b) {
+	case SE:
+		return false
+	case IAC:
+		c.data.WriteByte(b)
 	}
 
 	return true
@@ -190,32 +244,150 @@ func (c *IACPacket) String() string {
 	return s
 }
 
+// NVTOptionConfig contains which options are accepted and the negotiation
+// state of options on both sides of connection
 type NVTOptionConfig struct {
-	options   map[NVTOption]bool
-	serverOpt map[NVTOption]bool
+	mu       sync.RWMutex
+	options  map[NVTOption]bool
+	localOpt map[NVTOption]bool
+	states   map[NVTOption]*qOption
 }
 
 func NewNVTOptionConfig() *NVTOptionConfig {
 	cfg := &NVTOptionConfig{
 		options: map[NVTOption]bool{
-			O_ECHO:  true,
-			O_TTYPE: true,
+			O_ECHO:    true,
+			O_GMCP:    true,
+			O_MCCP2:   true,
+			O_MCCP3:   true,
+			O_CHARSET: true,
+			O_EOR:     true,
 		},
-		serverOpt: map[NVTOption]bool{},
+		localOpt: map[NVTOption]bool{
+			O_TTYPE:   true,
+			O_NAWS:    true,
+			O_CHARSET: true,
+		},
+		states: map[NVTOption]*qOption{},
 	}
 
 	return cfg
 }
 
+// Get report if server is allowed to enable option o
 func (c *NVTOptionConfig) Get(o NVTOption) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.options[o]
 }
+
+// Set allow or deny server to enable option o
 func (c *NVTOptionConfig) Set(o NVTOption, v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.options[o] = v
 }
 
+// Support report if we are willing to enable option o on local side
+func (c *NVTOptionConfig) Support(o NVTOption) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.localOpt[o]
+}
+
+// SetSupport set if we are willing to enable option o on local side
+func (c *NVTOptionConfig) SetSupport(o NVTOption, v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localOpt[o] = v
+}
+
+// GetRemote report if option o is enabled on server side
 func (c *NVTOptionConfig) GetRemote(o NVTOption) bool {
-	return c.serverOpt[o]
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st, ok := c.states[o]
+	return ok && st.him == Q_YES
+}
+
+// GetLocal report if option o is enabled on local side
+func (c *NVTOptionConfig) GetLocal(o NVTOption) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st, ok := c.states[o]
+	return ok && st.us == Q_YES
+}
+
+// Reset will clear negotiation states, it should be called on new connection
+func (c *NVTOptionConfig) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = map[NVTOption]*qOption{}
+}
+
+// RequestRemote ask server to enable or disable option o, it return the
+// packet should be sent to server, nil if nothing need to send
+func (c *NVTOptionConfig) RequestRemote(o NVTOption, enable bool) (*IACPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.state(o)
+	var cmd NVTCommand
+	var err error
+	if enable {
+		cmd, err = requestEnable(&st.him, &st.himq, DO)
+	} else {
+		cmd, err = requestDisable(&st.him, &st.himq, DONT)
+	}
+	return negotiation(cmd, o), err
+}
+
+// RequestLocal offer to enable or disable option o on local side
+func (c *NVTOptionConfig) RequestLocal(o NVTOption, enable bool) (*IACPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.state(o)
+	var cmd NVTCommand
+	var err error
+	if enable {
+		cmd, err = requestEnable(&st.us, &st.usq, WILL)
+	} else {
+		cmd, err = requestDisable(&st.us, &st.usq, WONT)
+	}
+	return negotiation(cmd, o), err
+}
+
+// OptionStatus is a snapshot of negotiation state of an option
+type OptionStatus struct {
+	Option NVTOption
+	Local  QState
+	Remote QState
+}
+
+// Status return states of all negotiated options
+func (c *NVTOptionConfig) Status() []OptionStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ret := make([]OptionStatus, 0, len(c.states))
+	for o, st := range c.states {
+		ret = append(ret, OptionStatus{Option: o, Local: st.us, Remote: st.him})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Option.Byte() < ret[j].Option.Byte()
+	})
+	return ret
+}
+
+// state return state of option o, caller must hold the lock
+func (c *NVTOptionConfig) state(o NVTOption) *qOption {
+	st, ok := c.states[o]
+	if !ok {
+		st = &qOption{}
+		c.states[o] = st
+	}
+	return st
 }
 
 type NVTCommandHandler func(cfg *NVTOptionConfig, data *IACPacket) *IACPacket
@@ -233,7 +405,6 @@ func NewIACReactor(cfg *NVTOptionConfig) *IACReactor {
 			WONT: handleNVTWont,
 			DO:   handleNVTDo,
 			DONT: handleNVTDont,
-			SB:   handleNVTSb,
 		},
 	}
 }
@@ -247,49 +418,30 @@ func (r *IACReactor) React(m *IACPacket) *IACPacket {
 }
 
 func handleNVTWill(cfg *NVTOptionConfig, p *IACPacket) *IACPacket {
-	if cfg.Get(p.opt) {
-		p.cmd = DO
-		cfg.serverOpt[p.opt] = true
-	} else {
-		p.cmd = DONT
-		cfg.serverOpt[p.opt] = false
-	}
-	return p
+	accept := cfg.Get(p.opt)
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	st := cfg.state(p.opt)
+	return negotiation(receiveEnable(&st.him, &st.himq, accept, DO, DONT), p.opt)
 }
 func handleNVTWont(cfg *NVTOptionConfig, p *IACPacket) *IACPacket {
-	p.cmd = DONT
-	cfg.serverOpt[p.opt] = false
-	return p
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	st := cfg.state(p.opt)
+	return negotiation(receiveDisable(&st.him, &st.himq, DO, DONT), p.opt)
 }
 func handleNVTDo(cfg *NVTOptionConfig, p *IACPacket) *IACPacket {
-	if cfg.Get(p.opt) {
-		p.cmd = WILL
-	} else {
-		p.cmd = DONT
-	}
-	return p
+	accept := cfg.Support(p.opt)
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	st := cfg.state(p.opt)
+	return negotiation(receiveEnable(&st.us, &st.usq, accept, WILL, WONT), p.opt)
 }
 func handleNVTDont(cfg *NVTOptionConfig, p *IACPacket) *IACPacket {
-	p.cmd = WONT
-	return p
-}
-func handleNVTSb(cfg *NVTOptionConfig, p *IACPacket) *IACPacket {
-	switch p.opt {
-	case O_TTYPE:
-		subopt, err := p.data.ReadByte()
-		if err != nil || subopt != 1 {
-			return nil
-		}
-		p.data.Reset()
-
-		buf := []byte{0}
-		buf = append(buf, []byte("xtelnet")...)
-		buf = append(buf, []byte{byte(IAC), byte(SE)}...)
-
-		p.data.Write(buf)
-
-		return p
-	}
-
-	return nil
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	st := cfg.state(p.opt)
+	return negotiation(receiveDisable(&st.us, &st.usq, WILL, WONT), p.opt)
 }
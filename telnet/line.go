@@ -0,0 +1,68 @@
+package telnet
+
+import (
+	"bytes"
+)
+
+// LineHandler is called with every complete line received from server, and
+// with the incomplete line ended by IAC GA or IAC EOR, which is taken as a
+// prompt. For servers not sending them, an incomplete line left unchanged
+// for a while is taken as prompt. line is plain text with escape sequences and line ending
+// stripped, data returned is output right after the line.
+type LineHandler func(line string, prompt bool) []byte
+
+// lineSplitter split decoded output into lines for a LineHandler
+type lineSplitter struct {
+	handler  LineHandler
+	line     bytes.Buffer
+	prompted bool
+}
+
+func newLineSplitter(h LineHandler) *lineSplitter {
+	return &lineSplitter{handler: h}
+}
+
+// Split feed p into splitter and call handler for every complete line, it
+// return p with data returned by handler inserted after the lines
+func (s *lineSplitter) Split(p []byte) []byte {
+	if s.handler == nil {
+		return p
+	}
+
+	out := make([]byte, 0, len(p))
+	for len(p) > 0 {
+		n := bytes.IndexByte(p, '\n')
+		if n < 0 {
+			s.line.Write(p)
+			out = append(out, p...)
+			break
+		}
+		s.line.Write(p[:n])
+		out = append(out, p[:n+1]...)
+		p = p[n+1:]
+
+		out = append(out, s.handler(s.text(), false)...)
+		s.line.Reset()
+		s.prompted = false
+	}
+	return out
+}
+
+// Pending report if there is an incomplete line not taken as prompt
+func (s *lineSplitter) Pending() bool {
+	return s.handler != nil && !s.prompted && s.line.Len() > 0
+}
+
+// Prompt call handler with the incomplete line, only once for each line
+func (s *lineSplitter) Prompt() []byte {
+	if s.handler == nil || s.prompted || s.line.Len() == 0 {
+		return nil
+	}
+	s.prompted = true
+	return s.handler(s.text(), true)
+}
+
+func (s *lineSplitter) text() string {
+	line := StripEscSeq(s.line.Bytes())
+	return string(bytes.TrimRight(line, "\r"))
+}
@@ -0,0 +1,34 @@
+package telnet
+
+import (
+	"testing"
+)
+
+func TestLineSplitter(t *testing.T) {
+	lines := []string{}
+	prompts := []string{}
+	s := newLineSplitter(func(line string, prompt bool) []byte {
+		if prompt {
+			prompts = append(prompts, line)
+			return nil
+		}
+		lines = append(lines, line)
+		return []byte("<" + line + ">\n")
+	})
+
+	out := s.Split([]byte("\x1b[1;31mhello\x1b[0m wor"))
+	out = append(out, s.Split([]byte("ld\r\nHP:100> "))...)
+	out = append(out, s.Prompt()...)
+	out = append(out, s.Prompt()...)
+
+	want := "\x1b[1;31mhello\x1b[0m world\r\n<hello world>\nHP:100> "
+	if string(out) != want {
+		t.Fatalf("bad output: %q", out)
+	}
+	if len(lines) != 1 || lines[0] != "hello world" {
+		t.Fatalf("bad lines: %q", lines)
+	}
+	if len(prompts) != 1 || prompts[0] != "HP:100> " {
+		t.Fatalf("bad prompts: %q", prompts)
+	}
+}
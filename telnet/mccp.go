@@ -0,0 +1,138 @@
+package telnet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// mccpStart is the subnegotiation which marks start of compressed stream
+//
+//	IAC SB MCCP2 IAC SE: server -> client
+//	IAC SB MCCP3 IAC SE: client -> server
+func mccpStart(opt NVTOption) []byte {
+	return []byte{byte(IAC), byte(SB), opt.Byte(), byte(IAC), byte(SE)}
+}
+
+// mccpReader reads from raw stream and switches to zlib decompression
+// when MCCP2 compression is started by server. It switches back to raw
+// stream when the compressed stream ends.
+type mccpReader struct {
+	raw *bufio.Reader
+	zr  io.ReadCloser
+	z   *bufio.Reader
+	// last is the reader returned the last byte
+	last *bufio.Reader
+}
+
+func newMCCPReader(r io.Reader, size int) *mccpReader {
+	return &mccpReader{
+		raw: bufio.NewReaderSize(r, size),
+	}
+}
+
+// ReadByte implements io.ByteReader
+func (r *mccpReader) ReadByte() (byte, error) {
+	if r.z == nil {
+		r.last = r.raw
+		return r.raw.ReadByte()
+	}
+
+	r.last = r.z
+	b, err := r.z.ReadByte()
+	if err == io.EOF {
+		// compressed stream ended by server, continue with raw stream
+		r.stop()
+		r.last = r.raw
+		return r.raw.ReadByte()
+	}
+	return b, err
+}
+
+// UnreadByte implements io.ByteScanner
+func (r *mccpReader) UnreadByte() error {
+	if r.last == nil {
+		return bufio.ErrInvalidUnreadByte
+	}
+	return r.last.UnreadByte()
+}
+
+// Start will decompress data read after this call
+func (r *mccpReader) Start() error {
+	if r.z != nil {
+		return nil
+	}
+	zr, err := zlib.NewReader(r.raw)
+	if err != nil {
+		return err
+	}
+	r.zr = zr
+	r.z = bufio.NewReaderSize(zr, r.raw.Size())
+
+	return nil
+}
+
+// Compressing report if data is being decompressed
+func (r *mccpReader) Compressing() bool {
+	return r.z != nil
+}
+
+func (r *mccpReader) stop() {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	r.zr = nil
+	r.z = nil
+}
+
+// mccpWriter writes data to w, and compress data written after MCCP3
+// start sequence was sent
+type mccpWriter struct {
+	raw *bufio.Writer
+	zw  *zlib.Writer
+	w   io.Writer
+}
+
+func newMCCPWriter(w io.Writer) *mccpWriter {
+	return &mccpWriter{
+		raw: bufio.NewWriter(w),
+		w:   w,
+	}
+}
+
+// Write will write a complete message, the message which starts MCCP3 must
+// be written alone.
+func (w *mccpWriter) Write(p []byte) (int, error) {
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+
+	n, err := w.raw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if bytes.Equal(p, mccpStart(O_MCCP3)) {
+		if err := w.raw.Flush(); err != nil {
+			return n, err
+		}
+		w.zw = zlib.NewWriter(w.w)
+	}
+	return n, nil
+}
+
+// Flush will send all buffered data to underlying writer
+func (w *mccpWriter) Flush() error {
+	if w.zw != nil {
+		return w.zw.Flush()
+	}
+	return w.raw.Flush()
+}
+
+// Close will end the compressed stream, it does not close underlying writer
+func (w *mccpWriter) Close() error {
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return w.raw.Flush()
+}
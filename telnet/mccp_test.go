@@ -0,0 +1,77 @@
+package telnet
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMCCPReader(t *testing.T) {
+	stream := new(bytes.Buffer)
+	stream.WriteString("plain ")
+	stream.Write(mccpStart(O_MCCP2))
+
+	zw := zlib.NewWriter(stream)
+	zw.Write([]byte{'z', 'i', 'p', byte(IAC), byte(GA), ' '})
+	zw.Close()
+	stream.WriteString("plain again")
+
+	r := newMCCPReader(stream, 16)
+	out := new(bytes.Buffer)
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == byte(IAC) {
+			pkt := &IACPacket{}
+			for b, err = r.ReadByte(); err == nil; b, err = r.ReadByte() {
+				if !pkt.Scan(b) {
+					break
+				}
+			}
+			if pkt.cmd == SB && pkt.opt == O_MCCP2 {
+				if err := r.Start(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out.WriteString("<" + pkt.String() + ">")
+			continue
+		}
+		out.WriteByte(b)
+	}
+
+	want := "plain <IAC SB MCCP2>zip<IAC GA> plain again"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestMCCPWriter(t *testing.T) {
+	conn := new(bytes.Buffer)
+	w := newMCCPWriter(conn)
+
+	w.Write([]byte("hello "))
+	w.Write(mccpStart(O_MCCP3))
+	w.Write([]byte("compressed"))
+	w.Flush()
+
+	prefix := append([]byte("hello "), mccpStart(O_MCCP3)...)
+	if !bytes.HasPrefix(conn.Bytes(), prefix) {
+		t.Fatalf("bad prefix: %v", conn.Bytes())
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(conn.Bytes()[len(prefix):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(zr)
+	if string(data) != "compressed" {
+		t.Fatalf("got %q", data)
+	}
+}
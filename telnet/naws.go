@@ -0,0 +1,61 @@
+package telnet
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// WindowSize is the size of client screen which will be reported to server
+// by NAWS, see RFC 1073
+type WindowSize struct {
+	mu     sync.Mutex
+	width  uint16
+	height uint16
+}
+
+// NewWindowSize create WindowSize with default width and height
+func NewWindowSize(width, height uint16) *WindowSize {
+	return &WindowSize{
+		width:  width,
+		height: height,
+	}
+}
+
+// Get return width and height
+func (w *WindowSize) Get() (uint16, uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.width, w.height
+}
+
+// Set update width and height, it report if size was changed
+func (w *WindowSize) Set(width, height uint16) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.width == width && w.height == height {
+		return false
+	}
+	w.width = width
+	w.height = height
+	return true
+}
+
+// nawsPacket return subnegotiation packet of window size
+//
+//	IAC SB NAWS <width 16bit> <height 16bit> IAC SE
+func nawsPacket(width, height uint16) *IACPacket {
+	p := &IACPacket{
+		cmd: SB,
+		opt: O_NAWS,
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:], width)
+	binary.BigEndian.PutUint16(b[2:], height)
+
+	p.data.Write(escapeIAC(b))
+	p.data.Write([]byte{byte(IAC), byte(SE)})
+
+	return p
+}
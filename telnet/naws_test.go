@@ -0,0 +1,14 @@
+package telnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNAWSPacket(t *testing.T) {
+	p := nawsPacket(255, 40)
+	want := []byte{byte(SB), byte(O_NAWS), 0, 255, 255, 0, 40, byte(IAC), byte(SE)}
+	if !bytes.Equal(p.Bytes(), want) {
+		t.Fatalf("got %v, want %v", p.Bytes(), want)
+	}
+}
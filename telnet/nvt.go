@@ -1,31 +1,19 @@
 package telnet
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 	"time"
-	"unicode/utf8"
 
 	"github.com/defsky/xtelnet/shared"
 )
 
-type TaskType int
-
-const (
-	Timer TaskType = iota
-	Ticker
-)
-
-type TaskHandler func()
-type ScheduleTask struct {
-	ttype   TaskType
-	handler TaskHandler
-}
-type TickTaskMap map[time.Duration][]ScheduleTask
+// CloseHandler is called after connection t is closed
+type CloseHandler func(t *NVT)
 
 // SessionOption contains some options of session
 type SessionOption struct {
@@ -33,12 +21,27 @@ type SessionOption struct {
 	DebugAnsiColor bool
 	DebugIAC       bool
 	GAVisible      bool
+	EscPassThrough bool
 	NVTOptionCfg   *NVTOptionConfig
+	GMCP           *GMCPOption
+	WindowSize     *WindowSize
+	TType          *TTypeOption
+	ClientColors   *ClientColors
+	TLS            *TLSOption
+	Charset        shared.Charset
+	OnLine         LineHandler
+	OnClose        CloseHandler
 }
 
 // Session is a telnet session based on net.Conn
 type NVT struct {
-	wg      sync.WaitGroup
+	wg sync.WaitGroup
+	mu sync.Mutex
+	// state guards closing and running
+	state   sync.Mutex
+	charset shared.Charset
+	// secure is set when connection is over TLS
+	secure  bool
 	Option  *SessionOption
 	host    string
 	port    string
@@ -46,48 +49,86 @@ type NVT struct {
 	closing bool
 	running bool
 
-	inBuffer    chan byte
+	inBuffer    chan inEvent
 	iacInBuffer chan *IACPacket
 	outBuffer   chan []byte
 	out         chan<- []byte
+	// done is closed by Close to stop sender
+	done chan struct{}
+	// charsetDone is signaled when a CHARSET subnegotiation is handled
+	charsetDone chan struct{}
+	// upgrade is request of receiver to start TLS by START_TLS
+	upgrade chan *tlsUpgrade
+
+	ttypeIndex int
 
-	closeTimer chan struct{}
+	charsetRequested bool
 }
 
 // NewSession will return a new session with host and output message to out
 func NewNVT(ch chan<- []byte, host, port string, opt *SessionOption) *NVT {
-	net.LookupHost(host)
-	conn, err := net.DialTimeout("tcp", host+":"+port, 10*time.Second)
+	return DialNVT(ch, DirectDialer, host, port, opt)
+}
+
+// DialNVT is NewNVT connecting server by dialer
+func DialNVT(ch chan<- []byte, dialer Dialer, host, port string, opt *SessionOption) *NVT {
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
 	if err != nil {
 		ch <- []byte(err.Error() + "\n")
 		return nil
 	}
 	ch <- []byte("connection established\n")
 
-	t := &NVT{
-		Option:     opt,
-		host:       host,
-		port:       port,
-		out:        ch,
-		conn:       conn,
-		closeTimer: make(chan struct{}),
+	var tlsCfg TLSConfig
+	if opt.TLS != nil {
+		tlsCfg = opt.TLS.Get()
+	}
+	if tlsCfg.Enabled {
+		if conn, err = clientTLS(ch, conn, host, tlsCfg); err != nil {
+			ch <- []byte(err.Error() + "\n")
+			return nil
+		}
 	}
 
-	t.RunEvery(time.Minute, func() {
-		t.Send([]byte("look\r\n"))
-	})
+	opt.NVTOptionCfg.Reset()
+	// START_TLS is only needed on plain connection
+	opt.NVTOptionCfg.SetSupport(O_START_TLS, tlsCfg.StartTLS && !tlsCfg.Enabled)
 
+	charset := opt.Charset
+	if len(charset) == 0 {
+		charset = shared.GB18030
+	}
+
+	t := &NVT{
+		Option:      opt,
+		host:        host,
+		port:        port,
+		out:         ch,
+		conn:        conn,
+		charset:     charset,
+		secure:      tlsCfg.Enabled,
+		inBuffer:    make(chan inEvent, 4096),
+		iacInBuffer: make(chan *IACPacket, 20),
+		outBuffer:   make(chan []byte, 80),
+		done:        make(chan struct{}),
+		charsetDone: make(chan struct{}, 1),
+		upgrade:     make(chan *tlsUpgrade),
+		running:     true,
+	}
+
+	// server may close connection at once, so state must be set before
+	// receiver starts
 	t.wg.Add(1)
 	go t.receiver()
 
-	t.running = true
-	t.closing = false
-
 	return t
 }
 
 // Close will close session
 func (t *NVT) Close() {
+	t.state.Lock()
+	defer t.state.Unlock()
+
 	if t.closing {
 		return
 	}
@@ -98,18 +139,45 @@ func (t *NVT) Close() {
 	}
 	t.running = false
 
-	close(t.closeTimer)
-	close(t.outBuffer)
+	close(t.done)
 }
 
 // IsAlive
 func (s *NVT) IsAlive() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+
 	return !s.closing
 }
 
+// alive report if data can be sent to server
+func (s *NVT) alive() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	return !s.closing && s.running
+}
+
+// enqueue put data into send buffer, it return false if session is closed
+func (s *NVT) enqueue(data []byte) bool {
+	s.state.Lock()
+	closing := s.closing
+	s.state.Unlock()
+	if closing {
+		return false
+	}
+
+	select {
+	case s.outBuffer <- data:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
 // Send wil send data to session
 func (s *NVT) Send(data []byte) bool {
-	if s.closing || !s.running {
+	if !s.alive() {
 		return false
 	}
 
@@ -117,50 +185,156 @@ func (s *NVT) Send(data []byte) bool {
 		// fmt.Fprint(s.out, string(data))
 		s.out <- data
 	}
-	s.outBuffer <- data
 
-	return true
+	return s.enqueue(data)
 }
 
-// RunAfter wil call f only once when d duration elapsed
-func (s *NVT) RunAfter(d time.Duration, f func()) {
-	timer := time.NewTimer(d)
+// Charset return charset of data transferred on this connection
+func (s *NVT) Charset() shared.Charset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.charset
+}
 
-	s.wg.Add(1)
-	go func(f func()) {
-		defer s.wg.Done()
-		defer timer.Stop()
+// SetCharset change charset of this connection, it takes effect on data
+// received and sent after this call
+func (s *NVT) SetCharset(c shared.Charset) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.charset = c
+}
 
-		select {
-		case <-timer.C:
-			f()
-		case <-s.closeTimer:
-			// close timer
+// SendGMCP will send a GMCP message to server, data will be encoded to json
+func (s *NVT) SendGMCP(pkg string, data interface{}) error {
+	if !s.alive() {
+		return errors.New("no active connection")
+	}
+	if !s.Option.NVTOptionCfg.GetRemote(O_GMCP) {
+		return errors.New("GMCP is not enabled by server")
+	}
+
+	msg, err := NewGMCPMessage(pkg, data)
+	if err != nil {
+		return err
+	}
+	s.sendIAC(gmcpPacket(msg))
+
+	return nil
+}
+
+// sendIAC will send IAC packet p to server
+func (s *NVT) sendIAC(p *IACPacket) {
+	s.enqueue(append([]byte{IAC.Byte()}, p.Bytes()...))
+}
+
+// Negotiate will request to enable or disable option o, cmd must be one of
+// WILL, WONT, DO and DONT
+func (s *NVT) Negotiate(cmd NVTCommand, o NVTOption) error {
+	if !s.alive() {
+		return errors.New("no active connection")
+	}
+
+	cfg := s.Option.NVTOptionCfg
+	var p *IACPacket
+	var err error
+	switch cmd {
+	case WILL:
+		p, err = cfg.RequestLocal(o, true)
+	case WONT:
+		p, err = cfg.RequestLocal(o, false)
+	case DO:
+		p, err = cfg.RequestRemote(o, true)
+	case DONT:
+		p, err = cfg.RequestRemote(o, false)
+	default:
+		return fmt.Errorf("can not negotiate option by %s", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		s.sendIAC(p)
+	}
+	return nil
+}
+
+// onRemoteEnabled is called when option o is enabled on server side
+func (s *NVT) onRemoteEnabled(o NVTOption) {
+	switch o {
+	case O_GMCP:
+		if s.Option.GMCP == nil {
+			return
 		}
+		for _, msg := range s.Option.GMCP.gmcpHello() {
+			s.sendIAC(gmcpPacket(msg))
+		}
+	case O_MCCP3:
+		// compress data sent after this
+		s.enqueue(mccpStart(O_MCCP3))
+	}
+}
 
-	}(f)
+// onLocalEnabled is called when option o is enabled on local side
+func (s *NVT) onLocalEnabled(o NVTOption) {
+	switch o {
+	case O_NAWS:
+		s.SendWindowSize()
+	case O_CHARSET:
+		// server asked us to enable CHARSET, so it expects our request
+		if !s.Option.NVTOptionCfg.GetRemote(O_CHARSET) {
+			s.RequestCharset()
+		}
+	}
 }
 
-// RunEvery will call f periodly when every d duaration elapsed
-func (s *NVT) RunEvery(d time.Duration, f func()) {
-	ticker := time.NewTicker(d)
+// SendWindowSize will report window size to server if NAWS is enabled
+func (s *NVT) SendWindowSize() {
+	if !s.alive() || s.Option.WindowSize == nil {
+		return
+	}
+	if !s.Option.NVTOptionCfg.GetLocal(O_NAWS) {
+		return
+	}
+	s.sendIAC(nawsPacket(s.Option.WindowSize.Get()))
+}
 
-	s.wg.Add(1)
-	go func(f func()) {
-		defer s.wg.Done()
-		defer ticker.Stop()
-	DONE:
-		for {
-			select {
-			case <-ticker.C:
-				f()
-			case <-s.closeTimer:
-				break DONE
-			}
+// handleGMCP parse GMCP subnegotiation and dispatch the message
+func (s *NVT) handleGMCP(pkt *IACPacket) {
+	if s.Option.GMCP == nil || !s.Option.NVTOptionCfg.GetRemote(O_GMCP) {
+		return
+	}
+	msg, err := ParseGMCP(pkt.data.Bytes())
+	if err != nil {
+		if s.Option.DebugIAC {
+			writeBytes(s.inBuffer, []byte(err.Error()+"\r\n"))
 		}
-	}(f)
+		return
+	}
+	s.Option.GMCP.Dispatch(msg)
+}
+
+// inMark is a mark in incoming data
+type inMark int
+
+const (
+	markNone inMark = iota
+	// markPrompt is put by IAC GA or IAC EOR which ends a prompt
+	markPrompt
+	// markCharset switch charset of data after it
+	markCharset
+)
+
+// inEvent is a byte of incoming data or a mark between bytes
+type inEvent struct {
+	b       byte
+	mark    inMark
+	charset shared.Charset
 }
 
+// promptQuietTime is how long an incomplete line must stay before it's
+// taken as prompt, it's only used until server sends IAC GA or IAC EOR
+const promptQuietTime = 500 * time.Millisecond
+
 func (s *NVT) preprocessor() {
 	defer func() {
 		s.Close()
@@ -168,6 +342,9 @@ func (s *NVT) preprocessor() {
 		s.wg.Wait()
 		// fmt.Fprintln(s.out, "Session closed")
 		s.out <- []byte("Session closed\n")
+		if s.Option.OnClose != nil {
+			s.Option.OnClose(s)
+		}
 	}()
 
 	// var w io.Writer
@@ -177,37 +354,74 @@ func (s *NVT) preprocessor() {
 	s.wg.Add(1)
 	go s.sender()
 
+	dec := shared.NewDecoder(s.Charset())
+	lines := newLineSplitter(s.Option.OnLine)
+
+	output := func(msg []byte) {
+		if len(msg) > 0 {
+			s.out <- msg
+		}
+	}
+	flush := func() {
+		if buffer.Len() > 0 {
+			output(lines.Split(dec.Decode(buffer.Bytes())))
+			buffer.Reset()
+		}
+	}
+	switchCharset := func(cs shared.Charset) {
+		if cs == dec.Charset() {
+			return
+		}
+		// flush data of old charset
+		flush()
+		output(lines.Split(dec.Flush()))
+		dec = shared.NewDecoder(cs)
+	}
+	// servers sending GA or EOR mark prompts exactly
+	marked := false
+
 DONE:
 	for {
+		var ev inEvent
+		var ok bool
+
 		select {
-		case b, ok := <-s.inBuffer:
-			if !ok {
-				break DONE
-			}
-			buffer.WriteByte(b)
+		case ev, ok = <-s.inBuffer:
 		default:
-			if buffer.Len() > 0 {
-				msg := shared.DecodeFrom("GB18030", buffer.Bytes())
-				r, _ := utf8.DecodeLastRune(msg)
-				if r != utf8.RuneError {
-					buffer.Reset()
-
-					s.out <- msg
-					break
-				}
+			// no more data for now, output what is received. Charset may
+			// be changed by user.
+			switchCharset(s.Charset())
+			flush()
+
+			var quiet <-chan time.Time
+			if !marked && lines.Pending() {
+				quiet = time.After(promptQuietTime)
 			}
-
-			// wait new incoming data
-			b2, ok := <-s.inBuffer
-			if !ok {
-				break DONE
+			select {
+			case ev, ok = <-s.inBuffer:
+			case <-quiet:
+				output(lines.Prompt())
+				continue
 			}
-			buffer.WriteByte(b2)
+		}
+		if !ok {
+			break DONE
+		}
+
+		switch ev.mark {
+		case markPrompt:
+			marked = true
+			flush()
+			output(lines.Prompt())
+		case markCharset:
+			switchCharset(ev.charset)
+		default:
+			buffer.WriteByte(ev.b)
 		}
 	}
 
-	if buffer.Len() > 0 {
-		msg := shared.DecodeFrom("GB18030", buffer.Bytes())
+	msg := lines.Split(append(dec.Decode(buffer.Bytes()), dec.Flush()...))
+	if len(msg) > 0 {
 		s.out <- msg
 	}
 }
@@ -215,7 +429,8 @@ DONE:
 func (s *NVT) iacprocessor() {
 	defer s.wg.Done()
 
-	reactor := NewIACReactor(s.Option.NVTOptionCfg)
+	cfg := s.Option.NVTOptionCfg
+	reactor := NewIACReactor(cfg)
 DONE:
 	for {
 		select {
@@ -223,26 +438,43 @@ DONE:
 			if !ok {
 				break DONE
 			}
+			local, remote := cfg.GetLocal(pkt.opt), cfg.GetRemote(pkt.opt)
+
 			resp := reactor.React(pkt)
-			if resp != nil && !s.closing {
-				s.outBuffer <- append([]byte{IAC.Byte()}, resp.Bytes()...)
+			if resp != nil {
+				s.sendIAC(resp)
+			}
+
+			if pkt.cmd == SB {
+				switch pkt.opt {
+				case O_TTYPE:
+					s.handleTTYPE(pkt)
+				case O_GMCP:
+					s.handleGMCP(pkt)
+				case O_CHARSET:
+					s.handleCharset(pkt)
+					s.charsetDone <- struct{}{}
+				}
+				continue
+			}
+			if !remote && cfg.GetRemote(pkt.opt) {
+				s.onRemoteEnabled(pkt.opt)
+			}
+			if !local && cfg.GetLocal(pkt.opt) {
+				s.onLocalEnabled(pkt.opt)
 			}
 		}
 	}
 }
 
 func (s *NVT) receiver() {
-	s.inBuffer = make(chan byte, 4096)
-	s.iacInBuffer = make(chan *IACPacket, 20)
-	s.outBuffer = make(chan []byte, 80)
-
 	defer func() {
 		close(s.inBuffer)
 		close(s.iacInBuffer)
 		s.wg.Done()
 	}()
 
-	buf := bufio.NewReaderSize(s.conn, 2048)
+	buf := newMCCPReader(s.conn, 2048)
 
 	var b byte
 	var err error
@@ -272,31 +504,63 @@ DONE:
 				break DONE
 			}
 
+			follows := pkt.cmd == SB && pkt.opt == O_START_TLS &&
+				bytes.Equal(pkt.data.Bytes(), []byte{START_TLS_FOLLOWS})
+
 			s.iacInBuffer <- pkt
+			if follows && s.Option.NVTOptionCfg.GetLocal(O_START_TLS) {
+				// server waits for our handshake after its FOLLOWS, nothing
+				// else can be buffered
+				if buf.Compressing() {
+					err = errors.New("START_TLS in compressed stream")
+					break DONE
+				}
+				conn, e := s.upgradeTLS()
+				if e != nil {
+					err = e
+					break DONE
+				}
+				buf = newMCCPReader(conn, 2048)
+			}
+			if pkt.cmd == SB && pkt.opt == O_CHARSET {
+				// data after it may be in the negotiated charset
+				<-s.charsetDone
+			}
+			if pkt.cmd == SB && pkt.opt == O_MCCP2 && s.Option.NVTOptionCfg.GetRemote(O_MCCP2) {
+				if e := buf.Start(); e != nil {
+					err = e
+					break DONE
+				}
+			}
 			if s.Option.DebugIAC {
 				writeBytes(s.inBuffer, []byte(pkt.String()+"\r\n"))
 			}
 			if pkt.cmd == GA && s.Option.GAVisible {
 				writeBytes(s.inBuffer, []byte("\r\n<IAC GA>\r\n"))
 			}
+			if pkt.cmd == GA || pkt.cmd == EOR {
+				s.inBuffer <- inEvent{mark: markPrompt}
+			}
 
 			continue
 		}
 
 		// escape sequence
 		if b == byte(0x1b) {
-			data, e := readEscSeq(buf)
+			seq, ctrl, e := ReadEscSeq(buf)
+			writeBytes(s.inBuffer, ctrl)
 			if e != nil {
 				err = e
 				break DONE
 			}
-			s.inBuffer <- b
-			writeBytes(s.inBuffer, data)
+			if seq != nil {
+				writeBytes(s.inBuffer, s.renderEscSeq(seq))
+			}
 
 			continue
 		}
 
-		s.inBuffer <- b
+		s.inBuffer <- inEvent{b: b}
 	}
 
 	writeBytes(s.inBuffer, handleConnError(err))
@@ -305,24 +569,22 @@ DONE:
 func (s *NVT) sender() {
 	defer s.wg.Done()
 
-	writer := bufio.NewWriter(s.conn)
-
-DONE:
-	for {
-		data, ok := <-s.outBuffer
-		if !ok {
-			s.conn.Close()
-			break DONE
-		}
+	conn := s.conn
+	writer := newMCCPWriter(conn)
+	defer func() {
+		writer.Close()
+		conn.Close()
+	}()
 
+	write := func(data []byte) {
 		if data[0] != byte(IAC) {
-			data = shared.EncodeTo("GB18030", data)
+			data = shared.EncodeTo(s.Charset(), data)
 		}
 
 		_, err := writer.Write(data)
 		if err != nil {
 			writeBytes(s.inBuffer, []byte(err.Error()+"\n"))
-			continue
+			return
 		}
 
 		err = writer.Flush()
@@ -330,12 +592,85 @@ DONE:
 			writeBytes(s.inBuffer, []byte(err.Error()+"\n"))
 		}
 	}
+
+	// startTLS answer START_TLS FOLLOWS and start TLS on connection
+	startTLS := func(u *tlsUpgrade) {
+		defer close(u.done)
+
+		if writer.zw != nil {
+			u.err = errors.New("START_TLS in compressed stream")
+			return
+		}
+		if _, u.err = writer.Write(startTLSFollows()); u.err != nil {
+			return
+		}
+		if u.err = writer.Flush(); u.err != nil {
+			return
+		}
+		var cfg TLSConfig
+		if s.Option.TLS != nil {
+			cfg = s.Option.TLS.Get()
+		}
+		tc, err := clientTLS(s.out, conn, s.host, cfg)
+		if err != nil {
+			u.err = err
+			return
+		}
+		conn, u.conn = tc, tc
+		writer = newMCCPWriter(conn)
+		s.setSecure()
+	}
+
+	for {
+		select {
+		case data := <-s.outBuffer:
+			write(data)
+		case u := <-s.upgrade:
+			startTLS(u)
+		case <-s.done:
+			// flush data queued before close
+			for {
+				select {
+				case data := <-s.outBuffer:
+					write(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// renderEscSeq return data should be output for seq, SGR is passed through,
+// sequences can not be displayed are stripped unless EscPassThrough is set
+func (s *NVT) renderEscSeq(seq *EscSeq) []byte {
+	switch seq.Type {
+	case ESC_SGR:
+		return seq.Raw
+	case ESC_CURSOR:
+		switch seq.Final {
+		case 'C':
+			// cursor forward is used as spaces by some servers
+			n := seq.Param(0, 1)
+			if n > 256 {
+				n = 256
+			}
+			return bytes.Repeat([]byte{' '}, n)
+		case 'E':
+			return []byte("\r\n")
+		}
+	}
+
+	if s.Option.EscPassThrough {
+		return seq.Raw
+	}
+	return nil
 }
 
 // writeBytes will write p into channel out byte by byte
-func writeBytes(out chan<- byte, p []byte) {
+func writeBytes(out chan<- inEvent, p []byte) {
 	for _, v := range p {
-		out <- v
+		out <- inEvent{b: v}
 	}
 }
 
@@ -347,24 +682,3 @@ func handleConnError(err error) []byte {
 		return []byte(fmt.Sprintf("\n%s\n", err.Error()))
 	}
 }
-
-// readEscSeq will read a complete ansi escape sequence from inbuffer
-func readEscSeq(r *bufio.Reader) ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	var b byte
-	var err error
-DONE:
-	for b, err = r.ReadByte(); err == nil; b, err = r.ReadByte() {
-		buf.WriteByte(b)
-
-		if b == byte('m') || b == byte('\n') {
-			break DONE
-		}
-	}
-
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
@@ -0,0 +1,65 @@
+package telnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/shared"
+)
+
+func TestPromptByGA(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// a line sent in pieces is not a prompt
+		conn.Write([]byte("hel"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("lo\r\nHP:100> "))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte{byte(IAC), byte(GA)})
+		time.Sleep(time.Second)
+	}()
+
+	type line struct {
+		text   string
+		prompt bool
+	}
+	lines := make(chan line, 10)
+	opt := &SessionOption{
+		NVTOptionCfg: NewNVTOptionConfig(),
+		Charset:      shared.UTF8,
+		OnLine: func(text string, prompt bool) []byte {
+			lines <- line{text, prompt}
+			return nil
+		},
+	}
+	out := make(chan []byte, 100)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := NewNVT(out, "127.0.0.1", port, opt)
+	if s == nil {
+		t.Fatal(string(<-out))
+	}
+	defer s.Close()
+
+	for _, want := range []line{{"hello", false}, {"HP:100> ", true}} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %+v", want)
+		}
+	}
+}
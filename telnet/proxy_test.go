@@ -0,0 +1,210 @@
+package telnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/shared"
+)
+
+// startTarget start a server writing greeting to every connection
+func startTarget(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("greeting\r\n"))
+			go func() {
+				time.Sleep(time.Second)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// startProxy start a proxy stand-in running handshake on every connection,
+// it relays data between client and the address returned by handshake
+func startProxy(t *testing.T, handshake func(net.Conn, *bufio.Reader) string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				addr := handshake(conn, r)
+				if len(addr) == 0 {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+// socks5Handshake accept user "u" with password "p" and CONNECT command
+func socks5Handshake(conn net.Conn, r *bufio.Reader) string {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return ""
+	}
+	io.ReadFull(r, make([]byte, head[1]))
+	conn.Write([]byte{socks5Version, socks5UserPass})
+
+	// VER ULEN UNAME PLEN PASSWD
+	io.ReadFull(r, head)
+	user := make([]byte, head[1])
+	io.ReadFull(r, user)
+	n, _ := r.ReadByte()
+	pass := make([]byte, n)
+	io.ReadFull(r, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		conn.Write([]byte{socks5AuthVersion, 1})
+		return ""
+	}
+	conn.Write([]byte{socks5AuthVersion, 0})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[3] != socks5AddrDomain {
+		return ""
+	}
+	n, _ = r.ReadByte()
+	host := make([]byte, n)
+	io.ReadFull(r, host)
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	if string(host) != "localhost" {
+		return ""
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// httpHandshake accept CONNECT with basic authorization of "u:p"
+func httpHandshake(conn net.Conn, r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return ""
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return ""
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	_, port, _ := net.SplitHostPort(req.Host)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func TestProxyDialer(t *testing.T) {
+	target := startTarget(t)
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	for scheme, handshake := range map[string]func(net.Conn, *bufio.Reader) string{
+		"socks5": socks5Handshake,
+		"http":   httpHandshake,
+	} {
+		ln := startProxy(t, handshake)
+		defer ln.Close()
+
+		u, err := ParseProxyURL(scheme + "://u:p@" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := NewProxyDialer(u, DirectDialer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := make(chan string, 10)
+		opt := &SessionOption{
+			NVTOptionCfg: NewNVTOptionConfig(),
+			Charset:      shared.UTF8,
+			OnLine: func(text string, prompt bool) []byte {
+				lines <- text
+				return nil
+			},
+		}
+		out := make(chan []byte, 100)
+		s := DialNVT(out, d, "localhost", port, opt)
+		if s == nil {
+			t.Fatalf("%s: %s", scheme, <-out)
+		}
+		waitLine(t, lines, "greeting")
+		s.Close()
+
+		// wrong password is refused
+		u.User = url.UserPassword("u", "x")
+		d, _ = NewProxyDialer(u, DirectDialer)
+		if conn, err := d.Dial("tcp", net.JoinHostPort("localhost", port)); err == nil {
+			conn.Close()
+			t.Fatalf("%s: want error for wrong password", scheme)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	if u, err := ProxyFromEnvironment("mud.org"); u != nil || err != nil {
+		t.Fatalf("got %v, %v without proxy", u, err)
+	}
+	os.Setenv("https_proxy", "proxy.local:3128")
+	os.Setenv("ALL_PROXY", "socks5://proxy.local")
+	u, err := ProxyFromEnvironment("mud.org")
+	if err != nil || u.String() != "socks5://proxy.local" {
+		t.Fatalf("got %v, %v", u, err)
+	}
+	os.Unsetenv("ALL_PROXY")
+	u, err = ProxyFromEnvironment("mud.org")
+	if err != nil || u.String() != "http://proxy.local:3128" {
+		t.Fatalf("got %v, %v", u, err)
+	}
+
+	os.Setenv("NO_PROXY", "internal, .mud.org")
+	for _, host := range []string{"127.0.0.1", "localhost", "internal", "mud.org", "game.mud.org"} {
+		if u, _ := ProxyFromEnvironment(host); u != nil {
+			t.Fatalf("%s is not connected directly", host)
+		}
+	}
+	if u, _ := ProxyFromEnvironment("amud.org"); u == nil {
+		t.Fatal("amud.org is connected directly")
+	}
+
+	os.Setenv("ALL_PROXY", "ftp://proxy.local")
+	if _, err := ProxyFromEnvironment("amud.org"); err == nil {
+		t.Fatal("want error for unsupported proxy")
+	}
+}
@@ -0,0 +1,151 @@
+package telnet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// QState is the state of an option on one side of connection, see RFC 1143
+type QState int
+
+const (
+	Q_NO QState = iota
+	Q_YES
+	Q_WANTNO
+	Q_WANTYES
+)
+
+func (q QState) String() string {
+	switch q {
+	case Q_NO:
+		return "NO"
+	case Q_YES:
+		return "YES"
+	case Q_WANTNO:
+		return "WANTNO"
+	case Q_WANTYES:
+		return "WANTYES"
+	}
+	return fmt.Sprintf("QState(%d)", int(q))
+}
+
+var (
+	EOptionEnabled     = errors.New("option already enabled")
+	EOptionDisabled    = errors.New("option already disabled")
+	EOptionNegotiating = errors.New("option already negotiating")
+	EOptionQueued      = errors.New("option request already queued")
+)
+
+// qOption is the negotiation state of an option, "us" is local side and
+// "him" is server side. Queue bit true means OPPOSITE, false means EMPTY.
+type qOption struct {
+	us   QState
+	usq  bool
+	him  QState
+	himq bool
+}
+
+// receiveEnable handle WILL on server side or DO on local side,
+// it return the command should be replied, nil if nothing need to reply
+func receiveEnable(state *QState, queue *bool, accept bool, yes, no NVTCommand) NVTCommand {
+	switch *state {
+	case Q_NO:
+		if accept {
+			*state = Q_YES
+			return yes
+		}
+		return no
+	case Q_YES:
+		// already enabled, ignore
+	case Q_WANTNO:
+		if *queue {
+			*state = Q_YES
+			*queue = false
+		} else {
+			// error: DONT answered by WILL
+			*state = Q_NO
+		}
+	case Q_WANTYES:
+		if *queue {
+			*state = Q_WANTNO
+			*queue = false
+			return no
+		}
+		*state = Q_YES
+	}
+	return nil
+}
+
+// receiveDisable handle WONT on server side or DONT on local side
+func receiveDisable(state *QState, queue *bool, yes, no NVTCommand) NVTCommand {
+	switch *state {
+	case Q_NO:
+		// already disabled, ignore
+	case Q_YES:
+		*state = Q_NO
+		return no
+	case Q_WANTNO:
+		if *queue {
+			*state = Q_WANTYES
+			*queue = false
+			return yes
+		}
+		*state = Q_NO
+	case Q_WANTYES:
+		*state = Q_NO
+		*queue = false
+	}
+	return nil
+}
+
+// requestEnable ask the other side to enable option
+func requestEnable(state *QState, queue *bool, yes NVTCommand) (NVTCommand, error) {
+	switch *state {
+	case Q_NO:
+		*state = Q_WANTYES
+		return yes, nil
+	case Q_YES:
+		return nil, EOptionEnabled
+	case Q_WANTNO:
+		if *queue {
+			return nil, EOptionQueued
+		}
+		*queue = true
+	case Q_WANTYES:
+		if !*queue {
+			return nil, EOptionNegotiating
+		}
+		*queue = false
+	}
+	return nil, nil
+}
+
+// requestDisable ask the other side to disable option
+func requestDisable(state *QState, queue *bool, no NVTCommand) (NVTCommand, error) {
+	switch *state {
+	case Q_NO:
+		return nil, EOptionDisabled
+	case Q_YES:
+		*state = Q_WANTNO
+		return no, nil
+	case Q_WANTNO:
+		if !*queue {
+			return nil, EOptionNegotiating
+		}
+		*queue = false
+	case Q_WANTYES:
+		if *queue {
+			return nil, EOptionQueued
+		}
+		*queue = true
+	}
+	return nil, nil
+}
+
+// negotiation return packet of cmd for option o, nil if cmd is nil
+func negotiation(cmd NVTCommand, o NVTOption) *IACPacket {
+	if cmd == nil {
+		return nil
+	}
+	return &IACPacket{cmd: cmd, opt: o}
+}
@@ -0,0 +1,67 @@
+package telnet
+
+import "testing"
+
+func TestQMethodNegotiation(t *testing.T) {
+	cfg := NewNVTOptionConfig()
+	r := NewIACReactor(cfg)
+
+	// accepted option
+	resp := r.React(&IACPacket{cmd: WILL, opt: O_GMCP})
+	if resp == nil || resp.cmd != DO || !cfg.GetRemote(O_GMCP) {
+		t.Fatalf("WILL GMCP: got %v", resp)
+	}
+	// repeated WILL must not be answered, this breaks negotiation loops
+	if resp := r.React(&IACPacket{cmd: WILL, opt: O_GMCP}); resp != nil {
+		t.Fatalf("repeated WILL GMCP: got %v", resp)
+	}
+
+	// refused option
+	resp = r.React(&IACPacket{cmd: WILL, opt: O_MXP})
+	if resp == nil || resp.cmd != DONT || cfg.GetRemote(O_MXP) {
+		t.Fatalf("WILL MXP: got %v", resp)
+	}
+	resp = r.React(&IACPacket{cmd: DO, opt: O_ECHO})
+	if resp == nil || resp.cmd != WONT || cfg.GetLocal(O_ECHO) {
+		t.Fatalf("DO ECHO: got %v", resp)
+	}
+
+	// WONT on enabled option
+	resp = r.React(&IACPacket{cmd: WONT, opt: O_GMCP})
+	if resp == nil || resp.cmd != DONT || cfg.GetRemote(O_GMCP) {
+		t.Fatalf("WONT GMCP: got %v", resp)
+	}
+}
+
+func TestQMethodRequest(t *testing.T) {
+	cfg := NewNVTOptionConfig()
+	r := NewIACReactor(cfg)
+
+	p, err := cfg.RequestLocal(O_NAWS, true)
+	if err != nil || p == nil || p.cmd != WILL {
+		t.Fatalf("request WILL NAWS: %v %v", p, err)
+	}
+	if _, err := cfg.RequestLocal(O_NAWS, true); err != EOptionNegotiating {
+		t.Fatalf("want EOptionNegotiating, got %v", err)
+	}
+
+	// queue disable while waiting for answer
+	if p, err := cfg.RequestLocal(O_NAWS, false); err != nil || p != nil {
+		t.Fatalf("queue WONT NAWS: %v %v", p, err)
+	}
+	// server agree, queued request must be sent
+	resp := r.React(&IACPacket{cmd: DO, opt: O_NAWS})
+	if resp == nil || resp.cmd != WONT || cfg.GetLocal(O_NAWS) {
+		t.Fatalf("DO NAWS: got %v", resp)
+	}
+	if resp := r.React(&IACPacket{cmd: DONT, opt: O_NAWS}); resp != nil {
+		t.Fatalf("DONT NAWS: got %v", resp)
+	}
+	if st := cfg.Status(); len(st) != 1 || st[0].Local != Q_NO {
+		t.Fatalf("bad status: %v", st)
+	}
+
+	if _, err := cfg.RequestRemote(O_ECHO, false); err != EOptionDisabled {
+		t.Fatalf("want EOptionDisabled, got %v", err)
+	}
+}
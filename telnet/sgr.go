@@ -0,0 +1,183 @@
+package telnet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BasicColorName are tcell names of the 16 basic colors, they are drawn by
+// palette of terminal
+var BasicColorName = [16]string{
+	"black", "maroon", "green", "olive", "navy", "purple", "teal", "silver",
+	"gray", "red", "lime", "yellow", "blue", "fuchsia", "aqua", "white",
+}
+
+// xterm256 return rgb value of xterm color n in range 16-255
+func xterm256(n int) (int, int, int) {
+	if n >= 232 {
+		v := 8 + (n-232)*10
+		return v, v, v
+	}
+	n -= 16
+	level := func(v int) int {
+		if v == 0 {
+			return 0
+		}
+		return 55 + v*40
+	}
+	return level(n / 36), level((n / 6) % 6), level(n % 6)
+}
+
+// nearestXterm256 return the nearest color in range 16-255 of rgb
+func nearestXterm256(r, g, b int) int {
+	best, bestDist := 16, -1
+	for n := 16; n < 256; n++ {
+		r2, g2, b2 := xterm256(n)
+		d := (r-r2)*(r-r2) + (g-g2)*(g-g2) + (b-b2)*(b-b2)
+		if bestDist < 0 || d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	return best
+}
+
+func hexColor(r, g, b int) string {
+	return fmt.Sprintf("#%02x%02x%02x", r&0xff, g&0xff, b&0xff)
+}
+
+// SGRStyle is the graphic rendition state changed by SGR sequences, colors
+// are names in BasicColorName or "#rrggbb", empty for default color
+type SGRStyle struct {
+	Fg, Bg    string
+	Bold      bool
+	Dim       bool
+	Italic    bool
+	Underline bool
+	Blink     bool
+	Reverse   bool
+}
+
+// Apply update style by SGR parameters, parameters may have sub parameters
+// separated by ':', like 38:2::255:0:0. 24-bit colors are replaced by the
+// nearest xterm 256 color if truecolor is false.
+func (s *SGRStyle) Apply(params string, truecolor bool) {
+	fields := strings.Split(params, ";")
+	for i := 0; i < len(fields); i++ {
+		sub := strings.Split(fields[i], ":")
+		code, _ := strconv.Atoi(sub[0])
+
+		switch {
+		case code == 0:
+			*s = SGRStyle{}
+		case code == 1:
+			s.Bold = true
+		case code == 2:
+			s.Dim = true
+		case code == 3:
+			s.Italic = true
+		case code == 4:
+			s.Underline = len(sub) < 2 || sub[1] != "0"
+		case code == 5 || code == 6:
+			s.Blink = true
+		case code == 7:
+			s.Reverse = true
+		case code == 21:
+			s.Underline = true
+		case code == 22:
+			s.Bold = false
+			s.Dim = false
+		case code == 23:
+			s.Italic = false
+		case code == 24:
+			s.Underline = false
+		case code == 25:
+			s.Blink = false
+		case code == 27:
+			s.Reverse = false
+		case code >= 30 && code <= 37:
+			s.Fg = BasicColorName[code-30]
+		case code == 39:
+			s.Fg = ""
+		case code >= 40 && code <= 47:
+			s.Bg = BasicColorName[code-40]
+		case code == 49:
+			s.Bg = ""
+		case code >= 90 && code <= 97:
+			s.Fg = BasicColorName[code-90+8]
+		case code >= 100 && code <= 107:
+			s.Bg = BasicColorName[code-100+8]
+		case code == 38 || code == 48:
+			var color string
+			if len(sub) > 1 {
+				color = extendedColor(sub[1:], truecolor)
+			} else {
+				var n int
+				color, n = extendedColorFields(fields[i+1:], truecolor)
+				i += n
+			}
+			if len(color) == 0 {
+				continue
+			}
+			if code == 38 {
+				s.Fg = color
+			} else {
+				s.Bg = color
+			}
+		}
+	}
+}
+
+// extendedColorFields parse color of 38 and 48 from following parameters
+// separated by ';', it return the color and count of parameters used
+func extendedColorFields(fields []string, truecolor bool) (string, int) {
+	if len(fields) == 0 {
+		return "", 0
+	}
+	switch fields[0] {
+	case "5":
+		if len(fields) < 2 {
+			return "", len(fields)
+		}
+		return extendedColor(fields[:2], truecolor), 2
+	case "2":
+		if len(fields) < 4 {
+			return "", len(fields)
+		}
+		return extendedColor(fields[:4], truecolor), 4
+	}
+	return "", 1
+}
+
+// extendedColor return color of "5 n" or "2 [colorspace] r g b"
+func extendedColor(args []string, truecolor bool) string {
+	v := make([]int, len(args))
+	for i, s := range args {
+		v[i], _ = strconv.Atoi(s)
+	}
+
+	switch v[0] {
+	case 5:
+		if len(v) < 2 || v[1] < 0 || v[1] > 255 {
+			return ""
+		}
+		if v[1] < 16 {
+			return BasicColorName[v[1]]
+		}
+		return hexColor(xterm256(v[1]))
+	case 2:
+		if len(v) > 4 {
+			// skip color space id
+			v = v[len(v)-4:]
+		}
+		if len(v) < 4 {
+			return ""
+		}
+		r, g, b := v[1], v[2], v[3]
+		if truecolor {
+			return hexColor(r, g, b)
+		}
+		return hexColor(xterm256(nearestXterm256(r, g, b)))
+	}
+	return ""
+}
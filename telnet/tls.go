@@ -0,0 +1,185 @@
+package telnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// START_TLS_FOLLOWS is the only subnegotiation of START_TLS, see
+// draft-altman-telnet-starttls
+//
+//	IAC SB START_TLS FOLLOWS IAC SE
+const START_TLS_FOLLOWS byte = 1
+
+// tlsHandshakeTimeout is the max time of TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig is the TLS settings of connection
+type TLSConfig struct {
+	// Enabled wraps connection in TLS at once after it's established
+	Enabled bool
+	// CAFile is PEM bundle of CA certificates used to verify server instead
+	// of the system pool
+	CAFile string
+	// CertFile and KeyFile are PEM files of client certificate
+	CertFile string
+	KeyFile  string
+	// Insecure skips verification of server certificate
+	Insecure bool
+	// StartTLS accepts START_TLS offered by server on plain connection
+	StartTLS bool
+}
+
+// ClientConfig return tls.Config to connect host
+func (c TLSConfig) ClientConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: c.Insecure,
+	}
+	if len(c.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+			return nil, errors.New("both certificate and key of client are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// TLSOption holds TLS settings of connection, it's safe for concurrent use
+type TLSOption struct {
+	mu  sync.Mutex
+	cfg TLSConfig
+}
+
+// NewTLSOption return TLSOption which only accepts START_TLS
+func NewTLSOption() *TLSOption {
+	return &TLSOption{
+		cfg: TLSConfig{StartTLS: true},
+	}
+}
+
+// Get return TLS settings
+func (o *TLSOption) Get() TLSConfig {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.cfg
+}
+
+// Set replace TLS settings, it takes effect on next connection
+func (o *TLSOption) Set(c TLSConfig) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cfg = c
+}
+
+// clientTLS start TLS on conn as client and report result to out, conn is
+// closed on error
+func clientTLS(out chan<- []byte, conn net.Conn, host string, c TLSConfig) (net.Conn, error) {
+	cfg, err := c.ClientConfig(host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.Insecure {
+		out <- []byte("[red]WARNING: certificate of server is NOT verified, the connection may be intercepted![-]\n")
+	}
+
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %s", err.Error())
+	}
+	tc.SetDeadline(time.Time{})
+
+	out <- []byte(tlsSummary(tc.ConnectionState()) + "\n")
+	return tc, nil
+}
+
+// tlsVersionName is name of TLS versions
+var tlsVersionName = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsSummary describe protocol version and server certificate of state
+func tlsSummary(state tls.ConnectionState) string {
+	version, ok := tlsVersionName[state.Version]
+	if !ok {
+		version = fmt.Sprintf("TLS 0x%04x", state.Version)
+	}
+	if len(state.PeerCertificates) == 0 {
+		return version + " established"
+	}
+
+	cert := state.PeerCertificates[0]
+	subject := cert.Subject.CommonName
+	if len(cert.DNSNames) > 0 {
+		subject = strings.Join(cert.DNSNames, ",")
+	}
+	return fmt.Sprintf("%s established, certificate of %s issued by %s, valid until %s",
+		version, subject, cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+}
+
+// startTLSFollows return the subnegotiation which starts TLS
+func startTLSFollows() []byte {
+	return []byte{byte(IAC), byte(SB), O_START_TLS.Byte(), START_TLS_FOLLOWS, byte(IAC), byte(SE)}
+}
+
+// tlsUpgrade is a request to sender for starting TLS on connection, conn
+// or err is set before done is closed
+type tlsUpgrade struct {
+	conn net.Conn
+	err  error
+	done chan struct{}
+}
+
+// upgradeTLS ask sender to answer START_TLS FOLLOWS and start TLS, it
+// return the new connection data must be read from
+func (s *NVT) upgradeTLS() (net.Conn, error) {
+	u := &tlsUpgrade{done: make(chan struct{})}
+	select {
+	case s.upgrade <- u:
+	case <-s.done:
+		return nil, errors.New("session closed")
+	}
+	<-u.done
+	return u.conn, u.err
+}
+
+// Secure report if data is transferred over TLS
+func (s *NVT) Secure() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secure
+}
+
+func (s *NVT) setSecure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secure = true
+}
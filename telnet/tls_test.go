@@ -0,0 +1,197 @@
+package telnet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/defsky/xtelnet/shared"
+)
+
+// testCert create a self-signed certificate of 127.0.0.1, it return the
+// certificate and file of its PEM
+func testCert(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xtelnet test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fname := filepath.Join(dir, "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(fname, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, fname
+}
+
+// dialTest connect NVT to ln with TLS settings c, it return lines received
+func dialTest(t *testing.T, ln net.Listener, c TLSConfig) (*NVT, chan string, chan []byte) {
+	lines := make(chan string, 10)
+	tlsOpt := NewTLSOption()
+	tlsOpt.Set(c)
+	opt := &SessionOption{
+		NVTOptionCfg: NewNVTOptionConfig(),
+		Charset:      shared.UTF8,
+		TLS:          tlsOpt,
+		OnLine: func(text string, prompt bool) []byte {
+			lines <- text
+			return nil
+		},
+	}
+	out := make(chan []byte, 100)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return NewNVT(out, "127.0.0.1", port, opt), lines, out
+}
+
+func waitLine(t *testing.T, lines chan string, want string) {
+	select {
+	case got := <-lines:
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %q", want)
+	}
+}
+
+func TestTLSConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, ca := testCert(t, dir)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("welcome\r\n"))
+			go func() {
+				time.Sleep(time.Second)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// certificate of unknown CA is refused
+	s, _, out := dialTest(t, ln, TLSConfig{Enabled: true})
+	if s != nil {
+		s.Close()
+		t.Fatal("want error for unknown CA")
+	}
+	<-out
+	if msg := string(<-out); !strings.Contains(msg, "TLS handshake") {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+
+	s, lines, out := dialTest(t, ln, TLSConfig{Enabled: true, CAFile: ca})
+	if s == nil {
+		<-out
+		t.Fatal(string(<-out))
+	}
+	defer s.Close()
+	waitLine(t, lines, "welcome")
+	if !s.Secure() {
+		t.Fatal("connection is not secure")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xtelnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, ca := testCert(t, dir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("plain\r\n"))
+		conn.Write([]byte{byte(IAC), byte(DO), O_START_TLS.Byte()})
+		want := []byte{byte(IAC), byte(WILL), O_START_TLS.Byte()}
+		got := make([]byte, len(want))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(got); err != nil || string(got) != string(want) {
+			errCh <- err
+			return
+		}
+		conn.Write(startTLSFollows())
+		got = make([]byte, len(startTLSFollows()))
+		if _, err := conn.Read(got); err != nil || string(got) != string(startTLSFollows()) {
+			errCh <- err
+			return
+		}
+
+		tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tc.Handshake(); err != nil {
+			errCh <- err
+			return
+		}
+		tc.Write([]byte("secret\r\n"))
+		errCh <- nil
+		time.Sleep(time.Second)
+	}()
+
+	s, lines, out := dialTest(t, ln, TLSConfig{CAFile: ca, StartTLS: true})
+	if s == nil {
+		t.Fatal(string(<-out))
+	}
+	defer s.Close()
+
+	waitLine(t, lines, "plain")
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	waitLine(t, lines, "secret")
+	if !s.Secure() {
+		t.Fatal("connection is not secure")
+	}
+}
@@ -0,0 +1,229 @@
+package telnet
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TTYPE_IS   byte = 0
+	TTYPE_SEND byte = 1
+)
+
+// MTTSFlag is capability bit of MUD Terminal Type Standard
+type MTTSFlag int
+
+const (
+	MTTS_ANSI MTTSFlag = 1 << iota
+	MTTS_VT100
+	MTTS_UTF8
+	MTTS_256COLORS
+	MTTS_MOUSE
+	MTTS_OSC_COLOR
+	MTTS_SCREEN_READER
+	MTTS_PROXY
+	MTTS_TRUECOLOR
+	MTTS_MNES
+	MTTS_MSLP
+	MTTS_SSL
+)
+
+var mttsFlagName = []struct {
+	flag MTTSFlag
+	name string
+}{
+	{MTTS_ANSI, "ansi"},
+	{MTTS_VT100, "vt100"},
+	{MTTS_UTF8, "utf8"},
+	{MTTS_256COLORS, "256colors"},
+	{MTTS_MOUSE, "mouse"},
+	{MTTS_OSC_COLOR, "osccolor"},
+	{MTTS_SCREEN_READER, "screenreader"},
+	{MTTS_PROXY, "proxy"},
+	{MTTS_TRUECOLOR, "truecolor"},
+	{MTTS_MNES, "mnes"},
+	{MTTS_MSLP, "mslp"},
+	{MTTS_SSL, "tls"},
+}
+
+// mttsColors are capabilities limited by colors of attached client
+const mttsColors = MTTS_256COLORS | MTTS_TRUECOLOR
+
+// ParseMTTSFlag return flag by name, name is case insensitive
+func ParseMTTSFlag(name string) (MTTSFlag, bool) {
+	for _, v := range mttsFlagName {
+		if strings.EqualFold(v.name, name) {
+			return v.flag, true
+		}
+	}
+	return 0, false
+}
+
+func (f MTTSFlag) String() string {
+	names := []string{}
+	for _, v := range mttsFlagName {
+		if f&v.flag != 0 {
+			names = append(names, v.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// TTypeOption is the identity reported to server by TTYPE
+type TTypeOption struct {
+	mu           sync.Mutex
+	clientName   string
+	terminalType string
+	capabilities MTTSFlag
+}
+
+// NewTTypeOption return TTypeOption with default identity
+func NewTTypeOption() *TTypeOption {
+	return &TTypeOption{
+		clientName:   strings.ToUpper(ClientName),
+		terminalType: "XTERM-256COLOR",
+		capabilities: MTTS_ANSI | MTTS_VT100 | MTTS_256COLORS | MTTS_TRUECOLOR,
+	}
+}
+
+// Identity return client name and terminal type
+func (o *TTypeOption) Identity() (string, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.clientName, o.terminalType
+}
+
+// SetIdentity set client name and terminal type, empty value is ignored
+func (o *TTypeOption) SetIdentity(name, term string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(name) > 0 {
+		o.clientName = name
+	}
+	if len(term) > 0 {
+		o.terminalType = strings.ToUpper(term)
+	}
+}
+
+// Capabilities return configured MTTS capabilities
+func (o *TTypeOption) Capabilities() MTTSFlag {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.capabilities
+}
+
+// SetCapabilities replace configured MTTS capabilities with f
+func (o *TTypeOption) SetCapabilities(f MTTSFlag) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.capabilities = f
+}
+
+// SetCapability enable or disable capability f
+func (o *TTypeOption) SetCapability(f MTTSFlag, v bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if v {
+		o.capabilities |= f
+	} else {
+		o.capabilities &^= f
+	}
+}
+
+// cycle return responses of TTYPE SEND in order: client name, terminal type
+// and MTTS bitvector
+func (o *TTypeOption) cycle(caps MTTSFlag) []string {
+	name, term := o.Identity()
+	return []string{
+		name,
+		term,
+		"MTTS " + strconv.Itoa(int(caps)),
+	}
+}
+
+// ttypePacket return TTYPE IS subnegotiation
+//
+//	IAC SB TTYPE IS <name> IAC SE
+func ttypePacket(name string) *IACPacket {
+	p := &IACPacket{
+		cmd: SB,
+		opt: O_TTYPE,
+	}
+	p.data.WriteByte(TTYPE_IS)
+	p.data.Write(escapeIAC([]byte(name)))
+	p.data.Write([]byte{byte(IAC), byte(SE)})
+
+	return p
+}
+
+// handleTTYPE answer TTYPE SEND, the last value is repeated to mark end of
+// cycle, then the cycle starts over
+func (s *NVT) handleTTYPE(pkt *IACPacket) {
+	subopt, err := pkt.data.ReadByte()
+	if err != nil || subopt != TTYPE_SEND {
+		return
+	}
+	if s.Option.TType == nil {
+		s.sendIAC(ttypePacket(strings.ToUpper(ClientName)))
+		return
+	}
+
+	cycle := s.Option.TType.cycle(s.mtts())
+	if s.ttypeIndex >= len(cycle) {
+		s.ttypeIndex = 0
+		s.sendIAC(ttypePacket(cycle[len(cycle)-1]))
+		return
+	}
+	s.sendIAC(ttypePacket(cycle[s.ttypeIndex]))
+	s.ttypeIndex++
+}
+
+// mtts return MTTS capabilities of this connection, colors not supported
+// by attached client are not reported
+func (s *NVT) mtts() MTTSFlag {
+	caps := s.Option.TType.Capabilities()
+	if s.Charset().IsUTF8() {
+		caps |= MTTS_UTF8
+	}
+	if s.Secure() {
+		caps |= MTTS_SSL
+	}
+	if s.Option.ClientColors != nil {
+		if colors, ok := s.Option.ClientColors.Get(); ok {
+			caps &^= mttsColors &^ colors
+		}
+	}
+	return caps
+}
+
+// ClientColors is the colors supported by attached client
+type ClientColors struct {
+	mu     sync.Mutex
+	colors MTTSFlag
+	known  bool
+}
+
+// NewClientColors create ClientColors unknown until Set
+func NewClientColors() *ClientColors {
+	return &ClientColors{}
+}
+
+// Get return color capabilities of client and if it's known
+func (c *ClientColors) Get() (MTTSFlag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.colors, c.known
+}
+
+// Set update color capabilities of client, other capabilities in f are
+// ignored
+func (c *ClientColors) Set(f MTTSFlag) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.colors = f & mttsColors
+	c.known = true
+}
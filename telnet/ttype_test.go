@@ -0,0 +1,35 @@
+package telnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTTypeCycle(t *testing.T) {
+	opt := NewTTypeOption()
+	opt.SetIdentity("MYCLIENT", "xterm-256color")
+	opt.SetCapability(MTTS_UTF8, true)
+	opt.SetCapability(MTTS_VT100, false)
+	// truecolor is dropped as client doesn't support it
+	colors := NewClientColors()
+	colors.Set(MTTS_256COLORS)
+
+	s := &NVT{
+		Option:    &SessionOption{TType: opt, ClientColors: colors},
+		outBuffer: make(chan []byte, 10),
+	}
+
+	want := []string{"MYCLIENT", "XTERM-256COLOR", "MTTS 13", "MTTS 13", "MYCLIENT"}
+	for _, w := range want {
+		req := &IACPacket{cmd: SB, opt: O_TTYPE}
+		req.data.WriteByte(TTYPE_SEND)
+		s.handleTTYPE(req)
+
+		got := <-s.outBuffer
+		expect := append([]byte{byte(IAC), byte(SB), byte(O_TTYPE), TTYPE_IS}, w...)
+		expect = append(expect, byte(IAC), byte(SE))
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("got %q, want %q", got, expect)
+		}
+	}
+}
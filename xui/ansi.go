@@ -0,0 +1,126 @@
+package xui
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/defsky/xtelnet/telnet"
+)
+
+// styleTag return tview color tag of style s, tcell has no italic attribute
+// so italic text is drawn underlined
+func styleTag(s *telnet.SGRStyle) string {
+	fg, bg, attrs := s.Fg, s.Bg, ""
+	if fg == "" {
+		fg = "-"
+	}
+	if bg == "" {
+		bg = "-"
+	}
+	if s.Bold {
+		attrs += "b"
+	}
+	if s.Dim {
+		attrs += "d"
+	}
+	if s.Underline || s.Italic {
+		attrs += "u"
+	}
+	if s.Blink {
+		attrs += "l"
+	}
+	if s.Reverse {
+		attrs += "r"
+	}
+	if attrs == "" {
+		attrs = "-"
+	}
+	return "[" + fg + ":" + bg + ":" + attrs + "]"
+}
+
+// ansiRenderer is an io.Writer which translates SGR sequences into tview
+// color tags, other escape sequences are removed
+type ansiRenderer struct {
+	io.Writer
+	truecolor bool
+	style     telnet.SGRStyle
+	// pending holds incomplete escape sequence of last write
+	pending []byte
+}
+
+// newANSIRenderer return a renderer writing to w, 24-bit colors fall back to
+// the nearest palette entry if truecolor is false
+func newANSIRenderer(w io.Writer, truecolor bool) *ansiRenderer {
+	return &ansiRenderer{
+		Writer:    w,
+		truecolor: truecolor,
+	}
+}
+
+// hasTrueColor report if terminal supports 24-bit colors
+func hasTrueColor() bool {
+	switch os.Getenv("COLORTERM") {
+	case "truecolor", "24bit":
+		return true
+	}
+	return false
+}
+
+// has256Color report if terminal supports 256 colors
+func has256Color() bool {
+	return hasTrueColor() || strings.Contains(os.Getenv("TERM"), "256color")
+}
+
+// Write translates p and writes it to underlying writer
+func (a *ansiRenderer) Write(p []byte) (int, error) {
+	data := p
+	if len(a.pending) > 0 {
+		data = append(a.pending, p...)
+		a.pending = nil
+	}
+
+	out := new(bytes.Buffer)
+	r := bytes.NewReader(data)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != 0x1b {
+			out.WriteByte(b)
+			continue
+		}
+
+		start := len(data) - r.Len() - 1
+		seq, ctrl, err := telnet.ReadEscSeq(r)
+		out.Write(ctrl)
+		if err != nil {
+			// incomplete sequence, wait for the rest
+			a.pending = append([]byte{}, data[start:]...)
+			break
+		}
+		if seq == nil {
+			continue
+		}
+		a.render(out, seq)
+	}
+
+	if _, err := out.WriteTo(a.Writer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *ansiRenderer) render(out *bytes.Buffer, seq *telnet.EscSeq) {
+	switch seq.Type {
+	case telnet.ESC_SGR:
+		a.style.Apply(seq.ParamString, a.truecolor)
+		out.WriteString(styleTag(&a.style))
+	case telnet.ESC_CURSOR:
+		if seq.IsCSI() && seq.Final == 'E' {
+			out.WriteString(strings.Repeat("\n", seq.Param(0, 1)))
+		}
+	}
+}
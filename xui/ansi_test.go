@@ -0,0 +1,52 @@
+package xui
+
+import (
+	"bytes"
+	"testing"
+)
+
+var ansiGolden = []struct {
+	name      string
+	input     string
+	truecolor bool
+	want      string
+}{
+	{"plain", "hello", false, "hello"},
+	{"reset", "\x1b[0mx\x1b[m", false, "[-:-:-]x[-:-:-]"},
+	{"basic colors", "\x1b[31mred\x1b[42mbg", false, "[maroon:-:-]red[maroon:green:-]bg"},
+	{"bright colors", "\x1b[91;104mx", false, "[red:blue:-]x"},
+	{"bold and colors", "\x1b[1;33;44mx", false, "[olive:navy:b]x"},
+	{"attributes", "\x1b[1;2;4;5;7mx\x1b[22;24mx", false, "[-:-:bdulr]x[-:-:lr]x"},
+	{"italic drawn underlined", "\x1b[3mx\x1b[23mx", false, "[-:-:u]x[-:-:-]x"},
+	{"256 basic", "\x1b[38;5;9mx", false, "[red:-:-]x"},
+	{"256 cube", "\x1b[38;5;208mx", false, "[#ff8700:-:-]x"},
+	{"256 grey", "\x1b[48;5;240mx", false, "[-:#585858:-]x"},
+	{"256 fg and bg", "\x1b[38;5;196;48;5;21mx", false, "[#ff0000:#0000ff:-]x"},
+	{"truecolor", "\x1b[38;2;18;52;86mx", true, "[#123456:-:-]x"},
+	{"truecolor fallback", "\x1b[38;2;18;52;86mx", false, "[#005f5f:-:-]x"},
+	{"truecolor colon form", "\x1b[48:2::255:0:0mx", true, "[-:#ff0000:-]x"},
+	{"default colors", "\x1b[31;41mx\x1b[39mx\x1b[49mx", false, "[maroon:maroon:-]x[-:maroon:-]x[-:-:-]x"},
+	{"non SGR removed", "a\x1b[2Jb\x1b]0;title\x07c", false, "abc"},
+	{"next line", "a\x1b[2Eb", false, "a\n\nb"},
+}
+
+func TestANSIRendererGolden(t *testing.T) {
+	for _, c := range ansiGolden {
+		out := new(bytes.Buffer)
+		w := newANSIRenderer(out, c.truecolor)
+		w.Write([]byte(c.input))
+		if out.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, out.String(), c.want)
+		}
+	}
+}
+
+func TestANSIRendererSplitSequence(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := newANSIRenderer(out, false)
+	w.Write([]byte("a\x1b[38;5"))
+	w.Write([]byte(";208mb"))
+	if want := "a[#ff8700:-:-]b"; out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
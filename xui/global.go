@@ -4,6 +4,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/defsky/xtelnet/proto"
 	"github.com/defsky/xtelnet/session"
 
 	"github.com/gdamore/tcell"
@@ -26,6 +27,19 @@ var statusBar = tview.NewTable().
 		SetMaxWidth(40).
 		SetTextColor(tcell.ColorDarkMagenta))
 
+// showConnEvent show lifecycle event of connection in status bar, ev is
+// connection name and event separated by space
+func showConnEvent(ev string) {
+	name, state := ev, ""
+	if n := strings.IndexByte(ev, ' '); n >= 0 {
+		name, state = ev[:n], ev[n+1:]
+	}
+	app.QueueUpdateDraw(func() {
+		statusBar.GetCell(0, 0).SetText(" #" + name + " ")
+		statusBar.GetCell(0, 1).SetText(" " + state + " ")
+	})
+}
+
 var inputBox = tview.NewInputField().SetLabel("Telnet> ").
 	SetLabelColor(tcell.ColorYellow).
 	SetFieldBackgroundColor(tcell.ColorDefault)
@@ -38,8 +52,39 @@ var layout = tview.NewFlex().SetDirection(tview.FlexRow).
 const historyCmdLength = 1000
 
 var historyCmd = session.NewHistoryCmd(historyCmdLength)
+
+// peer is hello of the attached session, features are only used if it
+// advertises them
+var peer = &proto.Hello{}
+
 var inputCh = make(chan []byte, 10)
 
+// screenSize is size of screen in characters
+type screenSize struct {
+	rows uint16
+	cols uint16
+}
+
+var sizeCh = make(chan screenSize, 1)
+var lastSize screenSize
+
+// notifyScreenSize will send size to session if it was changed,
+// it should be called in draw function of screen
+func notifyScreenSize(rows, cols int) {
+	size := screenSize{rows: uint16(rows), cols: uint16(cols)}
+	if size == lastSize {
+		return
+	}
+	lastSize = size
+
+	// only the latest size need to be sent
+	select {
+	case <-sizeCh:
+	default:
+	}
+	sizeCh <- size
+}
+
 func init() {
 	historyCmd.LoadCache()
 
@@ -51,6 +96,10 @@ func init() {
 		} else {
 			screen.SetWrap(true)
 		}
+		// live output is only part of screen in scrollback mode
+		if !sb.active {
+			notifyScreenSize(height, width)
+		}
 		return x, y, width, height
 	})
 
@@ -120,6 +169,10 @@ func init() {
 		switch key {
 		case tcell.KeyCtrlC:
 			close(inputCh)
+		default:
+			if sb.handleKey(e) {
+				return nil
+			}
 		}
 		return e
 	})
@@ -0,0 +1,414 @@
+package xui
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/defsky/xtelnet/proto"
+
+	"github.com/gdamore/tcell"
+	"github.com/rivo/tview"
+)
+
+const (
+	// liveRows is height of live output below history in scrollback mode
+	liveRows = 6
+	// historyPage is number of output lines requested at a time
+	historyPage = 200
+	// wheelLines is number of lines scrolled by a mouse wheel step
+	wheelLines = 3
+)
+
+// historyView shows output fetched from session in scrollback mode
+var historyView = tview.NewTextView().
+	SetDynamicColors(true).SetRegions(true).
+	SetScrollable(true).SetWrap(false)
+
+var searchBox = tview.NewInputField().SetLabel("Search: ").
+	SetLabelColor(tcell.ColorYellow).
+	SetFieldBackgroundColor(tcell.ColorDefault)
+
+// historyCh passes id of output line to sender, lines before it are
+// requested from session
+var historyCh = make(chan uint64, 1)
+
+// scrollback is state of scrollback mode, it's only accessed in event loop
+// of app
+type scrollback struct {
+	active    bool
+	searching bool
+	// text is rendered history and lines is number of lines in it
+	text  string
+	lines int
+	// oldest is id of the oldest line fetched, 0 if nothing is fetched
+	oldest  uint64
+	pending bool
+	done    bool
+
+	query   string
+	matches []int
+	current int
+}
+
+var sb = &scrollback{}
+
+// requestHistory ask session for lines before id
+func (s *scrollback) requestHistory(id uint64) {
+	if s.pending || s.done {
+		return
+	}
+	if !peer.Has(proto.FeatureHistory) {
+		s.done = true
+		return
+	}
+	s.pending = true
+	select {
+	case historyCh <- id:
+	default:
+	}
+}
+
+// enter switch to scrollback mode, history is split from live output
+func (s *scrollback) enter() {
+	if s.active {
+		return
+	}
+	*s = scrollback{active: true}
+	historyView.Clear().Highlight()
+	layout.Clear().
+		AddItem(historyView, 0, 1, false).
+		AddItem(screen, liveRows, 0, false).
+		AddItem(statusBar, 1, 1, false).
+		AddItem(inputBox, 1, 1, true)
+	s.requestHistory(0)
+}
+
+// leave switch back to live output
+func (s *scrollback) leave() {
+	if !s.active {
+		return
+	}
+	*s = scrollback{}
+	historyView.Clear().Highlight()
+	searchBox.SetText("")
+	layout.Clear().
+		AddItem(screen, 0, 1, false).
+		AddItem(statusBar, 1, 1, false).
+		AddItem(inputBox, 1, 1, true)
+	app.SetFocus(inputBox)
+}
+
+// prepend add lines starting from id first to the top of history, they
+// are data of SM_HISTORY
+func (s *scrollback) prepend(first uint64, data []byte) {
+	s.pending = false
+	if !s.active {
+		return
+	}
+	if first == 0 {
+		s.done = true
+		return
+	}
+	if first <= 1 {
+		s.done = true
+	}
+
+	out := new(bytes.Buffer)
+	newANSIRenderer(out, hasTrueColor()).Write(data)
+	added := strings.Count(out.String(), "\n")
+	initial := s.oldest == 0
+	s.oldest = first
+	s.text = out.String() + s.text
+	s.lines += added
+
+	row, _ := historyView.GetScrollOffset()
+	matches := len(s.matches)
+	s.render()
+	s.highlight()
+	s.current += len(s.matches) - matches
+	if initial {
+		historyView.ScrollToEnd()
+	} else {
+		historyView.ScrollTo(row+added, 0)
+	}
+}
+
+// render set text of history view, matches of query are marked as regions
+func (s *scrollback) render() {
+	if len(s.query) == 0 {
+		s.matches = nil
+		historyView.SetText(s.text)
+		return
+	}
+	text, matches := markMatches(s.text, s.query)
+	s.matches = matches
+	historyView.SetText(text)
+}
+
+// highlight highlight all matches of query
+func (s *scrollback) highlight() {
+	ids := make([]string, len(s.matches))
+	for i := range s.matches {
+		ids[i] = matchRegion(i)
+	}
+	historyView.Highlight(ids...)
+}
+
+// scroll move history view by n lines, negative n scrolls up. Older
+// history is requested at the top, and scrolling down at the bottom leaves
+// scrollback mode.
+func (s *scrollback) scroll(n int) {
+	if !s.active {
+		if n >= 0 {
+			return
+		}
+		s.enter()
+		return
+	}
+
+	row, _ := historyView.GetScrollOffset()
+	_, _, _, height := historyView.GetInnerRect()
+	if n > 0 && row+height >= s.lines {
+		s.leave()
+		return
+	}
+	row += n
+	if row <= 0 {
+		row = 0
+		s.requestHistory(s.oldest)
+	}
+	historyView.ScrollTo(row, 0)
+}
+
+// page return number of lines in a page of history view
+func (s *scrollback) page() int {
+	_, _, _, height := historyView.GetInnerRect()
+	if height > 2 {
+		return height - 1
+	}
+	return 1
+}
+
+// startSearch show search box in place of input box
+func (s *scrollback) startSearch() {
+	s.enter()
+	s.searching = true
+	searchBox.SetText(s.query)
+	layout.RemoveItem(inputBox).AddItem(searchBox, 1, 1, true)
+	app.SetFocus(searchBox)
+}
+
+// stopSearch give input box back, matches are still highlighted
+func (s *scrollback) stopSearch() {
+	if !s.searching {
+		return
+	}
+	s.searching = false
+	layout.RemoveItem(searchBox).AddItem(inputBox, 1, 1, true)
+	app.SetFocus(inputBox)
+}
+
+// search highlight matches of query and show the last one
+func (s *scrollback) search(query string) {
+	s.query = query
+	s.render()
+	s.highlight()
+	s.current = len(s.matches)
+	s.next(-1)
+}
+
+// next show the match after current one, or before it if step is negative
+func (s *scrollback) next(step int) {
+	if len(s.matches) == 0 {
+		searchBox.SetLabel("Search: ")
+		return
+	}
+	s.current += step
+	if s.current < 0 {
+		s.current = 0
+		s.requestHistory(s.oldest)
+	}
+	if s.current >= len(s.matches) {
+		s.current = len(s.matches) - 1
+	}
+	searchBox.SetLabel(fmt.Sprintf("Search (%d/%d): ", s.current+1, len(s.matches)))
+
+	row := s.matches[s.current] - s.page()/2
+	if row < 0 {
+		row = 0
+	}
+	historyView.ScrollTo(row, 0)
+}
+
+// handleKey handle keys of scrollback mode and search, it return false if
+// key is not handled
+func (s *scrollback) handleKey(e *tcell.EventKey) bool {
+	switch e.Key() {
+	case tcell.KeyPgUp:
+		s.scroll(-s.page())
+	case tcell.KeyPgDn:
+		s.scroll(s.page())
+	case tcell.KeyUp, tcell.KeyDown:
+		if s.searching {
+			if e.Key() == tcell.KeyUp {
+				s.next(-1)
+			} else {
+				s.next(1)
+			}
+			return true
+		}
+		if e.Modifiers()&tcell.ModShift == 0 {
+			return false
+		}
+		if e.Key() == tcell.KeyUp {
+			s.scroll(-1)
+		} else {
+			s.scroll(1)
+		}
+	case tcell.KeyCtrlF:
+		s.startSearch()
+	case tcell.KeyEnter:
+		if !s.searching {
+			return false
+		}
+		s.next(-1)
+	case tcell.KeyEsc:
+		if s.searching {
+			s.stopSearch()
+		} else if s.active {
+			s.leave()
+		} else {
+			return false
+		}
+	case tcell.KeyRune:
+		// "/" starts search only if it's not the beginning of a command
+		if e.Rune() != '/' || !s.active || s.searching || len(inputBox.GetText()) > 0 {
+			return false
+		}
+		s.startSearch()
+	default:
+		return false
+	}
+	return true
+}
+
+// historyReq return packet requesting lines before id from session
+func historyReq(id uint64) *proto.Packet {
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_HISTORY_REQ
+	binary.Write(p, binary.BigEndian, id)
+	binary.Write(p, binary.BigEndian, uint16(historyPage))
+	return p
+}
+
+// tagPattern matches color and region tags of tview
+var tagPattern = regexp.MustCompile(`\[([a-zA-Z]+|#[0-9a-zA-Z]{6}|\-)?(:([a-zA-Z]+|#[0-9a-zA-Z]{6}|\-)?(:([lbdru]+|\-)?)?)?\]|\["[a-zA-Z0-9_,;: \-\.]*"\]`)
+
+// matchRegion return region id of the nth match
+func matchRegion(n int) string {
+	return fmt.Sprintf("m%d", n)
+}
+
+// foldCase return lower case of s if it has the same length, so that
+// positions in s are kept
+func foldCase(s string) string {
+	if l := strings.ToLower(s); len(l) == len(s) {
+		return l
+	}
+	return s
+}
+
+// markMatches wrap case-insensitive matches of query in text with region
+// tags, and return line number of each match
+func markMatches(text, query string) (string, []int) {
+	query = foldCase(query)
+	out := new(strings.Builder)
+	matches := []int{}
+	for n, line := range strings.Split(text, "\n") {
+		if n > 0 {
+			out.WriteByte('\n')
+		}
+
+		// offset[i] is position of the ith plain byte in line
+		plain := new(strings.Builder)
+		offset := []int{}
+		pos := 0
+		for _, tag := range tagPattern.FindAllStringIndex(line, -1) {
+			for i := pos; i < tag[0]; i++ {
+				offset = append(offset, i)
+			}
+			plain.WriteString(line[pos:tag[0]])
+			pos = tag[1]
+		}
+		for i := pos; i < len(line); i++ {
+			offset = append(offset, i)
+		}
+		plain.WriteString(line[pos:])
+
+		lower := foldCase(plain.String())
+		pos = 0
+		for start := 0; start < len(lower); {
+			i := strings.Index(lower[start:], query)
+			if i < 0 {
+				break
+			}
+			begin, end := start+i, start+i+len(query)
+			out.WriteString(line[pos:offset[begin]])
+			out.WriteString(`["` + matchRegion(len(matches)) + `"]`)
+			out.WriteString(line[offset[begin] : offset[end-1]+1])
+			out.WriteString(`[""]`)
+			pos = offset[end-1] + 1
+			matches = append(matches, n)
+			start = end
+		}
+		out.WriteString(line[pos:])
+	}
+	return out.String(), matches
+}
+
+// wheelScreen turns mouse wheel events into scrolling, tview drops mouse
+// events
+type wheelScreen struct {
+	tcell.Screen
+}
+
+func (w *wheelScreen) PollEvent() tcell.Event {
+	for {
+		e := w.Screen.PollEvent()
+		m, ok := e.(*tcell.EventMouse)
+		if !ok {
+			return e
+		}
+		switch {
+		case m.Buttons()&tcell.WheelUp != 0:
+			app.QueueUpdateDraw(func() { sb.scroll(-wheelLines) })
+		case m.Buttons()&tcell.WheelDown != 0:
+			app.QueueUpdateDraw(func() { sb.scroll(wheelLines) })
+		}
+	}
+}
+
+// newScreen return screen of app with mouse wheel enabled
+func newScreen() (tcell.Screen, error) {
+	s, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	s.EnableMouse()
+	return &wheelScreen{s}, nil
+}
+
+func init() {
+	historyView.SetBorder(true).SetTitle(" scrollback: Esc to leave, / or Ctrl-F to search ")
+
+	searchBox.SetBackgroundColor(tcell.ColorDefault)
+	searchBox.SetChangedFunc(func(text string) {
+		sb.search(text)
+	})
+}
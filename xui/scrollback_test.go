@@ -0,0 +1,31 @@
+package xui
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkMatches(t *testing.T) {
+	cases := []struct {
+		name    string
+		text    string
+		query   string
+		want    string
+		matches []int
+	}{
+		{"plain", "foo bar\nbar foo", "foo",
+			`["m0"]foo[""] bar` + "\n" + `bar ["m1"]foo[""]`, []int{0, 1}},
+		{"case", "Foo FOO", "foo",
+			`["m0"]Foo[""] ["m1"]FOO[""]`, []int{0, 0}},
+		{"across tags", "[red]fo[blue]o[-]", "foo",
+			`[red]["m0"]fo[blue]o[""][-]`, []int{0}},
+		{"no match", "[red]bar[-]", "foo", "[red]bar[-]", []int{}},
+		{"tag text not matched", "[red]x", "red", "[red]x", []int{}},
+	}
+	for _, c := range cases {
+		text, matches := markMatches(c.text, c.query)
+		if text != c.want || !reflect.DeepEqual(matches, c.matches) {
+			t.Errorf("%s: got %q %v, want %q %v", c.name, text, matches, c.want, c.matches)
+		}
+	}
+}
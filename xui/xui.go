@@ -1,6 +1,7 @@
 package xui
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -23,7 +24,7 @@ type UI interface {
 
 // XUI is an extensible UI object
 type XUI struct {
-	conn        *net.UnixConn
+	conn        net.Conn
 	widgets     []tview.Primitive
 	stopMsg     string
 	sessionName string
@@ -78,50 +79,57 @@ func getSessionName(name string) (string, error) {
 	return matchedSession[0], nil
 }
 
+// AttachOptions are options of attaching session
+type AttachOptions struct {
+	// Detach detaches any other client
+	Detach bool
+	// Readonly attaches as spectator whose input is refused
+	Readonly bool
+	// Remote is used if session is on other host
+	Remote session.RemoteOptions
+}
+
 // Attach will attach to specified session
-//  name  : string, session name
-//  detach: bool, if detach other
-func (ui *XUI) Attach(name string, detach bool) {
+//  name: string, session name, or "host:port/name" of session on other host
+//  opts: AttachOptions
+func (ui *XUI) Attach(name string, opts AttachOptions) {
 	defer func() {
 		if len(ui.stopMsg) > 0 {
 			fmt.Printf("  %s\n", ui.stopMsg)
 		}
 	}()
 
-	s, err := getSessionName(name)
-	if err != nil {
-		ui.stopMsg = fmt.Sprintf("%s", err.Error())
-		return
-	}
-	ui.sessionName = s
-	homedir, err := session.SocketHomeDir()
-	if err != nil {
-		ui.stopMsg = fmt.Sprintf("%s", err.Error())
-		return
-	}
-	fpath := filepath.Join(homedir, s)
-
-	sessionAddr, err := net.ResolveUnixAddr("unix", fpath)
-	if err != nil {
-		ui.stopMsg = fmt.Sprintf("%s", err.Error())
+	var conn net.Conn
+	var err error
+	if n := strings.LastIndexByte(name, '/'); n >= 0 {
+		ui.sessionName = name
+		conn, peer, err = session.DialRemote(name[:n], name[n+1:], opts.Remote)
+		if err != nil {
+			ui.stopMsg = fmt.Sprintf("Attach error: %s", err.Error())
+			return
+		}
+	} else if conn, err = ui.dialLocal(name); err != nil {
+		ui.stopMsg = err.Error()
 		return
 	}
+	defer conn.Close()
 
-	conn, err := net.DialUnix("unix", nil, sessionAddr)
-	if err != nil {
-		os.Remove(fpath)
-		ui.stopMsg = fmt.Sprintf("%s", err.Error())
+	if opts.Readonly && !peer.Has(proto.FeatureReadOnly) {
+		ui.stopMsg = "Attach error: session does not support read-only attaching"
 		return
 	}
-	defer conn.Close()
 
 	p := &proto.Packet{}
 	p.Opcode = proto.CM_ATTACH_REQ
-	if detach {
-		p.WriteByte(byte(1))
-	} else {
-		p.WriteByte(byte(0))
+	var flags uint8
+	if opts.Detach {
+		flags |= 1
+	}
+	if opts.Readonly {
+		flags |= 2
+		inputBox.SetLabel("Read-only> ")
 	}
+	p.WriteByte(byte(flags))
 	if err := proto.WritePacket(conn, p); err != nil {
 		ui.stopMsg = fmt.Sprintf("Attach error: %s", err.Error())
 		return
@@ -150,12 +158,68 @@ func (ui *XUI) Attach(name string, detach bool) {
 	}
 	ui.conn = conn
 
+	if peer.Has(proto.FeatureClientColors) {
+		if err := ui.sendColors(); err != nil {
+			ui.stopMsg = fmt.Sprintf("Attach error: %s", err.Error())
+			return
+		}
+	}
+
 	go ui.receiver()
 	go ui.sender()
 
 	ui.run()
 }
 
+// dialLocal connect session name on this host and handshake with it
+func (ui *XUI) dialLocal(name string) (net.Conn, error) {
+	s, err := getSessionName(name)
+	if err != nil {
+		return nil, err
+	}
+	ui.sessionName = s
+	homedir, err := session.SocketHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	fpath := filepath.Join(homedir, s)
+
+	sessionAddr, err := net.ResolveUnixAddr("unix", fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUnix("unix", nil, sessionAddr)
+	if err != nil {
+		os.Remove(fpath)
+		return nil, err
+	}
+
+	if peer, err = proto.ClientHandshake(conn); err != nil {
+		conn.Close()
+		if err == proto.ENoHandshake {
+			return nil, errors.New("Attach error: session is run by an older xtelnet, restart it to attach")
+		}
+		return nil, fmt.Errorf("Attach error: %s", err.Error())
+	}
+	return conn, nil
+}
+
+// sendColors report colors supported by terminal to session
+func (ui *XUI) sendColors() error {
+	var colors uint8
+	if has256Color() {
+		colors |= 1
+	}
+	if hasTrueColor() {
+		colors |= 2
+	}
+	p := &proto.Packet{}
+	p.Opcode = proto.CM_CLIENT_COLORS
+	p.WriteByte(byte(colors))
+	return proto.WritePacket(ui.conn, p)
+}
+
 func (ui *XUI) sender() {
 	defer ui.conn.Close()
 
@@ -175,6 +239,20 @@ DONE:
 				fmt.Fprintln(screen, err)
 				break DONE
 			}
+		case id := <-historyCh:
+			if err := proto.WritePacket(ui.conn, historyReq(id)); err != nil {
+				fmt.Fprintln(screen, err)
+				break DONE
+			}
+		case size := <-sizeCh:
+			p := &proto.Packet{}
+			p.Opcode = proto.CM_SCREEN_SIZE
+			binary.Write(p, binary.BigEndian, size.rows)
+			binary.Write(p, binary.BigEndian, size.cols)
+			if err := proto.WritePacket(ui.conn, p); err != nil {
+				fmt.Fprintln(screen, err)
+				break DONE
+			}
 		}
 	}
 }
@@ -182,7 +260,7 @@ DONE:
 func (ui *XUI) receiver() {
 	defer ui.conn.Close()
 
-	ansiW := tview.ANSIWriter(screen)
+	ansiW := newANSIRenderer(screen, hasTrueColor())
 
 	// r := bufio.NewReader(ui.conn)
 DONE:
@@ -194,10 +272,8 @@ DONE:
 		p, err := proto.ReadPacket(ui.conn)
 		if err != nil {
 			if err == proto.EInvalidPacket {
-				fmt.Fprintf(ansiW, "[red]%s\n[-]", err.Error())
-				continue
-			}
-			if err == io.EOF {
+				ui.stopMsg = fmt.Sprintf("Detached from session %s: %s", ui.sessionName, err.Error())
+			} else if err == io.EOF {
 				ui.stopMsg = fmt.Sprintf("Remotely detached from session: %s", ui.sessionName)
 			} else {
 				ui.stopMsg = fmt.Sprintf("Detached from session: %s", ui.sessionName)
@@ -214,6 +290,17 @@ DONE:
 					break DONE
 				}
 			}
+		case proto.SM_CONN_EVENT:
+			showConnEvent(p.String())
+		case proto.SM_HISTORY:
+			if p.Len() < 8 {
+				continue
+			}
+			first := binary.BigEndian.Uint64(p.Next(8))
+			data := p.Bytes()
+			app.QueueUpdateDraw(func() {
+				sb.prepend(first, data)
+			})
 		default:
 			fmt.Fprint(ansiW, p.String())
 		}
@@ -226,7 +313,11 @@ DONE:
 }
 
 func (ui *XUI) run() error {
-	if err := app.SetRoot(layout, true).Run(); err != nil {
+	s, err := newScreen()
+	if err != nil {
+		return err
+	}
+	if err := app.SetScreen(s).SetRoot(layout, true).Run(); err != nil {
 		panic(err)
 	}
 